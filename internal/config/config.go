@@ -8,15 +8,70 @@ import (
 )
 
 type StorageConfig struct {
-	Name       string `mapstructure:"name"`    // Unique name for this storage config
-	Type       string `mapstructure:"type"`    // "local" or "s3"
-	IsDefault  bool   `mapstructure:"default"` // Whether this is the default storage
-	Path       string `mapstructure:"path"`    // for local storage
+	Name       string `mapstructure:"name"`      // Unique name for this storage config
+	Type       string `mapstructure:"type"`      // "local", "s3", "webdav" or "memory"
+	IsDefault  bool   `mapstructure:"default"`   // Whether this is the default storage
+	Path       string `mapstructure:"path"`      // for local storage
+	Layout     string `mapstructure:"layout"`    // Directories of new local content, "date" or "hash"
+	FileMode   string `mapstructure:"file_mode"` // Octal permissions of local files (e.g., "0640")
+	DirMode    string `mapstructure:"dir_mode"`  // Octal permissions of local directories (e.g., "0750")
 	S3Bucket   string `mapstructure:"s3_bucket"`
 	S3Region   string `mapstructure:"s3_region"`
 	S3Key      string `mapstructure:"s3_key"`
 	S3Secret   string `mapstructure:"s3_secret"`
 	S3Endpoint string `mapstructure:"s3_endpoint"`
+
+	// Raw and download requests for content in S3 are redirected to presigned
+	// URLs valid for this long, instead of being proxied. Zero disables it.
+	S3PresignExpiry time.Duration `mapstructure:"s3_presign_expiry"`
+
+	// WebDAV servers are authenticated against with basic auth when a
+	// username or password is set
+	WebDAVURL      string `mapstructure:"webdav_url"` // Collection content is kept in, e.g. "https://nas.local/dav/pastes"
+	WebDAVUsername string `mapstructure:"webdav_username"`
+	WebDAVPassword string `mapstructure:"webdav_password"`
+
+	// Connecting to a WebDAV server, and waiting for it to start responding,
+	// fails after this long. Zero uses a default of 30 seconds.
+	WebDAVTimeout time.Duration `mapstructure:"webdav_timeout"`
+
+	// Content is mirrored to the storage named here, which is then only used
+	// as a replica of this one. Reads fail over to the replica when this
+	// storage fails.
+	Replica     string `mapstructure:"replica"`
+	ReplicaMode string `mapstructure:"replica_mode"` // "sync" to write both before returning (default), or "async" to queue writes to the replica
+
+	// Bytes the storage can hold, which upload watermarks are measured
+	// against. Local storages without one use the size of their filesystem.
+	Capacity int64 `mapstructure:"capacity"`
+
+	// Encryption at rest. Content is encrypted when EncryptionKey is set, and
+	// content encrypted under any of the previous keys can still be read until
+	// it has been re-wrapped with the current key.
+	EncryptionKey          string   `mapstructure:"encryption_key"`           // base64 encoded 256-bit master key
+	EncryptionPreviousKeys []string `mapstructure:"encryption_previous_keys"` // base64 encoded keys being rotated out
+
+	// Read-through cache in front of the storage, used when a cache size or
+	// disk path is set. Content is cached as it's stored, so encrypted content
+	// stays encrypted in the cache.
+	CacheSize        int64  `mapstructure:"cache_size"`          // Bytes of content cached in memory
+	CacheMaxItemSize int64  `mapstructure:"cache_max_item_size"` // Largest content cached in memory, an eighth of the cache size by default
+	CacheDiskPath    string `mapstructure:"cache_disk_path"`     // Directory of a larger cache tier on local disk
+	CacheDiskSize    int64  `mapstructure:"cache_disk_size"`     // Bytes of content cached on disk
+}
+
+// StorageRouteConfig is a rule choosing the storage new pastes are put in.
+// Routes are tried in order and the first one that matches is used; pastes
+// that match none go to the default storage. Conditions that aren't set match
+// any paste.
+type StorageRouteConfig struct {
+	Name      string   `mapstructure:"name"`       // Shown in the stats, defaults to the storage name
+	Storage   string   `mapstructure:"storage"`    // Name of the storage config to use
+	MinSize   int64    `mapstructure:"min_size"`   // Smallest matching size in bytes
+	MaxSize   int64    `mapstructure:"max_size"`   // Largest matching size in bytes
+	MimeTypes []string `mapstructure:"mime_types"` // MIME types, such as "application/pdf" or "image/*"
+	APIKeys   []string `mapstructure:"api_keys"`   // API keys the pastes are created with
+	Private   *bool    `mapstructure:"private"`    // Whether the pastes are private
 }
 
 type DatabaseConfig struct {
@@ -33,6 +88,33 @@ type CleanupConfig struct {
 	Enabled  bool   `mapstructure:"enabled"`
 	Interval int    `mapstructure:"interval"` // in seconds
 	MaxAge   string `mapstructure:"max_age"`  // duration string (e.g., "168h")
+
+	Reconcile ReconcileConfig `mapstructure:"reconcile"`
+}
+
+type ReconcileConfig struct {
+	Enabled bool          `mapstructure:"enabled"` // Check stored content against the database on each cleanup run
+	Repair  bool          `mapstructure:"repair"`  // Delete what's found instead of only reporting it
+	MinAge  time.Duration `mapstructure:"min_age"` // How old unreferenced content has to be to count as orphaned (e.g., "24h")
+}
+
+type ScrubConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`  // Periodically re-hash stored content to detect corruption
+	Interval time.Duration `mapstructure:"interval"` // How often all stored content is re-hashed (e.g., "24h")
+}
+
+// QuotaConfig limits how much storage uploads can take up. Watermarks are
+// shares of a storage's capacity, and zero disables them; anonymous uploads
+// are turned away at their own, lower watermark before keyed ones are.
+type QuotaConfig struct {
+	PerKey             int64   `mapstructure:"per_key"`             // Bytes of pastes each API key can keep stored, unless set on the key; zero is unlimited
+	AnonymousWatermark float64 `mapstructure:"anonymous_watermark"` // Share of capacity above which anonymous uploads are rejected (e.g., 0.85)
+	Watermark          float64 `mapstructure:"watermark"`           // Share of capacity above which all uploads are rejected (e.g., 0.95)
+}
+
+type ResumableUploadConfig struct {
+	Enabled bool          `mapstructure:"enabled"` // Enable the tus resumable upload endpoint
+	Expiry  time.Duration `mapstructure:"expiry"`  // How long an upload is kept around (e.g., "24h")
 }
 
 type GlobalRateLimitConfig struct {
@@ -55,19 +137,23 @@ type RateLimitConfig struct {
 }
 
 type ServerConfig struct {
-	Address           string          `mapstructure:"address"`
-	BaseURL           string          `mapstructure:"base_url"`
-	MaxUploadSize     int             `mapstructure:"max_upload_size"`
-	DefaultUploadSize int             `mapstructure:"default_upload_size"`
-	APIUploadSize     int             `mapstructure:"api_upload_size"`
-	Prefork           bool            `mapstructure:"prefork"`
-	ServerHeader      string          `mapstructure:"server_header"`
-	AppName           string          `mapstructure:"app_name"`
-	Cleanup           CleanupConfig   `mapstructure:"cleanup"`
-	RateLimit         RateLimitConfig `mapstructure:"rate_limit"`
-	CORSOrigins       []string        `mapstructure:"cors_origins"`
-	ViewsDirectory    string          `mapstructure:"views_directory"`
-	PublicDirectory   string          `mapstructure:"public_directory"`
+	Address           string                `mapstructure:"address"`
+	BaseURL           string                `mapstructure:"base_url"`
+	MaxUploadSize     int                   `mapstructure:"max_upload_size"`
+	DefaultUploadSize int                   `mapstructure:"default_upload_size"`
+	APIUploadSize     int                   `mapstructure:"api_upload_size"`
+	MaxDiffSize       int                   `mapstructure:"max_diff_size"` // Largest paste that can be diffed, 0 for no limit
+	Prefork           bool                  `mapstructure:"prefork"`
+	ServerHeader      string                `mapstructure:"server_header"`
+	AppName           string                `mapstructure:"app_name"`
+	Cleanup           CleanupConfig         `mapstructure:"cleanup"`
+	Scrub             ScrubConfig           `mapstructure:"scrub"`
+	Quota             QuotaConfig           `mapstructure:"quota"`
+	ResumableUploads  ResumableUploadConfig `mapstructure:"resumable_uploads"`
+	RateLimit         RateLimitConfig       `mapstructure:"rate_limit"`
+	CORSOrigins       []string              `mapstructure:"cors_origins"`
+	ViewsDirectory    string                `mapstructure:"views_directory"`
+	PublicDirectory   string                `mapstructure:"public_directory"`
 }
 
 type SMTPConfig struct {
@@ -106,6 +192,19 @@ type Config struct {
 	SMTP      SMTPConfig      `mapstructure:"smtp"`
 	Redis     RedisConfig     `mapstructure:"redis"`
 	Retention RetentionConfig `mapstructure:"retention"`
+
+	StorageRoutes []StorageRouteConfig `mapstructure:"storage_routes"`
+}
+
+// IsReplica reports whether the named storage is the replica of another one,
+// which makes it unavailable as a storage of its own
+func (c *Config) IsReplica(name string) bool {
+	for _, storage := range c.Storage {
+		if storage.Replica == name {
+			return true
+		}
+	}
+	return false
 }
 
 func Load() (*Config, error) {
@@ -128,6 +227,7 @@ func Load() (*Config, error) {
 	_ = viper.BindEnv("server.max_upload_size", "0X_SERVER_MAX_UPLOAD_SIZE")
 	_ = viper.BindEnv("server.default_upload_size", "0X_SERVER_DEFAULT_UPLOAD_SIZE")
 	_ = viper.BindEnv("server.api_upload_size", "0X_SERVER_API_UPLOAD_SIZE")
+	_ = viper.BindEnv("server.max_diff_size", "0X_SERVER_MAX_DIFF_SIZE")
 	_ = viper.BindEnv("server.prefork", "0X_SERVER_PREFORK")
 	_ = viper.BindEnv("server.server_header", "0X_SERVER_SERVER_HEADER")
 	_ = viper.BindEnv("server.app_name", "0X_SERVER_APP_NAME")
@@ -139,6 +239,22 @@ func Load() (*Config, error) {
 	_ = viper.BindEnv("server.cleanup.enabled", "0X_SERVER_CLEANUP_ENABLED")
 	_ = viper.BindEnv("server.cleanup.interval", "0X_SERVER_CLEANUP_INTERVAL")
 	_ = viper.BindEnv("server.cleanup.max_age", "0X_SERVER_CLEANUP_MAX_AGE")
+	_ = viper.BindEnv("server.cleanup.reconcile.enabled", "0X_SERVER_CLEANUP_RECONCILE_ENABLED")
+	_ = viper.BindEnv("server.cleanup.reconcile.repair", "0X_SERVER_CLEANUP_RECONCILE_REPAIR")
+	_ = viper.BindEnv("server.cleanup.reconcile.min_age", "0X_SERVER_CLEANUP_RECONCILE_MIN_AGE")
+
+	// Server scrub bindings
+	_ = viper.BindEnv("server.scrub.enabled", "0X_SERVER_SCRUB_ENABLED")
+	_ = viper.BindEnv("server.scrub.interval", "0X_SERVER_SCRUB_INTERVAL")
+
+	// Storage quota bindings
+	_ = viper.BindEnv("server.quota.per_key", "0X_SERVER_QUOTA_PER_KEY")
+	_ = viper.BindEnv("server.quota.anonymous_watermark", "0X_SERVER_QUOTA_ANONYMOUS_WATERMARK")
+	_ = viper.BindEnv("server.quota.watermark", "0X_SERVER_QUOTA_WATERMARK")
+
+	// Resumable upload bindings
+	_ = viper.BindEnv("server.resumable_uploads.enabled", "0X_SERVER_RESUMABLE_UPLOADS_ENABLED")
+	_ = viper.BindEnv("server.resumable_uploads.expiry", "0X_SERVER_RESUMABLE_UPLOADS_EXPIRY")
 
 	// Rate limit bindings
 	_ = viper.BindEnv("server.rate_limit.global.enabled", "0X_SERVER_RATE_LIMIT_GLOBAL_ENABLED")
@@ -201,12 +317,20 @@ func Load() (*Config, error) {
 	viper.SetDefault("server.max_upload_size", 5242880)      // 5MB default
 	viper.SetDefault("server.default_upload_size", 10485760) // 10MB default
 	viper.SetDefault("server.api_upload_size", 52428800)     // 50MB default
+	viper.SetDefault("server.max_diff_size", 1048576)        // 1MB default
 	viper.SetDefault("server.prefork", false)
 	viper.SetDefault("server.server_header", "Paste69")
 	viper.SetDefault("server.app_name", "Paste69")
 	viper.SetDefault("server.cleanup.enabled", true)
 	viper.SetDefault("server.cleanup.interval", 3600)
 	viper.SetDefault("server.cleanup.max_age", "168h")
+	viper.SetDefault("server.cleanup.reconcile.enabled", false)
+	viper.SetDefault("server.cleanup.reconcile.repair", false)
+	viper.SetDefault("server.cleanup.reconcile.min_age", "24h")
+	viper.SetDefault("server.scrub.enabled", false)
+	viper.SetDefault("server.scrub.interval", "24h")
+	viper.SetDefault("server.resumable_uploads.enabled", true)
+	viper.SetDefault("server.resumable_uploads.expiry", "24h")
 	viper.SetDefault("server.cors_origins", []string{"*"})
 	viper.SetDefault("server.views_directory", "./views")
 	viper.SetDefault("server.public_directory", "./public")
@@ -254,11 +378,28 @@ func Load() (*Config, error) {
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.type", i), "0X_"+prefix+"TYPE")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.default", i), "0X_"+prefix+"DEFAULT")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.path", i), "0X_"+prefix+"PATH")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.layout", i), "0X_"+prefix+"LAYOUT")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.file_mode", i), "0X_"+prefix+"FILE_MODE")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.dir_mode", i), "0X_"+prefix+"DIR_MODE")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_bucket", i), "0X_"+prefix+"S3_BUCKET")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_region", i), "0X_"+prefix+"S3_REGION")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_key", i), "0X_"+prefix+"S3_KEY")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_secret", i), "0X_"+prefix+"S3_SECRET")
 		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_endpoint", i), "0X_"+prefix+"S3_ENDPOINT")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.s3_presign_expiry", i), "0X_"+prefix+"S3_PRESIGN_EXPIRY")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.webdav_url", i), "0X_"+prefix+"WEBDAV_URL")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.webdav_username", i), "0X_"+prefix+"WEBDAV_USERNAME")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.webdav_password", i), "0X_"+prefix+"WEBDAV_PASSWORD")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.webdav_timeout", i), "0X_"+prefix+"WEBDAV_TIMEOUT")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.replica", i), "0X_"+prefix+"REPLICA")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.replica_mode", i), "0X_"+prefix+"REPLICA_MODE")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.capacity", i), "0X_"+prefix+"CAPACITY")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.encryption_key", i), "0X_"+prefix+"ENCRYPTION_KEY")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.encryption_previous_keys", i), "0X_"+prefix+"ENCRYPTION_PREVIOUS_KEYS")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.cache_size", i), "0X_"+prefix+"CACHE_SIZE")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.cache_max_item_size", i), "0X_"+prefix+"CACHE_MAX_ITEM_SIZE")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.cache_disk_path", i), "0X_"+prefix+"CACHE_DISK_PATH")
+		_ = viper.BindEnv(fmt.Sprintf("storage.%d.cache_disk_size", i), "0X_"+prefix+"CACHE_DISK_SIZE")
 
 		// Check if this storage backend is configured
 		if name := viper.GetString(fmt.Sprintf("storage.%d.name", i)); name != "" {
@@ -267,11 +408,33 @@ func Load() (*Config, error) {
 				Type:       viper.GetString(fmt.Sprintf("storage.%d.type", i)),
 				IsDefault:  viper.GetBool(fmt.Sprintf("storage.%d.default", i)),
 				Path:       viper.GetString(fmt.Sprintf("storage.%d.path", i)),
+				Layout:     viper.GetString(fmt.Sprintf("storage.%d.layout", i)),
+				FileMode:   viper.GetString(fmt.Sprintf("storage.%d.file_mode", i)),
+				DirMode:    viper.GetString(fmt.Sprintf("storage.%d.dir_mode", i)),
 				S3Bucket:   viper.GetString(fmt.Sprintf("storage.%d.s3_bucket", i)),
 				S3Region:   viper.GetString(fmt.Sprintf("storage.%d.s3_region", i)),
 				S3Key:      viper.GetString(fmt.Sprintf("storage.%d.s3_key", i)),
 				S3Secret:   viper.GetString(fmt.Sprintf("storage.%d.s3_secret", i)),
 				S3Endpoint: viper.GetString(fmt.Sprintf("storage.%d.s3_endpoint", i)),
+
+				S3PresignExpiry: viper.GetDuration(fmt.Sprintf("storage.%d.s3_presign_expiry", i)),
+
+				WebDAVURL:      viper.GetString(fmt.Sprintf("storage.%d.webdav_url", i)),
+				WebDAVUsername: viper.GetString(fmt.Sprintf("storage.%d.webdav_username", i)),
+				WebDAVPassword: viper.GetString(fmt.Sprintf("storage.%d.webdav_password", i)),
+				WebDAVTimeout:  viper.GetDuration(fmt.Sprintf("storage.%d.webdav_timeout", i)),
+
+				Replica:     viper.GetString(fmt.Sprintf("storage.%d.replica", i)),
+				ReplicaMode: viper.GetString(fmt.Sprintf("storage.%d.replica_mode", i)),
+				Capacity:    viper.GetInt64(fmt.Sprintf("storage.%d.capacity", i)),
+
+				EncryptionKey:          viper.GetString(fmt.Sprintf("storage.%d.encryption_key", i)),
+				EncryptionPreviousKeys: viper.GetStringSlice(fmt.Sprintf("storage.%d.encryption_previous_keys", i)),
+
+				CacheSize:        viper.GetInt64(fmt.Sprintf("storage.%d.cache_size", i)),
+				CacheMaxItemSize: viper.GetInt64(fmt.Sprintf("storage.%d.cache_max_item_size", i)),
+				CacheDiskPath:    viper.GetString(fmt.Sprintf("storage.%d.cache_disk_path", i)),
+				CacheDiskSize:    viper.GetInt64(fmt.Sprintf("storage.%d.cache_disk_size", i)),
 			}
 			storageConfigs = append(storageConfigs, storage)
 		}
@@ -282,5 +445,42 @@ func Load() (*Config, error) {
 		config.Storage = storageConfigs
 	}
 
+	// Storage routes can be configured the same way
+	const maxStorageRoutes = 10
+	routeConfigs := []StorageRouteConfig{}
+
+	for i := 0; i < maxStorageRoutes; i++ {
+		prefix := fmt.Sprintf("STORAGE_ROUTE_%d_", i)
+
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.name", i), "0X_"+prefix+"NAME")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.storage", i), "0X_"+prefix+"STORAGE")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.min_size", i), "0X_"+prefix+"MIN_SIZE")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.max_size", i), "0X_"+prefix+"MAX_SIZE")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.mime_types", i), "0X_"+prefix+"MIME_TYPES")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.api_keys", i), "0X_"+prefix+"API_KEYS")
+		_ = viper.BindEnv(fmt.Sprintf("storage_routes.%d.private", i), "0X_"+prefix+"PRIVATE")
+
+		// Check if this route is configured
+		if storage := viper.GetString(fmt.Sprintf("storage_routes.%d.storage", i)); storage != "" {
+			route := StorageRouteConfig{
+				Name:      viper.GetString(fmt.Sprintf("storage_routes.%d.name", i)),
+				Storage:   storage,
+				MinSize:   viper.GetInt64(fmt.Sprintf("storage_routes.%d.min_size", i)),
+				MaxSize:   viper.GetInt64(fmt.Sprintf("storage_routes.%d.max_size", i)),
+				MimeTypes: viper.GetStringSlice(fmt.Sprintf("storage_routes.%d.mime_types", i)),
+				APIKeys:   viper.GetStringSlice(fmt.Sprintf("storage_routes.%d.api_keys", i)),
+			}
+			if private := fmt.Sprintf("storage_routes.%d.private", i); viper.GetString(private) != "" {
+				value := viper.GetBool(private)
+				route.Private = &value
+			}
+			routeConfigs = append(routeConfigs, route)
+		}
+	}
+
+	if len(routeConfigs) > 0 {
+		config.StorageRoutes = routeConfigs
+	}
+
 	return &config, nil
 }
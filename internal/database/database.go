@@ -2,9 +2,14 @@ package database
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/glebarez/sqlite"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/watzon/0x45/internal/config"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -28,6 +33,8 @@ func New(config *config.Config, gormConfig *gorm.Config) (*Database, error) {
 			config.Database.SSLMode,
 		)
 		dialector = postgres.Open(dsn)
+	case "mysql":
+		dialector = mysql.Open(mysqlDSN(config.Database))
 	case "sqlite":
 		dialector = sqlite.Open(config.Database.Name)
 	default:
@@ -42,6 +49,32 @@ func New(config *config.Config, gormConfig *gorm.Config) (*Database, error) {
 	return &Database{db}, nil
 }
 
+// mysqlDSN returns the DSN of a MySQL or MariaDB database. Times are kept in
+// UTC, and the sslmode is taken as the TLS setting of the driver, with the
+// postgres modes mapped onto it.
+func mysqlDSN(cfg config.DatabaseConfig) string {
+	dsn := mysqldriver.NewConfig()
+	dsn.User = cfg.User
+	dsn.Passwd = cfg.Password
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	dsn.DBName = cfg.Name
+	dsn.ParseTime = true
+	dsn.Loc = time.UTC
+	dsn.Params = map[string]string{"charset": "utf8mb4"}
+
+	switch cfg.SSLMode {
+	case "", "disable":
+	case "require":
+		dsn.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		dsn.TLSConfig = "true"
+	default:
+		dsn.TLSConfig = cfg.SSLMode
+	}
+	return dsn.FormatDSN()
+}
+
 func (d *Database) Close() error {
 	db, err := d.DB.DB()
 	if err != nil {
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Dialect is the SQL dialect of a database, for the queries that can't be
+// written the same way for all of the supported databases
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+	MySQL    Dialect = "mysql"
+)
+
+// DialectOf returns the dialect of db
+func DialectOf(db *gorm.DB) Dialect {
+	return Dialect(db.Dialector.Name())
+}
+
+// Date returns an expression for the day of a timestamp column, formatted as
+// YYYY-MM-DD, so rows can be grouped by day and the days scanned as strings
+// whatever the database
+func (d Dialect) Date(column string) string {
+	switch d {
+	case Postgres:
+		return fmt.Sprintf("TO_CHAR(%s, 'YYYY-MM-DD')", column)
+	case MySQL:
+		return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m-%%d')", column)
+	default:
+		return fmt.Sprintf("DATE(%s)", column)
+	}
+}
+
+// UpdateReturning returns whether an UPDATE can return columns of the rows it
+// changed. MySQL can't, and MariaDB only can for INSERT and DELETE.
+func (d Dialect) UpdateReturning() bool {
+	return d != MySQL
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/models"
+)
+
+func TestDialect(t *testing.T) {
+	db := newTestDatabase(t)
+	require.NoError(t, db.Migrate(nil))
+	assert.Equal(t, SQLite, DialectOf(db.DB))
+
+	createdAt := time.Date(2024, 3, 9, 23, 30, 0, 0, time.UTC)
+	require.NoError(t, db.Create(&models.Paste{ID: "abc", CreatedAt: createdAt}).Error)
+
+	var day string
+	require.NoError(t, db.Model(&models.Paste{}).
+		Select(DialectOf(db.DB).Date("created_at")).
+		Row().Scan(&day))
+	assert.Equal(t, "2024-03-09", day)
+
+	assert.Equal(t, "TO_CHAR(created_at, 'YYYY-MM-DD')", Postgres.Date("created_at"))
+	assert.Equal(t, "DATE_FORMAT(created_at, '%Y-%m-%d')", MySQL.Date("created_at"))
+	assert.False(t, MySQL.UpdateReturning())
+}
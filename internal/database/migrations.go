@@ -1,40 +1,262 @@
 package database
 
 import (
+	"database/sql"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
+	"path"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4"
+	migratedb "github.com/golang-migrate/migrate/v4/database"
+	migratemysql "github.com/golang-migrate/migrate/v4/database/mysql"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/watzon/0x45/internal/database/sqlite"
 	"github.com/watzon/0x45/internal/models"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-// Models is a list of all models that need to be migrated
+// migrationFiles holds the numbered SQL migrations, in a directory for each
+// database driver
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// baselineVersion is the migration creating the schema AutoMigrate created
+// before migrations were versioned
+const baselineVersion = 1
+
+// Models is a list of all models kept in the database
 var Models = []interface{}{
 	&models.Paste{},
+	&models.PasteFile{},
+	&models.PasteRevision{},
 	&models.APIKey{},
 	&models.Shortlink{},
 	&models.AnalyticsEvent{},
+	&models.Upload{},
+	&models.UploadChunk{},
+	&models.Blob{},
 }
 
-// RunMigrations runs all necessary database migrations
-func RunMigrations(db *gorm.DB) error {
-	if err := runGormMigrations(db); err != nil {
-		return fmt.Errorf("failed to run migrations: %w", err)
+// Migration is one of the migrations embedded in the binary
+type Migration struct {
+	Version uint
+	Name    string
+	Applied bool
+}
+
+// MigrationStatus is the state of a database's migrations
+type MigrationStatus struct {
+	Version    uint        // Last migration applied, 0 if none
+	Dirty      bool        // The last migration failed part way and has to be fixed by hand
+	Legacy     bool        // Created by AutoMigrate, baselined on the next migration up
+	Migrations []Migration // All migrations, oldest first
+}
+
+// Migrator applies the migrations embedded in the binary to a database,
+// keeping track of them in its schema_migrations table
+type Migrator struct {
+	db      *gorm.DB
+	dialect Dialect
+	migrate *migrate.Migrate
+}
+
+// NewMigrator returns a migrator for db, which must be a sqlite, postgres or
+// mysql database
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := createConstraints(db); err != nil {
-		return fmt.Errorf("failed to create constraints: %w", err)
+	dialect := DialectOf(db)
+	var driver migratedb.Driver
+	switch dialect {
+	case SQLite:
+		driver, err = sqlite.WithInstance(sqlDB, &sqlite.Config{})
+	case Postgres, MySQL:
+		driver, err = openMigrationDriver(db)
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", dialect)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	files, err := iofs.New(migrationFiles, path.Join("migrations", string(dialect)))
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", files, string(dialect), driver)
+	if err != nil {
+		files.Close()
+		driver.Close()
+		return nil, err
+	}
+
+	return &Migrator{db: db, dialect: dialect, migrate: m}, nil
+}
+
+// openMigrationDriver returns the migrate driver of a postgres or mysql
+// database. These drivers close the database they're given along with
+// themselves, so they get a connection pool of their own rather than db's.
+// MySQL migrations are sent as a single query, so its pool allows several
+// statements in a query, which db's doesn't.
+func openMigrationDriver(db *gorm.DB) (migratedb.Driver, error) {
+	switch dialector := db.Dialector.(type) {
+	case *postgres.Dialector:
+		migrationDB, err := sql.Open("pgx", dialector.DSN)
+		if err != nil {
+			return nil, err
+		}
+		driver, err := migratepgx.WithInstance(migrationDB, &migratepgx.Config{})
+		if err != nil {
+			migrationDB.Close()
+		}
+		return driver, err
+	case *mysql.Dialector:
+		cfg, err := mysqldriver.ParseDSN(dialector.DSN)
+		if err != nil {
+			return nil, err
+		}
+		cfg.MultiStatements = true
+		migrationDB, err := sql.Open("mysql", cfg.FormatDSN())
+		if err != nil {
+			return nil, err
+		}
+		driver, err := migratemysql.WithInstance(migrationDB, &migratemysql.Config{})
+		if err != nil {
+			migrationDB.Close()
+		}
+		return driver, err
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", db.Dialector.Name())
+	}
 }
 
-func runGormMigrations(db *gorm.DB) error {
-	// Enable foreign key constraints for SQLite
-	// This is a no-op for PostgreSQL as it's enabled by default
-	db = db.Set("gorm:auto_foreign_key", true)
+// Close releases the migrator, leaving the database open
+func (m *Migrator) Close() error {
+	sourceErr, databaseErr := m.migrate.Close()
+	return errors.Join(sourceErr, databaseErr)
+}
 
-	// Run migrations for each model
-	return db.AutoMigrate(Models...)
+// Up applies the next steps migrations, or all pending ones if steps is zero
+func (m *Migrator) Up(steps int) error {
+	if err := m.baseline(); err != nil {
+		return fmt.Errorf("failed to baseline database: %w", err)
+	}
+	if steps > 0 {
+		return ignoreNoChange(m.migrate.Steps(steps))
+	}
+	return ignoreNoChange(m.migrate.Up())
+}
+
+// Down rolls back the last steps migrations
+func (m *Migrator) Down(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("invalid number of migrations to roll back: %d", steps)
+	}
+	return ignoreNoChange(m.migrate.Steps(-steps))
+}
+
+// Force records version as the last migration applied without running
+// anything, to clear a dirty database once it has been fixed by hand
+func (m *Migrator) Force(version int) error {
+	return m.migrate.Force(version)
+}
+
+// Status returns the version of the database and the migrations it has had
+func (m *Migrator) Status() (*MigrationStatus, error) {
+	status := &MigrationStatus{}
+
+	version, dirty, err := m.migrate.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		status.Legacy = m.isLegacy()
+	case err != nil:
+		return nil, err
+	default:
+		status.Version = version
+		status.Dirty = dirty
+	}
+
+	names, err := fs.Glob(migrationFiles, path.Join("migrations", string(m.dialect), "*.up.sql"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		parsed, err := source.Parse(path.Base(name))
+		if err != nil {
+			return nil, err
+		}
+		status.Migrations = append(status.Migrations, Migration{
+			Version: parsed.Version,
+			Name:    parsed.Identifier,
+			Applied: parsed.Version < status.Version || (parsed.Version == status.Version && !status.Dirty),
+		})
+	}
+
+	return status, nil
+}
+
+// baseline marks a database created by AutoMigrate as being at the baseline
+// version, so its tables aren't created again. AutoMigrate first brings it up
+// to the models, in case it was created by an older release. This uses the
+// current models, so once a later migration changes them, databases from
+// before versioning have to be upgraded through the release adding migrations
+// first.
+func (m *Migrator) baseline() error {
+	if _, _, err := m.migrate.Version(); !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+	if !m.isLegacy() {
+		return nil
+	}
+
+	db := m.db.Set("gorm:auto_foreign_key", true)
+	if err := db.AutoMigrate(Models...); err != nil {
+		return err
+	}
+	return m.migrate.Force(baselineVersion)
+}
+
+// isLegacy returns whether the database was created by AutoMigrate, which
+// left no migration version behind
+func (m *Migrator) isLegacy() bool {
+	return m.db.Migrator().HasTable(&models.Paste{})
+}
+
+// ignoreNoChange treats having nothing to migrate, or fewer migrations than
+// asked for, as success
+func ignoreNoChange(err error) error {
+	var short migrate.ErrShortLimit
+	if errors.Is(err, migrate.ErrNoChange) || errors.As(err, &short) {
+		return nil
+	}
+	return err
+}
+
+// RunMigrations applies all pending migrations
+func RunMigrations(db *gorm.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+	defer migrator.Close()
+
+	if err := migrator.Up(0); err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+	return nil
 }
 
 func GetMigrator(db *gorm.DB) gorm.Migrator {
@@ -48,11 +270,3 @@ func DropAllTables(db *gorm.DB) error {
 func HasTable(db *gorm.DB, model interface{}) bool {
 	return db.Migrator().HasTable(model)
 }
-
-func createConstraints(db *gorm.DB) error {
-	// Add any custom constraints here that GORM's automigrate doesn't handle
-	// For example, if you need to add a custom index or foreign key that
-	// isn't defined in the model tags
-
-	return nil
-}
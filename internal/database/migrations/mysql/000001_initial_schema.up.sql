@@ -0,0 +1,170 @@
+CREATE TABLE pastes (
+    id varchar(16),
+    created_at datetime(3),
+    updated_at datetime(3),
+    deleted_at datetime(3),
+    filename varchar(255),
+    mime_type varchar(255),
+    size bigint,
+    extension varchar(32),
+    sha256 varchar(64),
+    encrypted boolean NOT NULL DEFAULT false,
+    storage_path varchar(512),
+    storage_type varchar(32),
+    storage_name varchar(64),
+    storage_route varchar(64),
+    private boolean,
+    delete_key varchar(32),
+    api_key varchar(64),
+    password_hash varchar(255),
+    expires_at datetime(3),
+    max_views bigint,
+    views bigint NOT NULL DEFAULT 0,
+    metadata json,
+    revision bigint NOT NULL DEFAULT 1,
+    revised_at datetime(3),
+    PRIMARY KEY (id)
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_pastes_deleted_at ON pastes (deleted_at);
+CREATE INDEX idx_pastes_api_key ON pastes (api_key);
+CREATE INDEX idx_pastes_expires_at ON pastes (expires_at);
+
+CREATE TABLE paste_files (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    paste_id varchar(16) NOT NULL,
+    position bigint,
+    filename varchar(255),
+    mime_type varchar(255),
+    size bigint,
+    extension varchar(32),
+    sha256 varchar(64),
+    storage_path varchar(512),
+    CONSTRAINT fk_pastes_files FOREIGN KEY (paste_id) REFERENCES pastes (id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_paste_files_paste_id ON paste_files (paste_id);
+
+CREATE TABLE paste_revisions (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    paste_id varchar(16) NOT NULL,
+    number bigint NOT NULL,
+    created_at datetime(3),
+    filename varchar(255),
+    mime_type varchar(255),
+    size bigint,
+    extension varchar(32),
+    sha256 varchar(64),
+    storage_path varchar(512),
+    CONSTRAINT fk_pastes_revisions FOREIGN KEY (paste_id) REFERENCES pastes (id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+CREATE UNIQUE INDEX idx_paste_revision ON paste_revisions (paste_id, number);
+
+CREATE TABLE api_keys (
+    `key` varchar(64),
+    created_at datetime(3),
+    updated_at datetime(3),
+    deleted_at datetime(3),
+    max_file_size bigint,
+    storage_quota bigint,
+    rate_limit bigint,
+    allow_private boolean DEFAULT true,
+    allow_updates boolean DEFAULT true,
+    allow_shortlinks boolean DEFAULT true,
+    shortlink_quota bigint DEFAULT 0,
+    shortlink_prefix varchar(16),
+    email varchar(255),
+    name varchar(255),
+    last_used_at datetime(3),
+    usage_count bigint,
+    verified boolean DEFAULT false,
+    verify_token varchar(64),
+    verify_expiry datetime(3),
+    is_reset boolean DEFAULT false,
+    PRIMARY KEY (`key`)
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_api_keys_deleted_at ON api_keys (deleted_at);
+
+CREATE TABLE shortlinks (
+    id varchar(8),
+    created_at datetime(3),
+    updated_at datetime(3),
+    deleted_at datetime(3),
+    target_url text NOT NULL,
+    title varchar(255),
+    api_key varchar(64) NOT NULL,
+    delete_key varchar(32) NOT NULL,
+    expires_at datetime(3),
+    metadata json,
+    PRIMARY KEY (id)
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_shortlinks_deleted_at ON shortlinks (deleted_at);
+CREATE INDEX idx_shortlinks_api_key ON shortlinks (api_key);
+CREATE INDEX idx_shortlinks_expires_at ON shortlinks (expires_at);
+
+CREATE TABLE analytics_events (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    created_at datetime(3),
+    updated_at datetime(3),
+    deleted_at datetime(3),
+    event_type varchar(32) NOT NULL,
+    resource_id varchar(16) NOT NULL,
+    resource_type varchar(32) NOT NULL,
+    user_agent text,
+    ip_address varchar(45),
+    referer_url text,
+    browser varchar(32),
+    os varchar(32),
+    device varchar(32),
+    city varchar(255),
+    region varchar(255),
+    zip_code varchar(10),
+    country varchar(2),
+    metadata json
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_analytics_events_deleted_at ON analytics_events (deleted_at);
+CREATE INDEX idx_analytics_events_event_type ON analytics_events (event_type);
+CREATE INDEX idx_analytics_events_resource_id ON analytics_events (resource_id);
+CREATE INDEX idx_analytics_events_resource_type ON analytics_events (resource_type);
+
+CREATE TABLE uploads (
+    id varchar(32),
+    created_at datetime(3),
+    updated_at datetime(3),
+    upload_length bigint,
+    upload_offset bigint,
+    filename varchar(255),
+    extension varchar(32),
+    private boolean,
+    expires_in varchar(32),
+    api_key varchar(64),
+    storage_name varchar(64),
+    paste_id varchar(16),
+    expires_at datetime(3),
+    PRIMARY KEY (id)
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_uploads_api_key ON uploads (api_key);
+CREATE INDEX idx_uploads_expires_at ON uploads (expires_at);
+
+CREATE TABLE upload_chunks (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    upload_id varchar(32) NOT NULL,
+    start_offset bigint,
+    size bigint,
+    storage_path varchar(512),
+    CONSTRAINT fk_uploads_chunks FOREIGN KEY (upload_id) REFERENCES uploads (id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+CREATE INDEX idx_upload_chunks_upload_id ON upload_chunks (upload_id);
+
+CREATE TABLE blobs (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    created_at datetime(3),
+    hash varchar(64) NOT NULL,
+    size bigint,
+    stored_size bigint,
+    storage_name varchar(64) NOT NULL,
+    storage_path varchar(512),
+    ref_count bigint NOT NULL DEFAULT 0,
+    verified_at datetime(3),
+    corrupt boolean NOT NULL DEFAULT false
+) DEFAULT CHARSET=utf8mb4;
+CREATE UNIQUE INDEX idx_blob_content ON blobs (hash, storage_name);
+CREATE INDEX idx_blobs_storage_path ON blobs (storage_path);
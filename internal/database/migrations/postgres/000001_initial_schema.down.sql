@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS blobs;
+DROP TABLE IF EXISTS upload_chunks;
+DROP TABLE IF EXISTS uploads;
+DROP TABLE IF EXISTS analytics_events;
+DROP TABLE IF EXISTS shortlinks;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS paste_revisions;
+DROP TABLE IF EXISTS paste_files;
+DROP TABLE IF EXISTS pastes;
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+	"gorm.io/gorm"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	db, err := New(&config.Config{
+		Database: config.DatabaseConfig{
+			Driver: "sqlite",
+			Name:   filepath.Join(t.TempDir(), "test.db"),
+		},
+	}, &gorm.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestMigrator(t *testing.T, db *Database) *Migrator {
+	migrator, err := NewMigrator(db.DB)
+	require.NoError(t, err)
+	t.Cleanup(func() { migrator.Close() })
+	return migrator
+}
+
+func TestMigrations(t *testing.T) {
+	t.Run("up and down", func(t *testing.T) {
+		db := newTestDatabase(t)
+		migrator := newTestMigrator(t, db)
+
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, uint(0), status.Version)
+		assert.False(t, status.Legacy)
+		require.NotEmpty(t, status.Migrations)
+		for _, migration := range status.Migrations {
+			assert.False(t, migration.Applied)
+		}
+
+		require.NoError(t, migrator.Up(0))
+		status, err = migrator.Status()
+		require.NoError(t, err)
+		latest := status.Migrations[len(status.Migrations)-1].Version
+		assert.Equal(t, latest, status.Version)
+		for _, model := range Models {
+			assert.True(t, HasTable(db.DB, model))
+		}
+
+		// The schema takes what the models write
+		paste := &models.Paste{ID: "abc", Filename: "test.txt", Metadata: models.JSON(`{"a":1}`)}
+		require.NoError(t, db.Create(paste).Error)
+		require.NoError(t, db.Create(&models.PasteFile{PasteID: paste.ID, Filename: "test.txt"}).Error)
+		require.NoError(t, db.Create(&models.APIKey{Key: "key", Email: "test@example.com"}).Error)
+
+		// Applying again is a no-op
+		require.NoError(t, migrator.Up(0))
+
+		require.NoError(t, migrator.Down(len(status.Migrations)))
+		status, err = migrator.Status()
+		require.NoError(t, err)
+		assert.Equal(t, uint(0), status.Version)
+		assert.False(t, HasTable(db.DB, &models.Paste{}))
+	})
+
+	t.Run("baselines databases created by AutoMigrate", func(t *testing.T) {
+		db := newTestDatabase(t)
+		require.NoError(t, db.AutoMigrate(Models...))
+		require.NoError(t, db.Create(&models.Paste{ID: "abc"}).Error)
+
+		migrator := newTestMigrator(t, db)
+		status, err := migrator.Status()
+		require.NoError(t, err)
+		assert.True(t, status.Legacy)
+
+		require.NoError(t, migrator.Up(0))
+		status, err = migrator.Status()
+		require.NoError(t, err)
+		assert.False(t, status.Legacy)
+		assert.GreaterOrEqual(t, status.Version, uint(baselineVersion))
+
+		// Existing content is kept
+		var count int64
+		require.NoError(t, db.Model(&models.Paste{}).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("runs on startup", func(t *testing.T) {
+		db := newTestDatabase(t)
+		require.NoError(t, db.Migrate(nil))
+		require.NoError(t, db.Migrate(nil))
+		assert.True(t, HasTable(db.DB, &models.Blob{}))
+	})
+}
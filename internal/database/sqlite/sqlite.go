@@ -35,11 +35,14 @@ type Config struct {
 
 type Sqlite struct {
 	db       *sql.DB
+	ownsDB   bool
 	isLocked atomic.Bool
 
 	config *Config
 }
 
+// WithInstance returns a driver using instance, which is left open for its
+// owner when the driver is closed
 func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	if config == nil {
 		return nil, ErrNilConfig
@@ -126,10 +129,16 @@ func (m *Sqlite) Open(url string) (database.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// The database was opened here, so it's closed along with the driver
+	mx.(*Sqlite).ownsDB = true
 	return mx, nil
 }
 
 func (m *Sqlite) Close() error {
+	if !m.ownsDB {
+		return nil
+	}
 	return m.db.Close()
 }
 
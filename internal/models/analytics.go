@@ -45,7 +45,7 @@ type AnalyticsEvent struct {
 	Country string `gorm:"type:varchar(2)"`
 
 	// Additional data
-	Metadata JSON `gorm:"type:jsonb"`
+	Metadata JSON
 }
 
 // CreateEvent is a helper function to create a new analytics event
@@ -15,6 +15,7 @@ type APIKey struct {
 
 	// Paste-related limits and permissions
 	MaxFileSize  int64 // 10MB default
+	StorageQuota int64 // Bytes of pastes the key can keep stored, 0 = configured default, negative = unlimited
 	RateLimit    int   // Requests per hour
 	AllowPrivate bool  `gorm:"default:true"`
 	AllowUpdates bool  `gorm:"default:true"`
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Blob is a piece of stored content, keyed by its SHA-256 hash. Identical
+// uploads share a single Blob, which counts the pastes, bundle files and
+// revisions referring to it; the content is only deleted once the last of
+// them is gone.
+type Blob struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	// Content information
+	Hash       string `gorm:"type:varchar(64);uniqueIndex:idx_blob_content;not null"` // Hex encoded SHA-256
+	Size       int64
+	StoredSize int64 // Size at rest, smaller than Size if the content is compressed
+
+	// Storage information
+	StorageName string `gorm:"type:varchar(64);uniqueIndex:idx_blob_content;not null"`
+	StoragePath string `gorm:"type:varchar(512);index"`
+
+	// Number of records sharing the content
+	RefCount int64 `gorm:"not null;default:0"`
+
+	// Set by the scrub, which re-hashes stored content to detect corruption
+	VerifiedAt *time.Time
+	Corrupt    bool `gorm:"not null;default:false"`
+}
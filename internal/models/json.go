@@ -4,11 +4,23 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
-// JSON custom type to handle both PostgreSQL JSONB and SQLite TEXT
+// JSON custom type to handle PostgreSQL JSONB, MySQL JSON and SQLite TEXT
 type JSON json.RawMessage
 
+// GormDBDataType implements the gorm.GormDataTypeInterface interface, MySQL
+// has no jsonb type
+func (JSON) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "mysql" {
+		return "json"
+	}
+	return "jsonb"
+}
+
 // Value implement driver.Valuer interface
 func (j JSON) Value() (driver.Value, error) {
 	if len(j) == 0 {
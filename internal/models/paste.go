@@ -21,22 +21,153 @@ type Paste struct {
 	MimeType  string `gorm:"type:varchar(255)"`
 	Size      int64
 	Extension string `gorm:"type:varchar(32)"`
+	SHA256    string `gorm:"type:varchar(64)"` // Hex encoded, empty for content stored before checksums
+
+	// Encrypted pastes hold an envelope encrypted by the client, which the
+	// server can't read. Their MimeType describes the envelope.
+	Encrypted bool `gorm:"not null;default:false"`
 
 	// Storage information
 	StoragePath string `gorm:"type:varchar(512)"`
-	StorageType string `gorm:"type:varchar(32)"` // "local" or "s3"
+	StorageType string `gorm:"type:varchar(32)"` // "local", "s3" or "webdav"
 	StorageName string `gorm:"type:varchar(64)"` // Name of the storage config
 
+	// Name of the storage route that chose the storage, empty if the paste
+	// went to the default storage
+	StorageRoute string `gorm:"type:varchar(64)"`
+
 	// Access control
 	Private   bool
 	DeleteKey string `gorm:"type:varchar(32)"`
 	APIKey    string `gorm:"type:varchar(64);index"` // If created with an API key
 
+	// Password protection, empty for pastes without a password
+	PasswordHash string `gorm:"type:varchar(255)"` // bcrypt hash of the password
+
 	// Expiration
 	ExpiresAt *time.Time `gorm:"index"`
 
+	// View limits. MaxViews is nil for pastes that can be viewed any number
+	// of times, Views counts the views used up so far.
+	MaxViews *int
+	Views    int `gorm:"not null;default:0"`
+
 	// Optional metadata
-	Metadata JSON `gorm:"type:jsonb"` // For PostgreSQL, will fallback to JSON string for SQLite
+	Metadata JSON // jsonb for PostgreSQL, json for MySQL, a JSON string for SQLite
+
+	// Files in a multi-file paste, empty for single file pastes
+	Files []PasteFile `gorm:"constraint:OnDelete:CASCADE"`
+
+	// Revision is the number of the current content, starting at 1 and
+	// incremented each time the content is updated
+	Revision  int `gorm:"not null;default:1"`
+	RevisedAt *time.Time
+	Revisions []PasteRevision `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// HasPassword returns whether the paste is password protected
+func (p *Paste) HasPassword() bool {
+	return p.PasswordHash != ""
+}
+
+// HasViewLimit returns whether the paste is deleted after a number of views
+func (p *Paste) HasViewLimit() bool {
+	return p.MaxViews != nil
+}
+
+// ViewsRemaining returns the number of views left for a paste with a view
+// limit
+func (p *Paste) ViewsRemaining() int {
+	if p.MaxViews == nil {
+		return 0
+	}
+	return max(*p.MaxViews-p.Views, 0)
+}
+
+// IsBundle returns whether the paste holds multiple files
+func (p *Paste) IsBundle() bool {
+	return len(p.Files) > 0
+}
+
+// PrimaryFile returns the file shown when a paste is viewed as a single file.
+// For bundles this is the first file, otherwise it's the paste's own content.
+func (p *Paste) PrimaryFile() PasteFile {
+	if p.IsBundle() {
+		return p.Files[0]
+	}
+
+	return PasteFile{
+		PasteID:     p.ID,
+		Filename:    p.Filename,
+		MimeType:    p.MimeType,
+		Size:        p.Size,
+		Extension:   p.Extension,
+		SHA256:      p.SHA256,
+		StoragePath: p.StoragePath,
+	}
+}
+
+// FindFile returns the bundle file with the given filename
+func (p *Paste) FindFile(filename string) (*PasteFile, bool) {
+	for i := range p.Files {
+		if p.Files[i].Filename == filename {
+			return &p.Files[i], true
+		}
+	}
+	return nil, false
+}
+
+// AtRevision returns a copy of the paste with its content replaced by that
+// of the given revision
+func (p *Paste) AtRevision(number int) (*Paste, bool) {
+	if number == p.Revision {
+		return p, true
+	}
+
+	for _, rev := range p.Revisions {
+		if rev.Number == number {
+			paste := *p
+			paste.Revision = rev.Number
+			paste.Filename = rev.Filename
+			paste.MimeType = rev.MimeType
+			paste.Size = rev.Size
+			paste.Extension = rev.Extension
+			paste.SHA256 = rev.SHA256
+			paste.StoragePath = rev.StoragePath
+			return &paste, true
+		}
+	}
+	return nil, false
+}
+
+// LatestRevision returns the number of the most recent revision. This differs
+// from Revision on copies returned by AtRevision.
+func (p *Paste) LatestRevision() int {
+	latest := p.Revision
+	for _, rev := range p.Revisions {
+		if rev.Number >= latest {
+			latest = rev.Number + 1
+		}
+	}
+	return latest
+}
+
+// StoragePaths returns the storage paths of all content held by the paste,
+// including prior revisions
+func (p *Paste) StoragePaths() []string {
+	var paths []string
+	if p.IsBundle() {
+		for _, file := range p.Files {
+			paths = append(paths, file.StoragePath)
+		}
+	} else {
+		paths = append(paths, p.StoragePath)
+	}
+
+	for _, rev := range p.Revisions {
+		paths = append(paths, rev.StoragePath)
+	}
+	return paths
 }
 
 // BeforeCreate generates ID and DeleteKey if not set
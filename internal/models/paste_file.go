@@ -0,0 +1,20 @@
+package models
+
+// PasteFile is a single file within a multi-file paste (a bundle). Pastes
+// created from a single file have no PasteFile records; their content is
+// described by the Paste itself.
+type PasteFile struct {
+	ID       uint   `gorm:"primarykey"`
+	PasteID  string `gorm:"type:varchar(16);index;not null"`
+	Position int    // Order of the file within the bundle
+
+	// Content information
+	Filename  string `gorm:"type:varchar(255)"`
+	MimeType  string `gorm:"type:varchar(255)"`
+	Size      int64
+	Extension string `gorm:"type:varchar(32)"`
+	SHA256    string `gorm:"type:varchar(64)"` // Hex encoded, empty for content stored before checksums
+
+	// Storage information
+	StoragePath string `gorm:"type:varchar(512)"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// PasteRevision is a prior version of a paste's content. The latest revision
+// is always described by the Paste itself, so a paste that was never updated
+// has no PasteRevision records.
+type PasteRevision struct {
+	ID        uint   `gorm:"primarykey"`
+	PasteID   string `gorm:"type:varchar(16);uniqueIndex:idx_paste_revision;not null"`
+	Number    int    `gorm:"uniqueIndex:idx_paste_revision;not null"`
+	CreatedAt time.Time
+
+	// Content information
+	Filename  string `gorm:"type:varchar(255)"`
+	MimeType  string `gorm:"type:varchar(255)"`
+	Size      int64
+	Extension string `gorm:"type:varchar(32)"`
+	SHA256    string `gorm:"type:varchar(64)"` // Hex encoded, empty for content stored before checksums
+
+	// Storage information
+	StoragePath string `gorm:"type:varchar(512)"`
+}
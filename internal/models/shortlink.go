@@ -26,7 +26,7 @@ type Shortlink struct {
 	ExpiresAt *time.Time `gorm:"index"`
 
 	// Optional metadata (referrer stats, etc.)
-	Metadata JSON `gorm:"type:jsonb"`
+	Metadata JSON
 }
 
 func (s *Shortlink) BeforeCreate(tx *gorm.DB) error {
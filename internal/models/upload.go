@@ -0,0 +1,62 @@
+package models
+
+import (
+	"time"
+
+	"github.com/watzon/0x45/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Upload tracks an in-progress resumable (tus) upload. The received bytes are
+// kept in storage as a series of chunks and assembled into a paste once the
+// upload is complete.
+type Upload struct {
+	ID        string `gorm:"primarykey;type:varchar(32)"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Progress information
+	UploadLength int64 // Total size declared by the client
+	UploadOffset int64 // Number of bytes received so far
+
+	// Paste options, taken from the Upload-Metadata header
+	Filename  string `gorm:"type:varchar(255)"`
+	Extension string `gorm:"type:varchar(32)"`
+	Private   bool
+	ExpiresIn string `gorm:"type:varchar(32)"`
+	APIKey    string `gorm:"type:varchar(64);index"` // If created with an API key
+
+	// Storage the chunks are kept in, the default storage when the upload was
+	// created
+	StorageName string `gorm:"type:varchar(64)"`
+
+	// Set once the upload has been assembled into a paste
+	PasteID string `gorm:"type:varchar(16)"`
+
+	// Uploads are garbage collected after this time, complete or not
+	ExpiresAt time.Time `gorm:"index"`
+
+	Chunks []UploadChunk `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// UploadChunk is a single stored piece of an Upload
+type UploadChunk struct {
+	ID          uint   `gorm:"primarykey"`
+	UploadID    string `gorm:"type:varchar(32);index;not null"`
+	StartOffset int64  // Offset of the first byte of this chunk within the upload
+	Size        int64
+	StoragePath string `gorm:"type:varchar(512)"`
+}
+
+// BeforeCreate generates the upload ID if not set
+func (u *Upload) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == "" {
+		u.ID = utils.MustGenerateID(32)
+	}
+	return nil
+}
+
+// IsComplete returns whether all of the declared bytes have been received
+func (u *Upload) IsComplete() bool {
+	return u.UploadOffset >= u.UploadLength
+}
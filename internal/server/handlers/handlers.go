@@ -12,6 +12,7 @@ type Handlers struct {
 	Web    *WebHandlers
 	APIKey *APIKeyHandlers
 	Paste  *PasteHandlers
+	Upload *UploadHandlers
 	URL    *URLHandlers
 	db     *gorm.DB
 	logger *zap.Logger
@@ -30,6 +31,7 @@ func NewHandlers(db *gorm.DB, logger *zap.Logger, config *config.Config, service
 	h.Web = NewWebHandlers(services, logger, config)
 	h.APIKey = NewAPIKeyHandlers(services, logger, config)
 	h.Paste = NewPasteHandlers(services, logger, config)
+	h.Upload = NewUploadHandlers(services, logger, config)
 	h.URL = NewURLHandlers(services, logger, config)
 
 	return h
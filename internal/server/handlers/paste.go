@@ -2,14 +2,16 @@ package handlers
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/parser"
-	"github.com/valyala/fasthttp"
 	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
 	"github.com/watzon/0x45/internal/server/services"
 	"go.uber.org/zap"
 )
@@ -49,9 +51,9 @@ func (h *PasteHandlers) HandleView(c *fiber.Ctx) error {
 		id = id + "." + ext.(string)
 	}
 
-	paste, err := h.services.Paste.GetPaste(id)
+	paste, err := h.lookupPaste(c, id)
 	if err != nil {
-		return err
+		return h.lookupError(c, err)
 	}
 
 	if err := h.services.Analytics.LogPasteView(c, paste.ID); err != nil {
@@ -60,14 +62,23 @@ func (h *PasteHandlers) HandleView(c *fiber.Ctx) error {
 
 	// If the accepts header contains our vendor-specific MIME type, return the paste as JSON
 	if strings.Contains(c.Get("Accept"), "application/vnd.0x45.paste+json") {
-		return h.services.Paste.RenderPasteJSON(c, paste)
+		return h.serveView(paste, func() error {
+			return h.services.Paste.RenderPasteJSON(c, paste)
+		})
 	}
 
 	// If the client wants HTML (browsers), render the HTML view.
 	// Specifically using "application/xhtml+xml" here since all browsers include it in their
 	// Accept header, and it won't ever be automatically added as a mime type for a paste.
 	if strings.Contains(c.Get("Accept"), "application/xhtml+xml") {
-		return h.services.Paste.RenderPaste(c, paste)
+		// Pastes with a view limit are only shown once the viewer asks for
+		// them, so opening the link doesn't use up a view
+		if paste.HasViewLimit() && c.Query("reveal") == "" {
+			return h.services.Paste.RenderSealed(c, paste)
+		}
+		return h.serveView(paste, func() error {
+			return h.services.Paste.RenderPaste(c, paste)
+		})
 	}
 
 	// For all other cases, check if the client accepts the paste's mime type
@@ -98,7 +109,9 @@ func (h *PasteHandlers) HandleView(c *fiber.Ctx) error {
 
 	// Set content type and return raw content
 	c.Set("Content-Type", paste.MimeType)
-	return h.services.Paste.RenderPasteRaw(c, paste)
+	return h.serveView(paste, func() error {
+		return h.services.Paste.RenderPasteRaw(c, paste)
+	})
 }
 
 // HandleRawView serves the raw content of a paste
@@ -110,12 +123,14 @@ func (h *PasteHandlers) HandleRawView(c *fiber.Ctx) error {
 		id = id + "." + ext.(string)
 	}
 
-	paste, err := h.services.Paste.GetPaste(id)
+	paste, err := h.lookupPaste(c, id)
 	if err != nil {
-		return err
+		return h.lookupError(c, err)
 	}
 
-	return h.services.Paste.RenderPasteRaw(c, paste)
+	return h.serveView(paste, func() error {
+		return h.services.Paste.RenderPasteRaw(c, paste)
+	})
 }
 
 // HandleDownload serves the content as a downloadable file
@@ -127,12 +142,75 @@ func (h *PasteHandlers) HandleDownload(c *fiber.Ctx) error {
 		id = id + "." + ext.(string)
 	}
 
-	paste, err := h.services.Paste.GetPaste(id)
+	paste, err := h.lookupPaste(c, id)
+	if err != nil {
+		return h.lookupError(c, err)
+	}
+
+	return h.serveView(paste, func() error {
+		return h.services.Paste.RenderDownload(c, paste)
+	})
+}
+
+// HandleUpdate stores new content for a paste as a new revision
+func (h *PasteHandlers) HandleUpdate(c *fiber.Ctx) error {
+	return h.services.Paste.UpdatePaste(c, getPasteID(c))
+}
+
+// HandleDiff renders a diff between two pastes, or revisions of a paste. Each
+// side is given as a paste ID, optionally followed by @ and a revision number.
+func (h *PasteHandlers) HandleDiff(c *fiber.Ctx) error {
+	a, b, err := h.lookupDiff(c)
+	if err != nil {
+		return h.lookupError(c, err)
+	}
+
+	// Browsers get the rendered diff, everything else gets a plain diff
+	if strings.Contains(c.Get("Accept"), "application/xhtml+xml") {
+		return h.services.Paste.RenderDiff(c, a, b)
+	}
+	return h.services.Paste.RenderDiffRaw(c, a, b)
+}
+
+// HandleRawDiff serves a diff between two pastes as text/x-diff
+func (h *PasteHandlers) HandleRawDiff(c *fiber.Ctx) error {
+	a, b, err := h.lookupDiff(c)
+	if err != nil {
+		return h.lookupError(c, err)
+	}
+
+	return h.services.Paste.RenderDiffRaw(c, a, b)
+}
+
+// HandleFile serves the raw content of a single file within a multi-file paste
+func (h *PasteHandlers) HandleFile(c *fiber.Ctx) error {
+	paste, err := h.services.Paste.GetPaste(getPasteID(c))
+	if err != nil {
+		return err
+	}
+	if err := h.services.Paste.CheckPassword(c, paste); err != nil {
+		return h.lookupError(c, err)
+	}
+
+	name, err := url.PathUnescape(c.Params("name"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid filename")
+	}
+
+	return h.serveView(paste, func() error {
+		return h.services.Paste.RenderFile(c, paste, name)
+	})
+}
+
+// HandleUnlock checks the password submitted to unlock a password protected
+// paste in the browser
+func (h *PasteHandlers) HandleUnlock(c *fiber.Ctx) error {
+	paste, err := h.services.Paste.GetPaste(getPasteID(c))
 	if err != nil {
 		return err
 	}
 
-	return h.services.Paste.RenderDownload(c, paste)
+	return h.services.Paste.Unlock(c, paste)
 }
 
 // HandleDeleteWithKey deletes a paste using its deletion key
@@ -164,7 +242,7 @@ func (h *PasteHandlers) HandleGetPasteImage(c *fiber.Ctx) error {
 		id = id + "." + ext.(string)
 	}
 
-	paste, err := h.services.Paste.GetPaste(id)
+	paste, err := h.lookupPaste(c, id)
 	if err != nil {
 		return err
 	}
@@ -184,50 +262,45 @@ func (h *PasteHandlers) HandlePreview(c *fiber.Ctx) error {
 		fullID = id
 	}
 
-	paste, err := h.services.Paste.GetPaste(id)
+	paste, err := h.lookupPaste(c, id)
 	if err != nil {
-		return err
+		return h.lookupError(c, err)
 	}
-
-	// Create a new context for rendering the raw content
-	app := c.App()
-	ctx := app.AcquireCtx(&fasthttp.RequestCtx{})
-	defer app.ReleaseCtx(ctx)
-
-	// Reset the response to avoid any previous data
-	ctx.Response().Reset()
-
-	// Get the raw content
-	if err := h.services.Paste.RenderPasteRaw(ctx, paste); err != nil {
-		return err
+	if paste.Encrypted {
+		return fiber.NewError(fiber.StatusBadRequest, "Encrypted pastes can't be previewed")
 	}
 
-	// Get the content from the response
-	content := ctx.Response().Body()
+	return h.serveView(paste, func() error {
+		// Get the raw content
+		content, err := h.services.Paste.GetRawContent(paste)
+		if err != nil {
+			return err
+		}
 
-	// Convert markdown to HTML
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs
-	p := parser.NewWithExtensions(extensions)
-	renderedContent := string(markdown.ToHTML(content, p, nil))
+		// Convert markdown to HTML
+		extensions := parser.CommonExtensions | parser.AutoHeadingIDs
+		p := parser.NewWithExtensions(extensions)
+		renderedContent := string(markdown.ToHTML(content, p, nil))
 
-	// Format the expiry time
-	var expiryTime string
-	if paste.ExpiresAt != nil {
-		expiryTime = formatExpiryTime(paste.ExpiresAt)
-	}
+		// Format the expiry time
+		var expiryTime string
+		if paste.ExpiresAt != nil {
+			expiryTime = formatExpiryTime(paste.ExpiresAt)
+		}
 
-	// Render the preview template
-	return c.Render("preview", fiber.Map{
-		"id":       fullID, // Use the ID with extension
-		"filename": paste.Filename,
-		"created":  paste.CreatedAt.Format("2006-01-02 15:04:05"),
-		"expires":  expiryTime,
-		"metadata": fiber.Map{
-			"size":     formatSize(paste.Size),
-			"mimeType": paste.MimeType,
-		},
-		"renderedContent": renderedContent,
-	}, "layouts/main")
+		// Render the preview template
+		return c.Render("preview", fiber.Map{
+			"id":       fullID, // Use the ID with extension
+			"filename": paste.Filename,
+			"created":  paste.CreatedAt.Format("2006-01-02 15:04:05"),
+			"expires":  expiryTime,
+			"metadata": fiber.Map{
+				"size":     formatSize(paste.Size),
+				"mimeType": paste.MimeType,
+			},
+			"renderedContent": renderedContent,
+		}, "layouts/main")
+	})
 }
 
 // formatExpiryTime formats a time pointer into a string
@@ -251,3 +324,129 @@ func formatSize(size int64) string {
 	}
 	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
 }
+
+// lookupPaste returns the paste with the given ID. If the route includes a
+// revision, the paste is pinned to that revision.
+func (h *PasteHandlers) lookupPaste(c *fiber.Ctx, id string) (*models.Paste, error) {
+	paste, err := h.services.Paste.GetPaste(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.services.Paste.CheckPassword(c, paste); err != nil {
+		return nil, err
+	}
+
+	if c.Params("rev") == "" {
+		return paste, nil
+	}
+
+	number, err := strconv.Atoi(c.Params("rev"))
+	if err != nil || number < 1 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid revision")
+	}
+
+	paste, err = h.services.Paste.GetRevision(paste, number)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Locals("revision", number)
+	return paste, nil
+}
+
+// lookupDiff returns both sides of a diff request. The diff is treated as
+// pinned when both sides name a revision.
+func (h *PasteHandlers) lookupDiff(c *fiber.Ctx) (*models.Paste, *models.Paste, error) {
+	refs := make([]string, 2)
+	for i, param := range []string{getPasteID(c), c.Params("other")} {
+		ref, err := url.PathUnescape(param)
+		if err != nil {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid paste reference")
+		}
+		refs[i] = ref
+	}
+
+	a, aPinned, err := h.lookupRef(c, refs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, bPinned, err := h.lookupRef(c, refs[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if aPinned && bPinned {
+		c.Locals("revision", true)
+	}
+	return a, b, nil
+}
+
+// lookupRef returns the paste named by a reference of the form ID or ID@rev,
+// and whether the reference names a revision
+func (h *PasteHandlers) lookupRef(c *fiber.Ctx, ref string) (*models.Paste, bool, error) {
+	id, rev, pinned := strings.Cut(ref, "@")
+
+	paste, err := h.services.Paste.GetPaste(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := h.services.Paste.CheckPassword(c, paste); err != nil {
+		c.Locals("locked", paste.ID)
+		return nil, false, err
+	}
+
+	if !pinned {
+		return paste, false, nil
+	}
+
+	number, err := strconv.Atoi(rev)
+	if err != nil || number < 1 {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "Invalid revision")
+	}
+
+	paste, err = h.services.Paste.GetRevision(paste, number)
+	if err != nil {
+		return nil, false, err
+	}
+	return paste, true, nil
+}
+
+// lookupError handles an error from looking up a paste. Browsers asking for a
+// password protected paste get the form to unlock it, other clients are told
+// to retry with Basic auth. For a diff, the form unlocks whichever side is
+// protected.
+func (h *PasteHandlers) lookupError(c *fiber.Ctx, err error) error {
+	if !services.IsPasswordError(err) {
+		return err
+	}
+
+	if strings.Contains(c.Get("Accept"), "application/xhtml+xml") {
+		id := getPasteID(c)
+		if locked, ok := c.Locals("locked").(string); ok {
+			id = locked
+		}
+		return h.services.Paste.RenderUnlock(c, id)
+	}
+
+	c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="paste"`)
+	return err
+}
+
+// serveView renders a paste, using up one of its views if it has a view
+// limit. The paste is burned once its final view has been served.
+func (h *PasteHandlers) serveView(paste *models.Paste, render func() error) error {
+	last, err := h.services.Paste.ConsumeView(paste)
+	if err != nil {
+		return err
+	}
+
+	if err := render(); err != nil {
+		return err
+	}
+
+	if last {
+		h.services.Paste.Burn(paste)
+	}
+	return nil
+}
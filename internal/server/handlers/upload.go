@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/server/services"
+	"go.uber.org/zap"
+)
+
+type UploadHandlers struct {
+	services *services.Services
+	logger   *zap.Logger
+	config   *config.Config
+}
+
+func NewUploadHandlers(services *services.Services, logger *zap.Logger, config *config.Config) *UploadHandlers {
+	return &UploadHandlers{
+		services: services,
+		logger:   logger,
+		config:   config,
+	}
+}
+
+// HandleOptions advertises the supported tus protocol version and extensions
+func (h *UploadHandlers) HandleOptions(c *fiber.Ctx) error {
+	return h.services.Upload.Options(c)
+}
+
+// HandleCreate starts a new resumable upload
+func (h *UploadHandlers) HandleCreate(c *fiber.Ctx) error {
+	return h.services.Upload.CreateUpload(c)
+}
+
+// HandleHead returns the current offset of a resumable upload
+func (h *UploadHandlers) HandleHead(c *fiber.Ctx) error {
+	return h.services.Upload.GetUploadOffset(c)
+}
+
+// HandlePatch appends a chunk to a resumable upload
+func (h *UploadHandlers) HandlePatch(c *fiber.Ctx) error {
+	return h.services.Upload.AppendChunk(c)
+}
+
+// HandleDelete terminates a resumable upload
+func (h *UploadHandlers) HandleDelete(c *fiber.Ctx) error {
+	return h.services.Upload.TerminateUpload(c)
+}
@@ -67,7 +67,7 @@ func (m *AuthMiddleware) Auth(required bool) fiber.Handler {
 
 func (m *AuthMiddleware) validateAPIKey(key string) (*models.APIKey, error) {
 	var apiKey models.APIKey
-	err := m.db.Where("key = ? AND verified = ?", key, true).First(&apiKey).Error
+	err := m.db.Where("api_keys.key = ? AND verified = ?", key, true).First(&apiKey).Error
 	if err != nil {
 		return nil, err
 	}
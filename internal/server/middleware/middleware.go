@@ -82,18 +82,55 @@ func (m *Middleware) Recover() fiber.Handler {
 func (m *Middleware) CORS() fiber.Handler {
 	return cors.New(cors.Config{
 		AllowOrigins:     strings.Join(m.config.Server.CORSOrigins, ","),
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization",
+		AllowMethods:     "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization," + TusRequestHeaders,
+		ExposeHeaders:    TusResponseHeaders,
 		AllowCredentials: false,
 		MaxAge:           300,
 	})
 }
 
-// Compression returns a middleware that compresses responses
+// unencodedMarker is the Content-Encoding StoredContent gives responses that
+// mustn't be compressed, since the compressor leaves responses that already
+// have an encoding alone. Compression removes it again before it's sent.
+const unencodedMarker = "identity"
+
+// Compression returns a middleware that compresses responses, except those
+// marked by StoredContent
 func (m *Middleware) Compression() fiber.Handler {
-	return compress.New(compress.Config{
+	compressor := compress.New(compress.Config{
+		// Partial content must be sent as stored, the byte range refers to it
+		Next: func(c *fiber.Ctx) bool {
+			return c.Get(fiber.HeaderRange) != ""
+		},
 		Level: compress.LevelDefault,
 	})
+
+	return func(c *fiber.Ctx) error {
+		if err := compressor(c); err != nil {
+			return err
+		}
+		if c.GetRespHeader(fiber.HeaderContentEncoding) == unencodedMarker {
+			c.Response().Header.Del(fiber.HeaderContentEncoding)
+		}
+		return nil
+	}
+}
+
+// StoredContent keeps responses sent exactly as their content was stored,
+// which handlers mark with the storedContent local, from being compressed.
+// The compressor only looks at the response once the handler has returned,
+// so this runs between the two.
+func (m *Middleware) StoredContent() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+		if c.Locals("storedContent") != nil && c.GetRespHeader(fiber.HeaderContentEncoding) == "" {
+			c.Set(fiber.HeaderContentEncoding, unencodedMarker)
+		}
+		return nil
+	}
 }
 
 // RequestID returns a middleware that adds a request ID to each request
@@ -114,6 +151,7 @@ func (m *Middleware) GetMiddleware() []fiber.Handler {
 		m.Recover(),
 		m.CORS(),
 		m.Compression(),
+		m.StoredContent(),
 		m.ETag(),
 	}
 }
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/server/services"
+)
+
+const (
+	// TusRequestHeaders are the tus headers browsers need to be allowed to send
+	TusRequestHeaders = "Tus-Resumable,Upload-Length,Upload-Offset,Upload-Metadata,Upload-Defer-Length"
+
+	// TusResponseHeaders are the tus headers browsers need to be allowed to read
+	TusResponseHeaders = "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size," +
+		"Upload-Offset,Upload-Length,Upload-Expires,Upload-Paste-URL,Upload-Paste-Delete-URL"
+)
+
+// TusResumable returns a middleware that advertises the tus protocol version on
+// every response and rejects requests made with an unsupported version
+func (m *Middleware) TusResumable() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", services.TusVersion)
+
+		// OPTIONS requests are used for discovery and don't need to send a version
+		if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != services.TusVersion {
+			c.Set("Tus-Version", services.TusVersion)
+			return fiber.NewError(fiber.StatusPreconditionFailed, "Unsupported tus protocol version")
+		}
+
+		return c.Next()
+	}
+}
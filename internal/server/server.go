@@ -81,7 +81,7 @@ func New(config *config.Config, logger *zap.Logger) *Server {
 	engine := template.New(config.Server.ViewsDirectory, "./views", ".hbs", logger)
 
 	// Initialize services
-	svc := services.NewServices(db.DB, logger, config)
+	svc := services.NewServices(db.DB, logger, config, storageManager)
 
 	// Initialize middleware
 	mw := middleware.NewMiddleware(db.DB, logger, config, svc)
@@ -93,11 +93,14 @@ func New(config *config.Config, logger *zap.Logger) *Server {
 	app := fiber.New(fiber.Config{
 		ErrorHandler: errorHandler,
 		BodyLimit:    int(config.Server.MaxUploadSize),
-		Views:        engine,
-		Prefork:      config.Server.Prefork,
-		ServerHeader: config.Server.ServerHeader,
-		AppName:      config.Server.AppName,
-		ProxyHeader:  fiber.HeaderXForwardedFor,
+		// Stream request bodies so large uploads aren't buffered in memory
+		// before they reach the paste service
+		StreamRequestBody: true,
+		Views:             engine,
+		Prefork:           config.Server.Prefork,
+		ServerHeader:      config.Server.ServerHeader,
+		AppName:           config.Server.AppName,
+		ProxyHeader:       fiber.HeaderXForwardedFor,
 	})
 
 	// Add all middleware in the correct order
@@ -136,9 +139,10 @@ func (s *Server) SetupMiddleware() {
 
 	// Setup CORS
 	s.app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Origin, Content-Type, Accept",
+		AllowOrigins:  "*",
+		AllowMethods:  "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS",
+		AllowHeaders:  "Origin, Content-Type, Accept, " + middleware.TusRequestHeaders,
+		ExposeHeaders: middleware.TusResponseHeaders,
 	}))
 
 	// Add request logging
@@ -175,13 +179,41 @@ func (s *Server) SetupRoutes() {
 	urls.Delete("/:id", s.handlers.URL.HandleDeleteURL)
 	urls.Put("/:id/expiry", s.handlers.URL.HandleUpdateURLExpiration)
 
+	// Resumable upload routes (tus protocol) - these must come before the
+	// public paste routes, which would otherwise match /p/uploads/:id
+	if s.config.Server.ResumableUploads.Enabled {
+		uploads := s.app.Group("/p/uploads", s.middleware.TusResumable(), s.middleware.Auth.Auth(false))
+		uploads.Options("/", s.handlers.Upload.HandleOptions)
+		uploads.Post("/", s.handlers.Upload.HandleCreate)
+		uploads.Head("/:id", s.handlers.Upload.HandleHead)
+		uploads.Patch("/:id", s.handlers.Upload.HandlePatch)
+		uploads.Delete("/:id", s.handlers.Upload.HandleDelete)
+	}
+
 	// Paste routes - authenticated routes first
 	pastes := s.app.Group("/p")
 	pastes.Post("/", s.middleware.Auth.Auth(false), s.handlers.Paste.HandleUpload)
 	pastes.Get("/list", s.middleware.Auth.Auth(true), s.handlers.Paste.HandleListPastes)
 	pastes.Delete("/:id", s.middleware.Auth.Auth(false), s.handlers.Paste.HandleDeletePaste)
+	pastes.Put("/:id", s.middleware.Auth.Auth(true), s.handlers.Paste.HandleUpdate)
 	pastes.Put("/:id/expiry", s.middleware.Auth.Auth(true), s.handlers.Paste.HandleUpdateExpiration)
 
+	// Bundle file, revision and diff routes go before the extension routes,
+	// which would otherwise match paths containing a dot
+	s.app.Get("/p/:id/files/:name", s.handlers.Paste.HandleFile)
+	s.app.Post("/p/:id/unlock", s.handlers.Paste.HandleUnlock)
+
+	// Revision routes pin a paste to one of its revisions
+	s.app.Get("/p/:id/rev/:rev", s.handlers.Paste.HandleView)
+	s.app.Get("/p/:id/rev/:rev/raw", s.handlers.Paste.HandleRawView)
+	s.app.Get("/p/:id/rev/:rev/download", s.handlers.Paste.HandleDownload)
+	s.app.Get("/p/:id/rev/:rev/image", s.handlers.Paste.HandleGetPasteImage)
+	s.app.Get("/p/:id/rev/:rev/preview", s.handlers.Paste.HandlePreview)
+
+	// Diffs between two pastes, or two revisions of a paste
+	s.app.Get("/p/:id/diff/:other", s.handlers.Paste.HandleDiff)
+	s.app.Get("/p/:id/diff/:other/raw", s.handlers.Paste.HandleRawDiff)
+
 	// Public paste routes - extension routes first (more specific)
 	s.app.Get("/p/:id.:ext", func(c *fiber.Ctx) error {
 		c.Locals("extension", c.Params("ext"))
@@ -234,6 +266,11 @@ func (s *Server) Start(addr string) error {
 		}
 	}
 
+	// Start scrub scheduler
+	if s.config.Server.Scrub.Enabled && s.config.Server.Scrub.Interval > 0 {
+		s.services.Cleanup.StartScrubScheduler(s.config.Server.Scrub.Interval)
+	}
+
 	// Setup routes
 	s.SetupRoutes()
 
@@ -278,6 +315,11 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 func (s *Server) Cleanup() error {
+	if s.storage != nil {
+		if err := s.storage.Close(); err != nil {
+			s.logger.Error("failed to close storage", zap.Error(err))
+		}
+	}
 	if s.db != nil && s.db.DB != nil {
 		if err := s.db.Close(); err != nil {
 			s.logger.Error("failed to close database", zap.Error(err))
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/database"
 	"github.com/watzon/0x45/internal/models"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -24,6 +25,11 @@ func NewAnalyticsService(db *gorm.DB, logger *zap.Logger, config *config.Config)
 	}
 }
 
+// day returns an expression for the day a row was created, as YYYY-MM-DD
+func (s *AnalyticsService) day() string {
+	return database.DialectOf(s.db).Date("created_at")
+}
+
 // GetResourceStats retrieves analytics statistics for a given resource
 func (s *AnalyticsService) GetResourceStats(resourceType string, resourceID string, timeframe AnalyticsTimeframe) (*AnalyticsStats, error) {
 	stats := &AnalyticsStats{
@@ -55,15 +61,16 @@ func (s *AnalyticsService) GetResourceStats(resourceType string, resourceID stri
 
 	// Get views by day
 	type DailyViews struct {
-		Date  time.Time `gorm:"column:date"`
-		Count int64     `gorm:"column:count"`
+		DateStr string `gorm:"column:date"`
+		Count   int64  `gorm:"column:count"`
 	}
 	var dailyViews []DailyViews
 
+	day := s.day()
 	viewsQuery := s.db.Model(&models.AnalyticsEvent{}).
-		Select("DATE(created_at) as date, COUNT(*) as count").
+		Select(day+" as date, COUNT(*) as count").
 		Where("resource_type = ? AND resource_id = ?", resourceType, resourceID).
-		Group("DATE(created_at)").
+		Group(day).
 		Order("date ASC")
 
 	if timeframe.StartTime != nil {
@@ -75,12 +82,16 @@ func (s *AnalyticsService) GetResourceStats(resourceType string, resourceID stri
 
 	viewsQuery.Find(&dailyViews)
 
-	stats.ViewsByDay = make([]ChartDataPoint, len(dailyViews))
-	for i, dv := range dailyViews {
-		stats.ViewsByDay[i] = ChartDataPoint{
-			Date:  dv.Date,
-			Value: dv.Count,
+	stats.ViewsByDay = make([]ChartDataPoint, 0, len(dailyViews))
+	for _, dv := range dailyViews {
+		date, err := time.Parse("2006-01-02", dv.DateStr)
+		if err != nil {
+			continue
 		}
+		stats.ViewsByDay = append(stats.ViewsByDay, ChartDataPoint{
+			Date:  date,
+			Value: dv.Count,
+		})
 	}
 
 	// Get top referrers (excluding empty ones)
@@ -151,6 +162,7 @@ func (s *AnalyticsService) GetStatsHistory(days int) (*StatsHistory, error) {
 	// Calculate date range
 	endDate := time.Now()
 	startDate := endDate.AddDate(0, 0, -days)
+	day := s.day()
 
 	// Get paste counts by day
 	type DailyCount struct {
@@ -161,18 +173,18 @@ func (s *AnalyticsService) GetStatsHistory(days int) (*StatsHistory, error) {
 	// Query paste counts
 	var pasteCounts []DailyCount
 	s.db.Model(&models.Paste{}).
-		Select("DATE(created_at) as date, COUNT(*) as count").
+		Select(day+" as date, COUNT(*) as count").
 		Where("created_at BETWEEN ? AND ?", startDate, endDate).
-		Group("DATE(created_at)").
+		Group(day).
 		Order("date ASC").
 		Find(&pasteCounts)
 
 	// Query URL counts
 	var urlCounts []DailyCount
 	s.db.Model(&models.Shortlink{}).
-		Select("DATE(created_at) as date, COUNT(*) as count").
+		Select(day+" as date, COUNT(*) as count").
 		Where("created_at BETWEEN ? AND ?", startDate, endDate).
-		Group("DATE(created_at)").
+		Group(day).
 		Order("date ASC").
 		Find(&urlCounts)
 
@@ -184,18 +196,18 @@ func (s *AnalyticsService) GetStatsHistory(days int) (*StatsHistory, error) {
 	}
 	var storageCounts []StorageCount
 	s.db.Model(&models.Paste{}).
-		Select("DATE(created_at) as date, SUM(size) as size, COUNT(*) as count").
+		Select(day+" as date, SUM(size) as size, COUNT(*) as count").
 		Where("created_at BETWEEN ? AND ?", startDate, endDate).
-		Group("DATE(created_at)").
+		Group(day).
 		Order("date ASC").
 		Find(&storageCounts)
 
 	// Query API key counts
 	var apiKeyCounts []DailyCount
 	s.db.Model(&models.APIKey{}).
-		Select("DATE(created_at) as date, COUNT(*) as count").
+		Select(day+" as date, COUNT(*) as count").
 		Where("created_at BETWEEN ? AND ? AND verified = ?", startDate, endDate, true).
-		Group("DATE(created_at)").
+		Group(day).
 		Order("date ASC").
 		Find(&apiKeyCounts)
 
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// hashingReader hashes and counts the content read through it
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// putContent stores content under name in the named storage, deduplicating it
+// against identical content that's already stored there. Text content is
+// compressed at rest. The blob record is created or referenced through db, so
+// a transaction that fails undoes the reference. It returns the path of the
+// content, its hex encoded SHA-256 hash, and whether it was newly stored;
+// content that isn't new must never be deleted directly.
+func (s *PasteService) putContent(db *gorm.DB, storageName, name string, content io.Reader, mimeType string) (string, string, bool, error) {
+	store, err := s.storeFor(storageName)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	body := &hashingReader{r: content, hash: sha256.New()}
+	var path string
+	if s.isTextContent(mimeType) {
+		path, err = store.PutCompressed(name, body)
+	} else {
+		path, err = store.Put(name, body)
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+
+	storedSize, err := store.Size(path)
+	if err != nil {
+		s.logger.Warn("failed to get size of stored content",
+			zap.String("path", path),
+			zap.Error(err))
+		storedSize = body.n
+	}
+
+	// The content can't be looked up before it's been read, so it's always
+	// stored and the copy discarded if it turns out to be a duplicate
+	blob := models.Blob{
+		Hash:        hex.EncodeToString(body.hash.Sum(nil)),
+		Size:        body.n,
+		StoredSize:  storedSize,
+		StorageName: storageName,
+		StoragePath: path,
+		RefCount:    1,
+	}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}, {Name: "storage_name"}},
+		DoUpdates: clause.Assignments(map[string]any{"ref_count": gorm.Expr("blobs.ref_count + 1")}),
+	}).Create(&blob).Error
+	if err == nil {
+		err = db.Model(&models.Blob{}).
+			Where("hash = ? AND storage_name = ?", blob.Hash, blob.StorageName).
+			Pluck("storage_path", &blob.StoragePath).Error
+	}
+	if err != nil {
+		_ = store.Delete(path)
+		return "", "", false, err
+	}
+
+	if blob.StoragePath != path {
+		if err := store.Delete(path); err != nil {
+			s.logger.Error("failed to delete duplicate content",
+				zap.String("path", path),
+				zap.Error(err))
+		}
+		return blob.StoragePath, blob.Hash, false, nil
+	}
+
+	return path, blob.Hash, true, nil
+}
+
+// discardContent cleans up after content stored by putContent in a
+// transaction that failed. Rolling back the transaction already dropped the
+// reference, only content that was newly stored is left to delete.
+func (s *PasteService) discardContent(storageName, path string, isNew bool) {
+	if !isNew {
+		return
+	}
+	store, err := s.storeFor(storageName)
+	if err != nil {
+		return
+	}
+	if err := store.Delete(path); err != nil {
+		s.logger.Error("failed to delete discarded content",
+			zap.String("path", path),
+			zap.Error(err))
+	}
+}
+
+// releaseContent drops a reference to each of the paths in the named storage,
+// deleting the content once nothing refers to it anymore. Content stored before
+// deduplication has no blob record and is deleted straight away.
+func (s *PasteService) releaseContent(db *gorm.DB, storageName string, paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	store, err := s.storeFor(storageName)
+	if err != nil {
+		return err
+	}
+
+	var shared []string
+	if err := db.Model(&models.Blob{}).
+		Where("storage_name = ? AND storage_path IN ?", storageName, paths).
+		Pluck("storage_path", &shared).Error; err != nil {
+		return err
+	}
+	isShared := make(map[string]bool, len(shared))
+	for _, path := range shared {
+		isShared[path] = true
+	}
+
+	// Content without a blob record is deleted before any references are
+	// dropped, so that a failure can be retried
+	var blobPaths []string
+	for _, path := range paths {
+		if isShared[path] {
+			blobPaths = append(blobPaths, path)
+			continue
+		}
+		if err := store.Delete(path); err != nil {
+			return err
+		}
+	}
+
+	var unused []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, path := range blobPaths {
+			if err := tx.Model(&models.Blob{}).
+				Where("storage_name = ? AND storage_path = ?", storageName, path).
+				UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+				return err
+			}
+
+			result := tx.Where("storage_name = ? AND storage_path = ? AND ref_count <= 0", storageName, path).
+				Delete(&models.Blob{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				unused = append(unused, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The blob records are gone by now, so a failure can only be logged
+	for _, path := range unused {
+		if err := store.Delete(path); err != nil {
+			s.logger.Error("failed to delete unused content",
+				zap.String("path", path),
+				zap.Error(err))
+		}
+	}
+
+	return nil
+}
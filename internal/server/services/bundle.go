@@ -0,0 +1,275 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"path/filepath"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// createBundle creates a multi-file paste from several uploaded files. The
+// size limit applies to the bundle as a whole rather than to each file.
+func (s *PasteService) createBundle(headers []*multipart.FileHeader, apiKey *models.APIKey, opts *PasteOptions) (*models.Paste, error) {
+	// Reject oversized bundles before reading any of the files
+	var total int64
+	seen := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		total += header.Size
+
+		name := bundleFilename(header.Filename)
+		if seen[name] {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Duplicate filename in bundle: %s", name))
+		}
+		seen[name] = true
+	}
+	if err := s.validateFileSize(total, apiKey); err != nil {
+		return nil, err
+	}
+
+	maxViews, err := viewLimit(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := passwordHash(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The files of a bundle are kept together, in the storage chosen for the
+	// bundle as a whole
+	store, route, err := s.chooseStorage(storageRequest{
+		Size:    total,
+		APIKey:  apiKey,
+		Private: opts.Private,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkCapacity(store, apiKey); err != nil {
+		return nil, err
+	}
+	if _, _, err := s.uploadLimit(apiKey, total); err != nil {
+		return nil, err
+	}
+
+	paste := &models.Paste{
+		Private:      opts.Private,
+		PasswordHash: password,
+		MaxViews:     maxViews,
+		StorageName:  store.Name,
+		StorageType:  store.Type,
+		StorageRoute: route,
+	}
+
+	// Set API key if provided
+	if apiKey != nil {
+		paste.APIKey = apiKey.Key
+	}
+
+	// Content that's newly stored, to be cleaned up if the paste can't be saved
+	var stored []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lockQuota(tx, apiKey); err != nil {
+			return err
+		}
+
+		// Create the initial database record so the files can use its ID
+		if err := tx.Create(paste).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to save paste")
+		}
+
+		remaining := s.maxFileSize(apiKey)
+		for i, header := range headers {
+			file, isNew, err := s.storeBundleFile(tx, paste, i, header, remaining, apiKey)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				stored = append(stored, file.StoragePath)
+			}
+			remaining -= file.Size
+
+			paste.Files = append(paste.Files, *file)
+			paste.Size += file.Size
+		}
+
+		// The bundle is described by its first file when viewed as a single paste
+		primary := paste.PrimaryFile()
+		paste.Filename = primary.Filename
+		paste.MimeType = primary.MimeType
+		paste.Extension = primary.Extension
+
+		expiry, err := s.calculateExpiry(ExpiryOptions{
+			Size:      paste.Size,
+			HasAPIKey: apiKey != nil,
+			ExpiresIn: opts.ExpiresIn,
+			ExpiresAt: opts.ExpiresAt,
+		})
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		paste.ExpiresAt = expiry
+
+		// Saving the paste also creates its file records
+		if err := tx.Save(paste).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update paste")
+		}
+
+		return s.checkQuota(tx, apiKey)
+	})
+
+	if err != nil {
+		// Clean up any files stored before the failure
+		for _, path := range stored {
+			s.discardContent(paste.StorageName, path, true)
+		}
+		return nil, err
+	}
+
+	return paste, nil
+}
+
+// storeBundleFile stores a single file of a bundle, allowing it at most limit
+// bytes. It also reports whether the content was newly stored, see putContent.
+func (s *PasteService) storeBundleFile(db *gorm.DB, paste *models.Paste, position int, header *multipart.FileHeader, limit int64, apiKey *models.APIKey) (*models.PasteFile, bool, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusInternalServerError, "Failed to open uploaded file")
+	}
+	defer f.Close()
+
+	mime, content, err := sniffContent(f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	filename := bundleFilename(header.Filename)
+	contentType := detectContentType(mime, filename, "")
+	file := &models.PasteFile{
+		PasteID:   paste.ID,
+		Position:  position,
+		Filename:  filename,
+		MimeType:  contentType,
+		Extension: detectExtension(mime, contentType, filename, ""),
+	}
+
+	// Generate a storage name unique to this file within the bundle
+	storageName := fmt.Sprintf("%s-%d", paste.ID, position)
+	if file.Extension != "" {
+		storageName = storageName + "." + file.Extension
+	}
+
+	body := &sizeLimitedReader{
+		r:     content,
+		limit: limit,
+	}
+	var isNew bool
+	file.StoragePath, file.SHA256, isNew, err = s.putContent(db, paste.StorageName, storageName, body, file.MimeType)
+	if err != nil {
+		if body.Exceeded() {
+			return nil, false, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Bundle exceeds upload limit of %d bytes", s.maxFileSize(apiKey)))
+		}
+		return nil, false, fiber.NewError(fiber.StatusInternalServerError, "Failed to store content")
+	}
+	file.Size = body.n
+
+	return file, isNew, nil
+}
+
+// bundleFilename returns the name a file is stored under within a bundle.
+// Only the base name is kept so filenames can be used in URLs and zip entries.
+func bundleFilename(filename string) string {
+	name := filepath.Base(filepath.Clean("/" + filename))
+	if name == "/" || name == "." || name == "-" {
+		return "untitled"
+	}
+	return name
+}
+
+// RenderFile serves the raw content of a single file within a bundle
+func (s *PasteService) RenderFile(c *fiber.Ctx, paste *models.Paste, filename string) error {
+	file, ok := paste.FindFile(filename)
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "File not found in paste")
+	}
+
+	c.Set("Content-Type", file.MimeType)
+	setContentCacheHeaders(c, paste)
+	return s.sendContent(c, paste, *file, "")
+}
+
+// renderBundleDownload streams all files of a bundle as a zip archive
+func (s *PasteService) renderBundleDownload(c *fiber.Ctx, paste *models.Paste) error {
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, paste.ID))
+	setContentCacheHeaders(c, paste)
+
+	files := paste.Files
+	store, err := s.storeFor(paste.StorageName)
+	if err != nil {
+		return err
+	}
+
+	// The content of a paste with a view limit may be burned as soon as this
+	// returns, so the archive has to be built before then
+	if paste.HasViewLimit() {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for _, file := range files {
+			if err := s.writeZipEntry(archive, store, file); err != nil {
+				return err
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		return c.Send(buf.Bytes())
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		archive := zip.NewWriter(w)
+		for _, file := range files {
+			if err := s.writeZipEntry(archive, store, file); err != nil {
+				// Headers have already been sent, so all we can do is stop
+				s.logger.Error("failed to write bundle archive",
+					zap.String("id", paste.ID),
+					zap.String("filename", file.Filename),
+					zap.Error(err))
+				return
+			}
+		}
+		if err := archive.Close(); err != nil {
+			s.logger.Error("failed to finish bundle archive",
+				zap.String("id", paste.ID),
+				zap.Error(err))
+		}
+	})
+	return nil
+}
+
+// writeZipEntry copies a single bundle file from storage into the archive
+func (s *PasteService) writeZipEntry(archive *zip.Writer, store storage.Provider, file models.PasteFile) error {
+	content, err := store.Open(file.StoragePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	entry, err := archive.Create(file.Filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, content)
+	return err
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/database"
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// viewLimit returns the number of views allowed by the paste options, or nil
+// if the paste can be viewed any number of times
+func viewLimit(opts *PasteOptions) (*int, error) {
+	if opts.MaxViews < 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "max_views must be a positive number")
+	}
+
+	if opts.BurnAfterRead {
+		if opts.MaxViews > 1 {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "burn_after_read can't be combined with max_views")
+		}
+		maxViews := 1
+		return &maxViews, nil
+	}
+
+	if opts.MaxViews == 0 {
+		return nil, nil
+	}
+	maxViews := opts.MaxViews
+	return &maxViews, nil
+}
+
+// ConsumeView uses up one view of a paste with a view limit, and reports
+// whether it was the final one. Once the final view has been served the
+// paste should be deleted with Burn.
+func (s *PasteService) ConsumeView(paste *models.Paste) (bool, error) {
+	if !paste.HasViewLimit() {
+		return false, nil
+	}
+
+	views, err := s.claimView(paste.ID)
+	if err != nil {
+		return false, err
+	}
+
+	paste.Views = views
+	return paste.ViewsRemaining() == 0, nil
+}
+
+// claimView uses up a view of a paste, returning the number of views it has
+// had. The view is claimed and counted in a single statement, so concurrent
+// readers can never both get the last view.
+func (s *PasteService) claimView(id string) (int, error) {
+	claim := func(tx *gorm.DB, claimed *models.Paste) error {
+		result := tx.Model(claimed).
+			Where("id = ? AND views < max_views", id).
+			UpdateColumn("views", gorm.Expr("views + ?", 1))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Paste not found or expired")
+		}
+		return nil
+	}
+
+	var claimed models.Paste
+	if database.DialectOf(s.db).UpdateReturning() {
+		err := claim(s.db.Clauses(clause.Returning{Columns: []clause.Column{{Name: "views"}}}), &claimed)
+		return claimed.Views, err
+	}
+
+	// Otherwise the count is read back in the same transaction, which holds
+	// the row from the update on
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := claim(tx, &claimed); err != nil {
+			return err
+		}
+		return tx.Select("views").First(&claimed, "id = ?", id).Error
+	})
+	return claimed.Views, err
+}
+
+// Burn deletes a paste that has used up all of its views. The content is
+// deleted straight away rather than being left for CleanupExpired, which
+// only picks up pastes that couldn't be burned.
+func (s *PasteService) Burn(paste *models.Paste) {
+	// Reload the paste since the one that was viewed may have been pinned to
+	// a revision
+	var burned models.Paste
+	if err := s.db.Preload("Files").Preload("Revisions").First(&burned, "id = ?", paste.ID).Error; err != nil {
+		s.logger.Error("failed to load paste to burn",
+			zap.String("id", paste.ID),
+			zap.Error(err))
+		return
+	}
+
+	if err := s.deleteContent(s.db, &burned); err != nil {
+		return
+	}
+
+	if err := s.db.Delete(&burned).Error; err != nil {
+		s.logger.Error("failed to delete burned paste",
+			zap.String("id", paste.ID),
+			zap.Error(err))
+	}
+}
+
+// RenderSealed renders a page in place of a paste with a view limit, so that
+// opening the link (or a link preview fetching it) doesn't use up a view. The
+// content is only shown once the viewer chooses to reveal it.
+func (s *PasteService) RenderSealed(c *fiber.Ctx, paste *models.Paste) error {
+	deletionUrl := takeDeletionURL(c)
+
+	c.Set("Cache-Control", "private, no-store")
+	return c.Render("sealed", fiber.Map{
+		"id":             paste.ID,
+		"filename":       paste.Filename,
+		"path":           revisionPath(c, paste),
+		"isText":         s.isTextContent(paste.MimeType) && !paste.IsBundle(),
+		"viewsRemaining": paste.ViewsRemaining(),
+		"burnAfterRead":  paste.ViewsRemaining() == 1,
+		"baseUrl":        s.config.Server.BaseURL,
+		"deletionUrl":    deletionUrl,
+		"metadata": fiber.Map{
+			"size":     formatSize(paste.Size),
+			"mimeType": paste.MimeType,
+		},
+	}, "layouts/main")
+}
+
+// takeDeletionURL returns the deletion URL stored in a cookie after a browser
+// upload, clearing the cookie so it's only shown once
+func takeDeletionURL(c *fiber.Ctx) string {
+	cookie := c.Cookies("deletion_url")
+	if cookie == "" {
+		return ""
+	}
+
+	// Clear the cookie before reading it to ensure one-time use
+	c.Cookie(&fiber.Cookie{
+		Name:     "deletion_url",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now().Add(-24 * time.Hour),
+		HTTPOnly: true,
+	})
+	return cookie
+}
@@ -13,6 +13,7 @@ type CleanupService struct {
 	logger *zap.Logger
 	config *config.Config
 	paste  *PasteService
+	upload *UploadService
 	url    *URLService
 	apiKey *APIKeyService
 }
@@ -23,6 +24,7 @@ func NewCleanupService(db *gorm.DB, logger *zap.Logger, config *config.Config, s
 		logger: logger,
 		config: config,
 		paste:  services.Paste,
+		upload: services.Upload,
 		url:    services.URL,
 		apiKey: services.APIKey,
 	}
@@ -39,6 +41,35 @@ func (s *CleanupService) RunCleanup() {
 		s.logger.Info("cleaned up expired pastes", zap.Int64("count", count))
 	}
 
+	// Cleanup expired and abandoned resumable uploads
+	if count, err := s.upload.CleanupExpired(); err != nil {
+		s.logger.Error("failed to cleanup expired uploads", zap.Error(err))
+	} else {
+		s.logger.Info("cleaned up expired uploads", zap.Int64("count", count))
+	}
+
+	// Move content encrypted at rest under a previous key to the current one
+	if count, err := s.paste.RewrapStorageKeys(); err != nil {
+		s.logger.Error("failed to rewrap storage keys", zap.Error(err))
+	} else if count > 0 {
+		s.logger.Info("rewrapped storage keys", zap.Int64("count", count))
+	}
+
+	// Check stored content against the records referring to it
+	if cfg := s.config.Server.Cleanup.Reconcile; cfg.Enabled {
+		if report, err := s.Reconcile(cfg.Repair); err != nil {
+			s.logger.Error("failed to reconcile storage", zap.Error(err))
+		} else {
+			s.logger.Info("reconciled storage",
+				zap.Bool("repaired", cfg.Repair),
+				zap.Int64("orphaned_content", report.OrphanedContent),
+				zap.Int64("orphaned_bytes", report.OrphanedBytes),
+				zap.Int64("broken_content", report.BrokenContent),
+				zap.Int64("broken_pastes", report.BrokenPastes),
+				zap.Int64("broken_revisions", report.BrokenRevisions))
+		}
+	}
+
 	// Cleanup expired shortlinks
 	if count, err := s.url.CleanupExpired(); err != nil {
 		s.logger.Error("failed to cleanup expired shortlinks", zap.Error(err))
@@ -54,6 +85,34 @@ func (s *CleanupService) RunCleanup() {
 	s.logger.Info("cleanup tasks completed")
 }
 
+// RunScrub re-hashes all stored content to detect corruption
+func (s *CleanupService) RunScrub() {
+	s.logger.Info("starting scrub of stored content")
+
+	checked, corrupt, err := s.paste.ScrubContent()
+	if err != nil {
+		s.logger.Error("failed to scrub stored content", zap.Error(err))
+		return
+	}
+	s.logger.Info("scrubbed stored content",
+		zap.Int64("checked", checked),
+		zap.Int64("corrupt", corrupt))
+}
+
+// StartScrubScheduler starts a periodic scrub of stored content
+func (s *CleanupService) StartScrubScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.RunScrub()
+		}
+	}()
+
+	s.logger.Info("scrub scheduler started", zap.Duration("interval", interval))
+}
+
 // StartCleanupScheduler starts a periodic cleanup task
 func (s *CleanupService) StartCleanupScheduler(interval time.Duration) {
 	go func() {
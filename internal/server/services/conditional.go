@@ -0,0 +1,158 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
+)
+
+// contentETag returns a strong ETag for a file's content. It's the SHA-256
+// hash of the content, so identical content has the same ETag wherever it's
+// served from. Content stored before it was hashed falls back to the paste
+// revision, and the file's position for bundle files.
+func contentETag(paste *models.Paste, file models.PasteFile) string {
+	if file.SHA256 != "" {
+		return `"` + file.SHA256 + `"`
+	}
+	if paste.IsBundle() {
+		return fmt.Sprintf(`"%s-r%d-f%d"`, paste.ID, paste.Revision, file.Position)
+	}
+	return fmt.Sprintf(`"%s-r%d"`, paste.ID, paste.Revision)
+}
+
+// compressedETag returns the ETag of the compressed representation of content
+// with the given ETag
+func compressedETag(etag string) string {
+	if strings.HasSuffix(etag, `"`) {
+		return strings.TrimSuffix(etag, `"`) + "-" + storage.CompressedEncoding + `"`
+	}
+	return etag + "-" + storage.CompressedEncoding
+}
+
+// contentModified returns when the content of a paste's revision was last
+// changed. Archived revisions record when their content was created, while
+// the latest revision's content dates from when the paste was last revised.
+func contentModified(paste *models.Paste) time.Time {
+	if paste.Revision == paste.LatestRevision() && paste.RevisedAt != nil {
+		return *paste.RevisedAt
+	}
+	for _, rev := range paste.Revisions {
+		if rev.Number == paste.Revision {
+			return rev.CreatedAt
+		}
+	}
+	return paste.CreatedAt
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there's no
+// If-None-Match, against content with the given modification time and ETags
+func notModified(c *fiber.Ctx, modified time.Time, etags ...string) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, tag := range strings.Split(noneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" {
+				return true
+			}
+			for _, etag := range etags {
+				if tag == etag {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince)); err == nil {
+		return !modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// requestedRange returns the byte range requested of content of the given
+// size. It returns false if the whole content should be sent instead: when
+// there's no Range header, when If-Range doesn't match the content, or when
+// more than one range is requested. Ranges that can't be satisfied are an
+// error.
+func requestedRange(c *fiber.Ctx, size int64, modified time.Time, etag string) (int64, int64, bool, error) {
+	header := c.Get(fiber.HeaderRange)
+	if header == "" {
+		return 0, 0, false, nil
+	}
+
+	// A range only applies to the representation the client already has part
+	// of, which an ETag has to match exactly
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) {
+			if ifRange != etag {
+				return 0, 0, false, nil
+			}
+		} else if date, err := http.ParseTime(ifRange); err != nil || !modified.Truncate(time.Second).Equal(date) {
+			return 0, 0, false, nil
+		}
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	unsatisfiable := fiber.NewError(fiber.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, nil
+	}
+
+	var offset, end int64
+	if first == "" {
+		// A suffix range of the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false, unsatisfiable
+		}
+		offset, end = max(size-n, 0), size-1
+	} else {
+		var err error
+		if offset, err = strconv.ParseInt(first, 10, 64); err != nil || offset < 0 {
+			return 0, 0, false, nil
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < offset {
+				return 0, 0, false, nil
+			}
+			end = min(end, size-1)
+		}
+		if offset >= size {
+			return 0, 0, false, unsatisfiable
+		}
+	}
+
+	return offset, end - offset + 1, true, nil
+}
+
+// setContentDigest sets the digest headers of content sent as it was stored,
+// from its hex encoded SHA-256 hash. The digests don't hold for the content
+// once it's encoded, so it's marked for the compression middleware to leave
+// alone.
+func setContentDigest(c *fiber.Ctx, hash string) {
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != sha256.Size {
+		return
+	}
+	digest := base64.StdEncoding.EncodeToString(sum)
+	c.Set("Repr-Digest", "sha-256=:"+digest+":")
+	c.Set("Digest", "SHA-256="+digest)
+	c.Locals("storedContent", true)
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/watzon/0x45/internal/models"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change
+const diffContextLines = 3
+
+// Diff layouts supported by RenderDiff
+const (
+	DiffViewUnified = "unified"
+	DiffViewSplit   = "split"
+)
+
+// diffSide is one of the two pastes being compared
+type diffSide struct {
+	paste   *models.Paste
+	label   string
+	content string
+}
+
+// RenderDiff renders a syntax highlighted diff between two pastes, or two
+// revisions of the same paste. The layout is chosen with the view query
+// parameter and defaults to a unified diff.
+func (s *PasteService) RenderDiff(c *fiber.Ctx, a, b *models.Paste) error {
+	from, to, err := s.loadDiffSides(a, b)
+	if err != nil {
+		return err
+	}
+
+	view := c.Query("view", DiffViewUnified)
+	if view != DiffViewSplit {
+		view = DiffViewUnified
+	}
+
+	binding := fiber.Map{
+		"isDiff":     true,
+		"from":       from.label,
+		"to":         to.label,
+		"path":       c.Path(),
+		"isSplit":    view == DiffViewSplit,
+		"hasChanges": from.content != to.content,
+		"baseUrl":    s.config.Server.BaseURL,
+	}
+
+	if view == DiffViewSplit {
+		rows, err := splitDiffRows(from, to)
+		if err != nil {
+			return err
+		}
+		binding["rows"] = rows
+	} else {
+		content, err := s.renderHighlightedText(unifiedDiff(from, to), "diff", "text/x-diff")
+		if err != nil {
+			return err
+		}
+		binding["content"] = content
+	}
+
+	setDiffCacheHeaders(c, a, b)
+	return c.Render("diff", binding, "layouts/main")
+}
+
+// RenderDiffRaw serves a unified diff between two pastes as text/x-diff
+func (s *PasteService) RenderDiffRaw(c *fiber.Ctx, a, b *models.Paste) error {
+	from, to, err := s.loadDiffSides(a, b)
+	if err != nil {
+		return err
+	}
+
+	setDiffCacheHeaders(c, a, b)
+	c.Set("Content-Type", "text/x-diff; charset=utf-8")
+	return c.SendString(unifiedDiff(from, to))
+}
+
+// loadDiffSides loads the content of both pastes, which must be single text
+// files no larger than the configured diff size limit
+func (s *PasteService) loadDiffSides(a, b *models.Paste) (*diffSide, *diffSide, error) {
+	sides := make([]*diffSide, 2)
+	for i, paste := range []*models.Paste{a, b} {
+		if paste.IsBundle() {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Multi-file pastes can't be diffed")
+		}
+		if paste.Encrypted {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Encrypted pastes can't be diffed")
+		}
+		if !s.isTextContent(paste.MimeType) {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Only text pastes can be diffed")
+		}
+		if paste.HasViewLimit() {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Pastes with a view limit can't be diffed")
+		}
+		if limit := s.config.Server.MaxDiffSize; limit > 0 && paste.Size > int64(limit) {
+			return nil, nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Pastes larger than %d bytes can't be diffed", limit))
+		}
+
+		content, err := s.getContent(paste, paste.StoragePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sides[i] = &diffSide{
+			paste:   paste,
+			label:   fmt.Sprintf("%s@%d/%s", paste.ID, paste.Revision, paste.Filename),
+			content: string(content),
+		}
+	}
+	return sides[0], sides[1], nil
+}
+
+// unifiedDiff returns a unified diff between two pastes, or an empty string
+// if their content is identical
+func unifiedDiff(from, to *diffSide) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(from.content),
+		B:        splitLines(to.content),
+		FromFile: from.label,
+		ToFile:   to.label,
+		Context:  diffContextLines,
+	})
+	if err != nil {
+		// Writing to a strings.Builder never fails
+		return ""
+	}
+	return diff
+}
+
+// splitDiffRows builds the rows of a side-by-side diff, with each side
+// highlighted using the lexer for its own paste
+func splitDiffRows(from, to *diffSide) ([]fiber.Map, error) {
+	fromLines := splitLines(from.content)
+	toLines := splitLines(to.content)
+
+	fromHTML, err := highlightLines(from)
+	if err != nil {
+		return nil, err
+	}
+	toHTML, err := highlightLines(to)
+	if err != nil {
+		return nil, err
+	}
+
+	cell := func(lines []string, i int) fiber.Map {
+		return fiber.Map{"number": i + 1, "content": lines[i]}
+	}
+
+	var rows []fiber.Map
+	matcher := difflib.NewMatcher(fromLines, toLines)
+	for g, group := range matcher.GetGroupedOpCodes(diffContextLines) {
+		if g > 0 {
+			rows = append(rows, fiber.Map{"kind": "separator"})
+		}
+
+		for _, op := range group {
+			fromCount, toCount := op.I2-op.I1, op.J2-op.J1
+			for k := 0; k < max(fromCount, toCount); k++ {
+				row := fiber.Map{}
+				switch op.Tag {
+				case 'e':
+					row["kind"] = "equal"
+				case 'd':
+					row["kind"] = "delete"
+				case 'i':
+					row["kind"] = "insert"
+				case 'r':
+					row["kind"] = "replace"
+				}
+				if k < fromCount {
+					row["from"] = cell(fromHTML, op.I1+k)
+				}
+				if k < toCount {
+					row["to"] = cell(toHTML, op.J1+k)
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// highlightLines highlights the content of a diff side and returns the HTML
+// for each of its lines, matching the lines returned by splitLines
+func highlightLines(side *diffSide) ([]string, error) {
+	lines := splitLines(side.content)
+	lexer := selectLexer(side.content, side.paste.Extension, side.paste.MimeType)
+	iterator, err := lexer.Tokenise(nil, side.content)
+	if err != nil {
+		return nil, err
+	}
+
+	formatter := html.New(
+		html.PreventSurroundingPre(true),
+		html.TabWidth(4),
+		html.WithClasses(false), // Use inline styles
+	)
+	style := highlightStyle()
+
+	tokenLines := chroma.SplitTokensIntoLines(iterator.Tokens())
+	highlighted := make([]string, len(lines))
+	for i, line := range lines {
+		// Lexers may split content differently, so fall back to plain text
+		// for any line the tokens don't cover
+		if i >= len(tokenLines) {
+			highlighted[i] = template.HTMLEscapeString(strings.TrimSuffix(line, "\n"))
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := formatter.Format(&buf, style, chroma.Literator(tokenLines[i]...)); err != nil {
+			return nil, err
+		}
+		highlighted[i] = strings.TrimSuffix(buf.String(), "\n")
+	}
+	return highlighted, nil
+}
+
+// splitLines splits content into newline terminated lines
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines
+}
+
+// previousDiffPath returns the path of the diff between a paste's revision and
+// the one before it, or an empty string for the first revision
+func previousDiffPath(paste *models.Paste) string {
+	if paste.Revision <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("/p/%s@%d/diff/%s@%d", paste.ID, paste.Revision-1, paste.ID, paste.Revision)
+}
+
+// setDiffCacheHeaders sets the cache headers for a diff. Like paste content,
+// a diff is only immutable when both sides are pinned to a revision, and is
+// never kept by a shared cache when either side is protected.
+func setDiffCacheHeaders(c *fiber.Ctx, a, b *models.Paste) {
+	if a.HasViewLimit() || a.HasPassword() || b.HasViewLimit() || b.HasPassword() {
+		c.Set("Cache-Control", "private, no-store")
+		return
+	}
+
+	if revisionPinned(c) {
+		c.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Set("Cache-Control", "public, no-cache")
+	}
+	c.Set("ETag", fmt.Sprintf("%s-r%d..%s-r%d", a.ID, a.Revision, b.ID, b.Revision))
+}
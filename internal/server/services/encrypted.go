@@ -0,0 +1,120 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/models"
+)
+
+// EncryptedMimeType is the content type of an encrypted paste's envelope
+const EncryptedMimeType = "application/vnd.0x45.encrypted+json"
+
+// Values of the envelope fields supported by this server
+const (
+	envelopeVersion   = 1
+	envelopeAlgorithm = "AES-GCM"
+	envelopeIVLength  = 12
+	envelopeTagLength = 16
+)
+
+// Envelope is the stored form of an encrypted paste. The content is encrypted
+// by the client with AES-256-GCM under a random key that is only ever kept in
+// the URL fragment, so the server never sees the key or the plaintext.
+type Envelope struct {
+	// Version of the envelope format, currently always 1
+	Version int `json:"v"`
+	// Algorithm used to encrypt the content, currently always "AES-GCM"
+	Algorithm string `json:"alg"`
+	// IV is the unpadded base64url encoding of the 12 byte GCM nonce
+	IV string `json:"iv"`
+	// Ciphertext is the unpadded base64url encoding of the ciphertext,
+	// followed by the 16 byte authentication tag
+	Ciphertext string `json:"ct"`
+}
+
+// readEnvelope reads and validates the envelope of an encrypted paste,
+// allowing it at most limit bytes. The envelope is returned re-encoded so
+// that nothing but the known fields is ever stored.
+func readEnvelope(content io.Reader, limit int64) ([]byte, error) {
+	body := &sizeLimitedReader{r: content, limit: limit}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		if body.Exceeded() {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("File size exceeds limit of %d bytes", limit))
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to read content")
+	}
+	if len(data) == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Empty file")
+	}
+
+	var envelope Envelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Encrypted content must be a JSON envelope")
+	}
+	if err := envelope.validate(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope)
+}
+
+// validate checks that the envelope is in a format clients can decrypt
+func (e *Envelope) validate() error {
+	if e.Version != envelopeVersion {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unsupported envelope version %d", e.Version))
+	}
+	if e.Algorithm != envelopeAlgorithm {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unsupported envelope algorithm %q", e.Algorithm))
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(e.IV)
+	if err != nil || len(iv) != envelopeIVLength {
+		return fiber.NewError(fiber.StatusBadRequest, "Envelope IV must be 12 bytes of unpadded base64url")
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(e.Ciphertext)
+	if err != nil || len(ciphertext) < envelopeTagLength {
+		return fiber.NewError(fiber.StatusBadRequest, "Envelope ciphertext must be unpadded base64url including the authentication tag")
+	}
+	return nil
+}
+
+// RenderEncrypted renders the viewer for an encrypted paste. The envelope is
+// embedded in the page, where it's decrypted with the key from the URL
+// fragment, so a paste with a view limit only needs the one request.
+func (s *PasteService) RenderEncrypted(c *fiber.Ctx, paste *models.Paste) error {
+	envelope, err := s.getContent(paste, paste.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	// The deletion URL is only shown once, so the page can't be cached with it
+	deletionUrl := takeDeletionURL(c)
+	if deletionUrl != "" {
+		c.Set("Cache-Control", "private, no-store")
+	} else {
+		setContentCacheHeaders(c, paste)
+	}
+	return c.Render("encrypted", fiber.Map{
+		"id":          paste.ID,
+		"envelope":    string(envelope),
+		"path":        revisionPath(c, paste),
+		"created":     paste.CreatedAt.Format("2006-01-02 15:04:05"),
+		"expires":     formatExpiryTime(paste.ExpiresAt),
+		"revision":    paste.Revision,
+		"revisions":   revisionList(paste),
+		"baseUrl":     s.config.Server.BaseURL,
+		"deletionUrl": deletionUrl,
+		"metadata": fiber.Map{
+			"size": formatSize(paste.Size),
+		},
+	}, "layouts/main")
+}
@@ -0,0 +1,349 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+)
+
+// migrationBatchSize is the number of pastes loaded at a time by
+// MigrateStorage
+const migrationBatchSize = 100
+
+// errPasteChanged is returned when a paste changes while it's being migrated
+var errPasteChanged = errors.New("paste changed during migration")
+
+// StorageMigrationOptions selects the pastes moved by MigrateStorage and
+// controls how they're moved
+type StorageMigrationOptions struct {
+	From string // Storage to move pastes out of, empty for all but To
+	To   string // Storage to move pastes to
+
+	OlderThan time.Duration // Only move pastes created at least this long ago
+	MinSize   int64         // Only move pastes of at least this many bytes
+	MaxSize   int64         // Only move pastes of at most this many bytes
+
+	Rate   float64       // Pastes moved per second, 0 for no limit
+	Grace  time.Duration // How long source content is kept for reads in progress
+	DryRun bool          // Only report the pastes that would be moved
+
+	// Progress is called for each paste once it's been moved, or with the
+	// error that kept it from being moved
+	Progress func(paste *models.Paste, err error)
+}
+
+// StorageMigrationResult sums up a run of MigrateStorage
+type StorageMigrationResult struct {
+	Migrated int64
+	Failed   int64
+	Bytes    int64
+}
+
+// pendingRelease is source content waiting out the grace period before its
+// references are dropped
+type pendingRelease struct {
+	at      time.Time
+	storage string
+	paths   []string
+}
+
+// MigrateStorage moves the stored content of pastes to another storage. Each
+// paste is copied, the copy's size is verified, and the paste is switched
+// over to it in a single update that only applies if the paste hasn't changed
+// in the meantime; the source content is released last. A paste that fails
+// is left where it was, so the migration can be stopped at any time and
+// simply run again to pick up the pastes that are left.
+func (s *PasteService) MigrateStorage(ctx context.Context, opts StorageMigrationOptions) (StorageMigrationResult, error) {
+	var result StorageMigrationResult
+
+	var target *config.StorageConfig
+	for i := range s.config.Storage {
+		if s.config.Storage[i].Name == opts.To {
+			target = &s.config.Storage[i]
+		}
+	}
+	if target == nil || s.config.IsReplica(opts.To) {
+		return result, fmt.Errorf("unknown storage: %s", opts.To)
+	}
+	if opts.From == opts.To {
+		return result, fmt.Errorf("pastes are already in storage %s", opts.To)
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.Rate), 1)
+	}
+
+	var pending []pendingRelease
+	release := func(all bool) {
+		for len(pending) > 0 && (all || time.Since(pending[0].at) >= opts.Grace) {
+			if err := s.releaseContent(s.db, pending[0].storage, pending[0].paths...); err != nil {
+				s.logger.Error("failed to release migrated content",
+					zap.String("storage", pending[0].storage),
+					zap.Error(err))
+			}
+			pending = pending[1:]
+		}
+	}
+
+	// Pastes are walked in ID order so those that fail aren't loaded again
+	lastID := ""
+	for {
+		var pastes []models.Paste
+		if err := s.migrationQuery(opts).
+			Preload("Files").Preload("Revisions").
+			Where("id > ?", lastID).
+			Order("id ASC").
+			Limit(migrationBatchSize).
+			Find(&pastes).Error; err != nil {
+			release(true)
+			return result, err
+		}
+		if len(pastes) == 0 {
+			break
+		}
+		lastID = pastes[len(pastes)-1].ID
+
+		for i := range pastes {
+			paste := &pastes[i]
+			if err := limiter.Wait(ctx); err != nil {
+				release(true)
+				return result, ctx.Err()
+			}
+			release(false)
+
+			if opts.DryRun {
+				result.Migrated++
+				result.Bytes += paste.Size
+				if opts.Progress != nil {
+					opts.Progress(paste, nil)
+				}
+				continue
+			}
+
+			oldStorage, oldPaths := paste.StorageName, paste.StoragePaths()
+			err := s.migratePaste(paste, target)
+			if err != nil {
+				result.Failed++
+				s.logger.Error("failed to migrate paste",
+					zap.String("id", paste.ID),
+					zap.String("from", oldStorage),
+					zap.String("to", target.Name),
+					zap.Error(err))
+			} else {
+				result.Migrated++
+				result.Bytes += paste.Size
+				pending = append(pending, pendingRelease{at: time.Now(), storage: oldStorage, paths: oldPaths})
+			}
+			if opts.Progress != nil {
+				opts.Progress(paste, err)
+			}
+		}
+	}
+
+	// Wait out the grace period of the content released last, unless the
+	// migration is being stopped
+	if len(pending) > 0 {
+		select {
+		case <-time.After(time.Until(pending[len(pending)-1].at.Add(opts.Grace))):
+		case <-ctx.Done():
+		}
+	}
+	release(true)
+
+	return result, nil
+}
+
+// migrationQuery returns a query for the pastes selected by opts
+func (s *PasteService) migrationQuery(opts StorageMigrationOptions) *gorm.DB {
+	query := s.db.Model(&models.Paste{}).Where("storage_name <> ?", opts.To)
+	if opts.From != "" {
+		query = query.Where("storage_name = ?", opts.From)
+	}
+	if opts.OlderThan > 0 {
+		query = query.Where("created_at <= ?", time.Now().Add(-opts.OlderThan))
+	}
+	if opts.MinSize > 0 {
+		query = query.Where("size >= ?", opts.MinSize)
+	}
+	if opts.MaxSize > 0 {
+		query = query.Where("size <= ?", opts.MaxSize)
+	}
+	return query
+}
+
+// migratePaste copies the content of a paste to the target storage and
+// switches the paste over to the copy. On success paste is updated to
+// describe its new storage; the caller releases the old content.
+func (s *PasteService) migratePaste(paste *models.Paste, target *config.StorageConfig) error {
+	var copies []string
+	discard := func() {
+		if err := s.releaseContent(s.db, target.Name, copies...); err != nil {
+			s.logger.Error("failed to release copied content",
+				zap.String("id", paste.ID),
+				zap.Error(err))
+		}
+	}
+
+	// Content is copied outside of the transaction, which would otherwise
+	// block writes for as long as the copy takes
+	copyContent := func(path, name, mimeType string, size int64) (string, error) {
+		newPath, err := s.copyContent(paste.StorageName, target.Name, path, name, mimeType, size)
+		if err != nil {
+			return "", err
+		}
+		copies = append(copies, newPath)
+		return newPath, nil
+	}
+
+	newPath := ""
+	if !paste.IsBundle() {
+		name := paste.ID
+		if paste.Revision > 1 {
+			name = fmt.Sprintf("%s-r%d", paste.ID, paste.Revision)
+		}
+		var err error
+		if newPath, err = copyContent(paste.StoragePath, withExtension(name, paste.Extension), paste.MimeType, paste.Size); err != nil {
+			discard()
+			return err
+		}
+	}
+
+	filePaths := make([]string, len(paste.Files))
+	for i, file := range paste.Files {
+		name := fmt.Sprintf("%s-%d", paste.ID, file.Position)
+		var err error
+		if filePaths[i], err = copyContent(file.StoragePath, withExtension(name, file.Extension), file.MimeType, file.Size); err != nil {
+			discard()
+			return err
+		}
+	}
+
+	revisionPaths := make([]string, len(paste.Revisions))
+	for i, rev := range paste.Revisions {
+		name := fmt.Sprintf("%s-r%d", paste.ID, rev.Number)
+		var err error
+		if revisionPaths[i], err = copyContent(rev.StoragePath, withExtension(name, rev.Extension), rev.MimeType, rev.Size); err != nil {
+			discard()
+			return err
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// The paste is only switched over if it's still as it was read,
+		// otherwise the copies could be missing content added since
+		result := tx.Model(&models.Paste{}).
+			Where("id = ? AND storage_name = ? AND storage_path = ? AND revision = ?",
+				paste.ID, paste.StorageName, paste.StoragePath, paste.Revision).
+			UpdateColumns(map[string]any{
+				"storage_name": target.Name,
+				"storage_type": target.Type,
+				"storage_path": newPath,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errPasteChanged
+		}
+
+		for i, file := range paste.Files {
+			if err := tx.Model(&models.PasteFile{}).
+				Where("id = ?", file.ID).
+				UpdateColumn("storage_path", filePaths[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		for i, rev := range paste.Revisions {
+			if err := tx.Model(&models.PasteRevision{}).
+				Where("id = ?", rev.ID).
+				UpdateColumn("storage_path", revisionPaths[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		discard()
+		return err
+	}
+
+	paste.StorageName = target.Name
+	paste.StorageType = target.Type
+	paste.StoragePath = newPath
+	for i := range paste.Files {
+		paste.Files[i].StoragePath = filePaths[i]
+	}
+	for i := range paste.Revisions {
+		paste.Revisions[i].StoragePath = revisionPaths[i]
+	}
+	return nil
+}
+
+// copyContent copies content from one storage to another, deduplicating it
+// in the target storage like new content. The copy is checked against the
+// size the content should have, and against its blob record with the size of
+// the stored content reported by the target storage.
+func (s *PasteService) copyContent(from, to, path, name, mimeType string, size int64) (string, error) {
+	source, err := s.storeFor(from)
+	if err != nil {
+		return "", err
+	}
+	target, err := s.storeFor(to)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := source.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer content.Close()
+
+	newPath, _, _, err := s.putContent(s.db, to, name, content, mimeType)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s: %w", path, err)
+	}
+
+	var blob models.Blob
+	if err := s.db.Where("storage_name = ? AND storage_path = ?", to, newPath).First(&blob).Error; err != nil {
+		s.discardCopy(to, newPath)
+		return "", err
+	}
+	storedSize, err := target.Size(newPath)
+	if err == nil && (blob.Size != size || storedSize != blob.StoredSize) {
+		err = fmt.Errorf("copy of %s has size %d (%d stored), expected %d (%d stored)", path, blob.Size, storedSize, size, blob.StoredSize)
+	}
+	if err != nil {
+		s.discardCopy(to, newPath)
+		return "", err
+	}
+
+	return newPath, nil
+}
+
+// discardCopy drops the reference taken by a copy that failed verification
+func (s *PasteService) discardCopy(storageName, path string) {
+	if err := s.releaseContent(s.db, storageName, path); err != nil {
+		s.logger.Error("failed to release copied content",
+			zap.String("path", path),
+			zap.Error(err))
+	}
+}
+
+// withExtension appends an extension, if there is one, to a storage name
+func withExtension(name, extension string) string {
+	if extension == "" {
+		return name
+	}
+	return name + "." + extension
+}
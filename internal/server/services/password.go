@@ -0,0 +1,162 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PastePasswordHeader is the request header used to give the password of a
+// protected paste
+const PastePasswordHeader = "X-Paste-Password"
+
+// maxPasswordLength is the longest password bcrypt can hash
+const maxPasswordLength = 72
+
+// Errors returned for password protected pastes
+var (
+	ErrPasswordRequired = fiber.NewError(fiber.StatusUnauthorized, "Password required")
+	ErrInvalidPassword  = fiber.NewError(fiber.StatusUnauthorized, "Invalid password")
+)
+
+// IsPasswordError reports whether err means a paste's password was missing
+// or wrong
+func IsPasswordError(err error) bool {
+	return errors.Is(err, ErrPasswordRequired) || errors.Is(err, ErrInvalidPassword)
+}
+
+// passwordHash returns the hash of the password given in the paste options,
+// or an empty string if the paste isn't password protected
+func passwordHash(opts *PasteOptions) (string, error) {
+	if opts.Password == "" {
+		return "", nil
+	}
+	if len(opts.Password) > maxPasswordLength {
+		return "", fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Password can't be longer than %d bytes", maxPasswordLength))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fiber.NewError(fiber.StatusInternalServerError, "Failed to hash password")
+	}
+	return string(hash), nil
+}
+
+// CheckPassword checks that the request may access a password protected
+// paste. Browsers that unlocked the paste have a cookie for it, other clients
+// give the password in the X-Paste-Password header or with Basic auth.
+func (s *PasteService) CheckPassword(c *fiber.Ctx, paste *models.Paste) error {
+	if !paste.HasPassword() {
+		return nil
+	}
+
+	if cookie := c.Cookies(unlockCookieName(paste.ID)); cookie != "" {
+		if hmac.Equal([]byte(cookie), []byte(unlockToken(paste))) {
+			return nil
+		}
+	}
+
+	password := requestPassword(c)
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	if !verifyPassword(paste, password) {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Unlock checks the password submitted through the unlock form, and if it's
+// correct remembers that the browser unlocked the paste
+func (s *PasteService) Unlock(c *fiber.Ctx, paste *models.Paste) error {
+	// Only redirect back to pages of this paste, or diffs against it
+	next := c.FormValue("next")
+	if !strings.HasPrefix(next, "/p/"+paste.ID) && !(strings.HasPrefix(next, "/p/") && strings.Contains(next, "/diff/"+paste.ID)) {
+		next = "/p/" + paste.ID
+	}
+
+	if !verifyPassword(paste, c.FormValue("password")) {
+		return s.renderUnlock(c, paste.ID, next, true)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     unlockCookieName(paste.ID),
+		Value:    unlockToken(paste),
+		Path:     "/p/",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return c.Redirect(next, fiber.StatusSeeOther)
+}
+
+// RenderUnlock renders the form used to unlock a password protected paste in
+// place of the page that was requested
+func (s *PasteService) RenderUnlock(c *fiber.Ctx, id string) error {
+	// Strip any extension from the ID
+	if idx := strings.LastIndex(id, "."); idx != -1 {
+		id = id[:idx]
+	}
+
+	return s.renderUnlock(c, id, c.OriginalURL(), false)
+}
+
+func (s *PasteService) renderUnlock(c *fiber.Ctx, id, next string, invalid bool) error {
+	c.Set("Cache-Control", "private, no-store")
+	return c.Status(fiber.StatusUnauthorized).Render("unlock", fiber.Map{
+		"id":      id,
+		"next":    next,
+		"invalid": invalid,
+		"baseUrl": s.config.Server.BaseURL,
+	}, "layouts/main")
+}
+
+// requestPassword returns the paste password given with the request
+func requestPassword(c *fiber.Ctx) string {
+	if password := c.Get(PastePasswordHeader); password != "" {
+		return password
+	}
+
+	// The username is ignored so clients can use e.g. curl -u :password
+	auth := c.Get(fiber.HeaderAuthorization)
+	if encoded, ok := strings.CutPrefix(auth, "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return ""
+		}
+		_, password, _ := strings.Cut(string(decoded), ":")
+		return password
+	}
+
+	return ""
+}
+
+// verifyPassword reports whether password is the password of the paste
+func verifyPassword(paste *models.Paste, password string) bool {
+	if password == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(paste.PasswordHash), []byte(password)) == nil
+}
+
+// unlockCookieName returns the name of the cookie set when a browser unlocks
+// a paste
+func unlockCookieName(id string) string {
+	return "paste_unlock_" + id
+}
+
+// unlockToken returns the value of the unlock cookie for a paste. It's keyed
+// on the password hash, which never leaves the server, so it can't be forged
+// and stops working if the password changes.
+func unlockToken(paste *models.Paste) string {
+	mac := hmac.New(sha256.New, []byte(paste.PasswordHash))
+	mac.Write([]byte(paste.ID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
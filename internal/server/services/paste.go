@@ -8,6 +8,7 @@ import (
 	_ "image/jpeg" // Register JPEG format
 	"image/png"
 	"io"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"time"
@@ -27,20 +28,24 @@ import (
 	"gorm.io/gorm"
 )
 
+// mimeSniffLength is the number of bytes read from the start of an upload for
+// MIME type detection. It matches the default read limit of mimetype.
+const mimeSniffLength = 3072
+
 type PasteService struct {
 	db        *gorm.DB
 	logger    *zap.Logger
 	config    *config.Config
-	storage   storage.Provider
+	storage   *storage.StorageManager
 	analytics *AnalyticsService
 }
 
-func NewPasteService(db *gorm.DB, logger *zap.Logger, config *config.Config) *PasteService {
+func NewPasteService(db *gorm.DB, logger *zap.Logger, config *config.Config, storage *storage.StorageManager) *PasteService {
 	return &PasteService{
 		db:        db,
 		logger:    logger,
 		config:    config,
-		storage:   storage.NewProvider(config),
+		storage:   storage,
 		analytics: NewAnalyticsService(db, logger, config),
 	}
 }
@@ -48,9 +53,59 @@ func NewPasteService(db *gorm.DB, logger *zap.Logger, config *config.Config) *Pa
 // CreatePaste handles the creation of a new paste
 func (s *PasteService) UploadPaste(c *fiber.Ctx) error {
 	s.logger.Debug("Received upload request",
-		zap.String("content-type", c.Get("Content-Type")),
-		zap.String("body", string(c.Body())))
+		zap.String("content-type", c.Get("Content-Type")))
+
+	p, err := s.parseOptions(c)
+	if err != nil {
+		return err
+	}
+
+	var apiKey *models.APIKey
+	if key := c.Locals("apiKey"); key != nil {
+		apiKey = key.(*models.APIKey)
+	}
+
+	// Check if the user is attempting to do something they're not allowed to do
+	if p.Private && apiKey == nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Private pastes can only be created with an API key")
+	}
+
+	// Several files uploaded together become a single multi-file paste
+	if form, err := c.MultipartForm(); err == nil && len(form.File["file"]) > 1 {
+		if p.Encrypted {
+			return fiber.NewError(fiber.StatusBadRequest, "Multi-file pastes can't be encrypted")
+		}
+		paste, err := s.createBundle(form.File["file"], apiKey, p)
+		if err != nil {
+			return err
+		}
+		return s.uploadResponse(c, paste)
+	}
+
+	// Get a stream for the content. Nothing is read into memory here, the
+	// content is streamed through createPaste and into storage.
+	content, filename, size, err := s.openContent(c, p, apiKey)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
 
+	// If we found a filename and none was provided in the request, use it
+	if filename != "" && p.Filename == "" {
+		p.Filename = filename
+	}
+
+	// Create the paste
+	paste, err := s.createPaste(content, size, apiKey, p)
+	if err != nil {
+		return err
+	}
+
+	return s.uploadResponse(c, paste)
+}
+
+// parseOptions parses the paste options from the request body
+func (s *PasteService) parseOptions(c *fiber.Ctx) (*PasteOptions, error) {
 	p := new(PasteOptions)
 	contentType := c.Get("Content-Type")
 
@@ -66,30 +121,37 @@ func (s *PasteService) UploadPaste(c *fiber.Ctx) error {
 		if err := c.BodyParser(p); err != nil {
 			s.logger.Error("Failed to parse request body",
 				zap.Error(err),
-				zap.String("content-type", c.Get("Content-Type")),
-				zap.String("body", string(c.Body())))
-			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+				zap.String("content-type", c.Get("Content-Type")))
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
 		}
 	}
 
 	s.logger.Debug("Parsed paste options",
 		zap.Any("options", p))
 
-	// Get file content
-	var content []byte
+	return p, nil
+}
+
+// openContent returns a stream for the content of an upload, along with the
+// filename it was uploaded under and its size, if they are known. The size is
+// -1 otherwise. The caller must close the returned stream.
+func (s *PasteService) openContent(c *fiber.Ctx, p *PasteOptions, apiKey *models.APIKey) (io.ReadCloser, string, int64, error) {
+	var content io.ReadCloser
 	var filename string
+	size := int64(-1)
 	if file, err := c.FormFile("file"); err == nil {
-		// Read file content
-		f, err := file.Open()
-		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "Failed to open uploaded file")
+		// The multipart header already tells us the size, so reject oversized
+		// files before reading any of them
+		if err := s.validateFileSize(file.Size, apiKey); err != nil {
+			return nil, "", 0, err
 		}
-		defer f.Close()
 
-		content, err = io.ReadAll(f)
+		f, err := file.Open()
 		if err != nil {
-			return fiber.NewError(fiber.StatusInternalServerError, "Failed to read file content")
+			return nil, "", 0, fiber.NewError(fiber.StatusInternalServerError, "Failed to open uploaded file")
 		}
+		content = f
+		size = file.Size
 
 		// First check for a filename in form field
 		if formFilename := c.FormValue("filename"); formFilename != "" {
@@ -100,11 +162,13 @@ func (s *PasteService) UploadPaste(c *fiber.Ctx) error {
 			filename = "paste.txt" // Default filename
 		}
 	} else if p.URL != "" {
-		// Read content from the given URL
-		content, err = utils.GetContentFromURL(p.URL)
+		// Stream content from the given URL
+		body, length, err := utils.OpenURL(p.URL)
 		if err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, "Failed to fetch URL")
+			return nil, "", 0, fiber.NewError(fiber.StatusBadRequest, "Failed to fetch URL")
 		}
+		content = body
+		size = length
 
 		// Try to get filename from URL if not explicitly provided
 		if p.Filename == "" {
@@ -112,47 +176,36 @@ func (s *PasteService) UploadPaste(c *fiber.Ctx) error {
 		}
 	} else if p.Content != "" {
 		// Use content from the request body
-		content = []byte(p.Content)
+		content = io.NopCloser(strings.NewReader(p.Content))
+		size = int64(len(p.Content))
 	} else {
-		return fiber.NewError(fiber.StatusBadRequest, "No file provided")
+		return nil, "", 0, fiber.NewError(fiber.StatusBadRequest, "No file provided")
 	}
 
-	// Check for empty content
-	if len(content) == 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "Empty file")
-	}
-
-	// If we found a filename and none was provided in the request, use it
-	if filename != "" && p.Filename == "" {
-		p.Filename = filename
-	}
-
-	var apiKey *models.APIKey
-	if key := c.Locals("apiKey"); key != nil {
-		apiKey = key.(*models.APIKey)
-	}
-
-	// Check if the user is attempting to do something they're not allowed to do
-	if p.Private && apiKey == nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Private pastes can only be created with an API key")
-	}
-
-	// Create the paste
-	paste, err := s.createPaste(bytes.NewReader(content), apiKey, int64(len(content)), p)
-	if err != nil {
-		return err
-	}
+	return content, filename, size, nil
+}
 
+// uploadResponse responds to a successful upload, either by redirecting
+// browsers to the new paste or by returning its details as JSON
+func (s *PasteService) uploadResponse(c *fiber.Ctx, paste *models.Paste) error {
 	baseURL := s.config.Server.BaseURL
+	urlSuffix := paste.ID
+	if paste.Extension != "" {
+		urlSuffix = urlSuffix + "." + paste.Extension
+	}
 	response := &PasteResponse{
 		ID:        paste.ID,
 		Filename:  paste.Filename,
-		URL:       fmt.Sprintf("%s/p/%s.%s", baseURL, paste.ID, paste.Extension),
-		DeleteURL: fmt.Sprintf("%s/p/%s.%s/%s", baseURL, paste.ID, paste.Extension, paste.DeleteKey),
+		URL:       fmt.Sprintf("%s/p/%s", baseURL, urlSuffix),
+		DeleteURL: fmt.Sprintf("%s/p/%s/%s", baseURL, urlSuffix, paste.DeleteKey),
 		Private:   paste.Private,
 		MimeType:  paste.MimeType,
 		Size:      paste.Size,
 		ExpiresAt: paste.ExpiresAt,
+		Revision:  paste.Revision,
+		MaxViews:  paste.MaxViews,
+		Encrypted: paste.Encrypted,
+		Files:     NewPasteFileResponses(paste, baseURL),
 	}
 
 	// If this is a browser form submission, redirect to the paste view
@@ -181,7 +234,11 @@ func (s *PasteService) GetPaste(id string) (*models.Paste, error) {
 	}
 
 	var paste models.Paste
-	err := s.db.Where("id = ? AND (expires_at IS NULL OR expires_at > ?)", id, time.Now()).First(&paste).Error
+	err := s.db.Preload("Files", orderFilesByPosition).
+		Preload("Revisions", orderRevisionsByNumber).
+		Where("id = ? AND (expires_at IS NULL OR expires_at > ?)", id, time.Now()).
+		Where("max_views IS NULL OR views < max_views").
+		First(&paste).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, fiber.NewError(fiber.StatusNotFound, "Paste not found or expired")
@@ -193,29 +250,40 @@ func (s *PasteService) GetPaste(id string) (*models.Paste, error) {
 
 // GetPasteImage returns an image of the paste suitable for Open Graph
 func (s *PasteService) GetPasteImage(c *fiber.Ctx, paste *models.Paste) error {
+	// Previews would reveal the content without using up a view
+	if paste.HasViewLimit() {
+		return fiber.NewError(fiber.StatusNotFound, "Previews aren't available for pastes with a view limit")
+	}
+	if paste.Encrypted {
+		return fiber.NewError(fiber.StatusNotFound, "Previews aren't available for encrypted pastes")
+	}
+
+	// Bundles are previewed using their first file
+	file := paste.PrimaryFile()
+
 	// Get the content
-	content, err := s.storage.Get(paste.StoragePath)
+	content, err := s.getContent(paste, file.StoragePath)
 	if err != nil {
 		s.logger.Error("Failed to get paste content for image generation",
 			zap.Error(err),
 			zap.String("id", paste.ID),
-			zap.String("storage_path", paste.StoragePath))
+			zap.String("storage_path", file.StoragePath))
 		return err
 	}
 
 	var imageBytes []byte
 
 	// Handle different content types
-	if s.isTextContent(paste.MimeType) {
+	if s.isTextContent(file.MimeType) {
 		// For text content, generate a code preview image
-		imageBytes, err = GenerateCodeImage(string(content), paste.Filename)
+		imageBytes, err = GenerateCodeImage(string(content), file.Filename)
 		if err != nil {
 			s.logger.Error("Failed to generate code image",
 				zap.Error(err),
 				zap.String("id", paste.ID))
 			return err
 		}
-	} else if s.isImageContent(paste.MimeType) {
+	} else if s.isImageContent(file.MimeType) {
 		// For images, use the image directly but resize if needed
 		img, _, err := image.Decode(bytes.NewReader(content))
 		if err != nil {
@@ -245,7 +313,7 @@ func (s *PasteService) GetPasteImage(c *fiber.Ctx, paste *models.Paste) error {
 		imageBytes = buf.Bytes()
 	} else {
 		// For binary content, generate a placeholder image
-		img, err := GenerateBinaryPreviewImage(paste.Filename, paste.MimeType)
+		img, err := GenerateBinaryPreviewImage(file.Filename, file.MimeType)
 		if err != nil {
 			s.logger.Error("Failed to generate binary preview image",
 				zap.Error(err),
@@ -264,31 +332,32 @@ func (s *PasteService) GetPasteImage(c *fiber.Ctx, paste *models.Paste) error {
 		imageBytes = buf.Bytes()
 	}
 
-	c.Set("Cache-Control", "max-age=31536000, immutable")
+	setContentCacheHeaders(c, paste)
 	c.Set("Content-Type", "image/png")
 	return c.Send(imageBytes)
 }
 
 // RenderPaste renders the paste view for text content
 func (s *PasteService) RenderPaste(c *fiber.Ctx, paste *models.Paste) error {
-	content, err := s.storage.Get(paste.StoragePath)
+	// Encrypted pastes can only be decrypted by the browser
+	if paste.Encrypted {
+		return s.RenderEncrypted(c, paste)
+	}
+
+	var content []byte
+	var files []fiber.Map
+	var err error
+	if paste.IsBundle() {
+		files, err = s.renderBundleFiles(paste)
+	} else {
+		content, err = s.getContent(paste, paste.StoragePath)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Check for deletion URL cookie
-	var deletionUrl string
-	if cookie := c.Cookies("deletion_url"); cookie != "" {
-		// Clear the cookie before reading it to ensure one-time use
-		c.Cookie(&fiber.Cookie{
-			Name:     "deletion_url",
-			Value:    "",
-			Path:     "/",
-			Expires:  time.Now().Add(-24 * time.Hour),
-			HTTPOnly: true,
-		})
-		deletionUrl = cookie
-	}
+	deletionUrl := takeDeletionURL(c)
 
 	// Set cache headers
 	if deletionUrl != "" {
@@ -299,14 +368,13 @@ func (s *PasteService) RenderPaste(c *fiber.Ctx, paste *models.Paste) error {
 		c.Set("CDN-Cache-Control", "no-store")
 		c.Set("Cloudflare-CDN-Cache-Control", "no-store")
 	} else {
-		// If no deletion URL, content is immutable and can be cached
-		c.Set("Cache-Control", "public, max-age=31536000, immutable")
-		c.Set("ETag", paste.ID)
+		// If no deletion URL, the content can be cached
+		setContentCacheHeaders(c, paste)
 	}
 
 	var renderedContent string
 
-	if s.isTextContent(paste.MimeType) {
+	if !paste.IsBundle() && s.isTextContent(paste.MimeType) {
 		// Handle text content with syntax highlighting
 		renderedContent, err = s.renderHighlightedText(string(content), paste.Extension, paste.MimeType)
 		if err != nil {
@@ -332,6 +400,12 @@ func (s *PasteService) RenderPaste(c *fiber.Ctx, paste *models.Paste) error {
 		"rawContent":  string(content),
 		"baseUrl":     s.config.Server.BaseURL,
 		"deletionUrl": deletionUrl,
+		"isBundle":    paste.IsBundle(),
+		"files":       files,
+		"path":        revisionPath(c, paste),
+		"revision":    paste.Revision,
+		"revisions":   revisionList(paste),
+		"diffPath":    previousDiffPath(paste),
 		"metadata": fiber.Map{
 			"size":      formatSize(paste.Size),
 			"mimeType":  paste.MimeType,
@@ -341,6 +415,37 @@ func (s *PasteService) RenderPaste(c *fiber.Ctx, paste *models.Paste) error {
 	}, "layouts/main")
 }
 
+// renderBundleFiles renders each file of a bundle for the paste view
+func (s *PasteService) renderBundleFiles(paste *models.Paste) ([]fiber.Map, error) {
+	files := make([]fiber.Map, 0, len(paste.Files))
+	for _, file := range paste.Files {
+		content, err := s.getContent(paste, file.StoragePath)
+		if err != nil {
+			return nil, err
+		}
+
+		var renderedContent string
+		if s.isTextContent(file.MimeType) {
+			renderedContent, err = s.renderHighlightedText(string(content), file.Extension, file.MimeType)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		files = append(files, fiber.Map{
+			"filename": file.Filename,
+			"language": s.getLanguageName(file.Extension, file.MimeType),
+			"content":  renderedContent,
+			"isText":   s.isTextContent(file.MimeType),
+			"isImage":  s.isImageContent(file.MimeType),
+			"url":      PasteFileURL(s.config.Server.BaseURL, paste.ID, file.Filename),
+			"size":     formatSize(file.Size),
+			"mimeType": file.MimeType,
+		})
+	}
+	return files, nil
+}
+
 // Helper function to get language name
 func (s *PasteService) getLanguageName(extension, mimeType string) string {
 	var lexer chroma.Lexer
@@ -358,21 +463,7 @@ func (s *PasteService) getLanguageName(extension, mimeType string) string {
 
 // Helper function to render highlighted text
 func (s *PasteService) renderHighlightedText(content, extension, mimeType string) (string, error) {
-	// Determine lexer based on extension or content
-	var lexer chroma.Lexer
-	if extension != "" {
-		lexer = lexers.Get(extension)
-	}
-	if lexer == nil {
-		lexer = lexers.Get(mimeType)
-	}
-	if lexer == nil {
-		lexer = lexers.Analyse(content)
-	}
-	if lexer == nil {
-		lexer = lexers.Fallback
-	}
-	lexer = chroma.Coalesce(lexer)
+	lexer := selectLexer(content, extension, mimeType)
 
 	// Create formatter
 	formatter := html.New(
@@ -391,30 +482,159 @@ func (s *PasteService) renderHighlightedText(content, extension, mimeType string
 		return "", err
 	}
 
+	if err := formatter.Format(&codeBuffer, highlightStyle(), iterator); err != nil {
+		return "", err
+	}
+
+	return codeBuffer.String(), nil
+}
+
+// selectLexer picks a lexer based on the extension, falling back to the MIME
+// type and then the content itself
+func selectLexer(content, extension, mimeType string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if extension != "" {
+		lexer = lexers.Get(extension)
+	}
+	if lexer == nil {
+		lexer = lexers.Get(mimeType)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(content)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// highlightStyle returns the style used for syntax highlighting
+func highlightStyle() *chroma.Style {
 	// Use GitHub Dark style
 	style := styles.Get("github-dark")
 	if style == nil {
 		style = styles.Fallback
 	}
-
-	if err := formatter.Format(&codeBuffer, style, iterator); err != nil {
-		return "", err
-	}
-
-	return codeBuffer.String(), nil
+	return style
 }
 
 // RenderPasteRaw serves the raw content with proper content type
 func (s *PasteService) RenderPasteRaw(c *fiber.Ctx, paste *models.Paste) error {
-	content, err := s.storage.Get(paste.StoragePath)
+	// Bundles serve their first file, the others have their own URLs
+	file := paste.PrimaryFile()
+	c.Set("Content-Type", file.MimeType)
+	setContentCacheHeaders(c, paste)
+	return s.sendContent(c, paste, file, "")
+}
+
+// sendContent serves the stored content of a file, answering conditional and
+// range requests. Content compressed at rest is sent as is to clients that
+// accept it, instead of being decompressed on every request.
+func (s *PasteService) sendContent(c *fiber.Ctx, paste *models.Paste, file models.PasteFile, disposition string) error {
+	if redirected, err := s.redirectToStore(c, paste, file.StoragePath, c.GetRespHeader(fiber.HeaderContentType), disposition); redirected || err != nil {
+		return err
+	}
+
+	store, err := s.storeFor(paste.StorageName)
+	if err != nil {
+		return err
+	}
+
+	// Content that's burned after being viewed is only ever sent whole, a
+	// partial or empty response would still use up a view
+	if !paste.HasViewLimit() {
+		etag := contentETag(paste, file)
+		modified := contentModified(paste)
+		c.Set(fiber.HeaderETag, etag)
+		c.Set(fiber.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+		c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+		if notModified(c, modified, etag, compressedETag(etag)) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		if offset, length, ok, err := requestedRange(c, file.Size, modified, etag); ok || err != nil {
+			if err != nil {
+				c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", file.Size))
+				return err
+			}
+
+			content, err := store.OpenRange(file.StoragePath, offset, length)
+			if err != nil {
+				return err
+			}
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, file.Size))
+			setContentDigest(c, file.SHA256)
+			c.Status(fiber.StatusPartialContent)
+			return c.SendStream(content, int(length))
+		}
+	}
+
+	compressed, ok, err := store.OpenCompressed(file.StoragePath)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.Vary(fiber.HeaderAcceptEncoding)
+
+		// Clients that don't send Accept-Encoding at all, like curl, get the
+		// content decompressed
+		if c.Get(fiber.HeaderAcceptEncoding) != "" && c.AcceptsEncodings(storage.CompressedEncoding) != "" {
+			c.Set(fiber.HeaderContentEncoding, storage.CompressedEncoding)
+			if etag := c.GetRespHeader(fiber.HeaderETag); etag != "" {
+				c.Set(fiber.HeaderETag, compressedETag(etag))
+			}
+			return c.SendStream(compressed)
+		}
+		compressed.Close()
+	}
+
+	content, err := store.Open(file.StoragePath)
 	if err != nil {
 		return err
 	}
-	c.Set("Content-Type", paste.MimeType)
-	// Add permanent cache headers since content is immutable
-	c.Set("Cache-Control", "public, max-age=31536000, immutable")
-	c.Set("ETag", paste.ID)
-	return c.Send(content)
+	setContentDigest(c, file.SHA256)
+	return c.SendStream(content)
+}
+
+// redirectToStore redirects the client to a presigned URL for content whose
+// storage supports it, so the content doesn't pass through the server. It
+// reports whether it redirected; otherwise the content must be served as
+// usual.
+func (s *PasteService) redirectToStore(c *fiber.Ctx, paste *models.Paste, path, contentType, disposition string) (bool, error) {
+	// The content of a paste with a view limit may be burned before the
+	// client gets to follow the redirect
+	if paste.HasViewLimit() {
+		return false, nil
+	}
+
+	store, err := s.storeFor(paste.StorageName)
+	if err != nil {
+		return false, err
+	}
+
+	url, err := store.Presign(path, contentType, disposition)
+	if err != nil {
+		// Serving the content ourselves still works
+		s.logger.Warn("failed to presign content URL",
+			zap.String("id", paste.ID),
+			zap.String("storage", paste.StorageName),
+			zap.Error(err))
+		return false, nil
+	}
+	if url == "" {
+		return false, nil
+	}
+
+	// The URL expires, so the redirect must not outlive it in a cache
+	c.Response().Header.Del(fiber.HeaderETag)
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return true, c.Redirect(url, fiber.StatusFound)
+}
+
+// GetRawContent returns the content served by RenderPasteRaw
+func (s *PasteService) GetRawContent(paste *models.Paste) ([]byte, error) {
+	return s.getContent(paste, paste.PrimaryFile().StoragePath)
 }
 
 // RenderPasteJSON serves the paste as JSON. If the paste is text, the content will be included
@@ -426,15 +646,28 @@ func (s *PasteService) RenderPasteJSON(c *fiber.Ctx, paste *models.Paste) error
 		MimeType string `json:"mimeType"`
 		URL      string `json:"url"`
 		Content  string `json:"content"`
+		Revision int    `json:"revision"`
+		SHA256   string `json:"sha256,omitempty"`
+
+		Encrypted bool                `json:"encrypted,omitempty"`
+		Files     []PasteFileResponse `json:"files,omitempty"`
 	}{
 		ID:       paste.ID,
+		Revision: paste.Revision,
+		SHA256:   paste.SHA256,
 		Filename: paste.Filename,
 		MimeType: paste.MimeType,
 		URL:      fmt.Sprintf("%s/p/%s.%s", s.config.Server.BaseURL, paste.ID, paste.Extension),
+		Files:    NewPasteFileResponses(paste, s.config.Server.BaseURL),
+
+		Encrypted: paste.Encrypted,
 	}
 
-	if s.isTextContent(paste.MimeType) {
-		content, err := s.storage.Get(paste.StoragePath)
+	// For bundles the content is that of the first file. The envelope of an
+	// encrypted paste is only available from the raw URL.
+	file := paste.PrimaryFile()
+	if s.isTextContent(file.MimeType) && !paste.Encrypted {
+		content, err := s.getContent(paste, file.StoragePath)
 		if err != nil {
 			return err
 		}
@@ -446,17 +679,16 @@ func (s *PasteService) RenderPasteJSON(c *fiber.Ctx, paste *models.Paste) error
 
 // RenderDownload serves the content as a downloadable file
 func (s *PasteService) RenderDownload(c *fiber.Ctx, paste *models.Paste) error {
-	content, err := s.storage.Get(paste.StoragePath)
-	if err != nil {
-		return err
+	// Bundles are downloaded as a zip of all their files
+	if paste.IsBundle() {
+		return s.renderBundleDownload(c, paste)
 	}
 
+	disposition := fmt.Sprintf(`attachment; filename="%s"`, paste.Filename)
 	c.Set("Content-Type", "application/octet-stream")
-	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, paste.Filename))
-	// Add permanent cache headers since content is immutable
-	c.Set("Cache-Control", "public, max-age=31536000, immutable")
-	c.Set("ETag", paste.ID)
-	return c.Send(content)
+	c.Set("Content-Disposition", disposition)
+	setContentCacheHeaders(c, paste)
+	return s.sendContent(c, paste, paste.PrimaryFile(), disposition)
 }
 
 // DeleteWithKey deletes a paste using its deletion key
@@ -531,7 +763,7 @@ func (s *PasteService) Delete(c *fiber.Ctx, id string) error {
 		return err
 	}
 
-	if err := s.storage.Delete(paste.StoragePath); err != nil {
+	if err := s.deleteContent(s.db, paste); err != nil {
 		s.logger.Error("failed to delete paste content", zap.Error(err))
 	}
 
@@ -555,7 +787,7 @@ func (s *PasteService) ListPastes(c *fiber.Ctx) error {
 		return err
 	}
 
-	if err := query.Offset(offset).Limit(limit).Find(&pastes).Error; err != nil {
+	if err := query.Preload("Files", orderFilesByPosition).Offset(offset).Limit(limit).Find(&pastes).Error; err != nil {
 		return err
 	}
 
@@ -608,18 +840,18 @@ func (s *PasteService) CleanupExpired() (int64, error) {
 	// Use a transaction to ensure consistency
 	err := s.db.Transaction(func(tx *gorm.DB) error {
 		var pastes []models.Paste
-		if err := tx.Where("expires_at < ? AND expires_at IS NOT NULL", time.Now()).Find(&pastes).Error; err != nil {
+		// Pastes that used up their views are normally burned straight away,
+		// this only catches those that couldn't be
+		if err := tx.Preload("Files").Preload("Revisions").
+			Where("expires_at < ? AND expires_at IS NOT NULL", time.Now()).
+			Or("max_views IS NOT NULL AND views >= max_views").
+			Find(&pastes).Error; err != nil {
 			return err
 		}
 
 		for _, paste := range pastes {
 			// Delete storage content first
-			if err := s.storage.Delete(paste.StoragePath); err != nil {
-				s.logger.Error("failed to delete paste content",
-					zap.String("id", paste.ID),
-					zap.String("path", paste.StoragePath),
-					zap.Error(err),
-				)
+			if err := s.deleteContent(tx, &paste); err != nil {
 				// Skip this paste if we can't delete the storage
 				continue
 			}
@@ -630,13 +862,19 @@ func (s *PasteService) CleanupExpired() (int64, error) {
 					zap.String("id", paste.ID),
 					zap.Error(err),
 				)
-				// Try to recover the storage file since we couldn't delete the record
-				if _, err := s.storage.Put(paste.StoragePath, bytes.NewReader([]byte{})); err != nil {
-					s.logger.Error("failed to recover storage after failed deletion",
-						zap.String("id", paste.ID),
-						zap.String("path", paste.StoragePath),
-						zap.Error(err),
-					)
+				// Try to recover the storage files since we couldn't delete the record
+				store, err := s.storeFor(paste.StorageName)
+				if err != nil {
+					continue
+				}
+				for _, path := range paste.StoragePaths() {
+					if _, err := store.Put(path, bytes.NewReader([]byte{})); err != nil {
+						s.logger.Error("failed to recover storage after failed deletion",
+							zap.String("id", paste.ID),
+							zap.String("path", path),
+							zap.Error(err),
+						)
+					}
 				}
 				continue
 			}
@@ -656,6 +894,83 @@ func (s *PasteService) CleanupExpired() (int64, error) {
 
 // Helper functions
 
+// orderFilesByPosition is used when preloading bundle files so they keep the
+// order they were uploaded in
+func orderFilesByPosition(db *gorm.DB) *gorm.DB {
+	return db.Order("position ASC")
+}
+
+// orderRevisionsByNumber is used when preloading prior revisions so they're
+// listed oldest first
+func orderRevisionsByNumber(db *gorm.DB) *gorm.DB {
+	return db.Order("number ASC")
+}
+
+// storeFor returns the storage with the given name. Pastes are read from the
+// storage they were created in, so several can be in use at once and the
+// default can change without old pastes becoming unreadable.
+func (s *PasteService) storeFor(name string) (storage.Provider, error) {
+	if name == "" {
+		return s.defaultStore()
+	}
+
+	store, err := s.storage.Provider(name)
+	if err != nil {
+		s.logger.Error("storage of paste isn't configured",
+			zap.String("storage", name),
+			zap.Error(err),
+		)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Storage not available")
+	}
+	return store, nil
+}
+
+// backendFor returns the storage with the given name without its cache and
+// replica, for checking what's really stored in it
+func (s *PasteService) backendFor(name string) (storage.Provider, error) {
+	store, err := s.storage.BackendProvider(name)
+	if err != nil {
+		s.logger.Error("storage isn't configured",
+			zap.String("storage", name),
+			zap.Error(err),
+		)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Storage not available")
+	}
+	return store, nil
+}
+
+// defaultStore returns the storage new content is put in
+func (s *PasteService) defaultStore() (storage.Provider, error) {
+	store, _, err := s.storage.DefaultProvider()
+	if err != nil {
+		s.logger.Error("no default storage configured", zap.Error(err))
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Storage not available")
+	}
+	return store, nil
+}
+
+// getContent reads content of a paste from its storage
+func (s *PasteService) getContent(paste *models.Paste, path string) ([]byte, error) {
+	store, err := s.storeFor(paste.StorageName)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(path)
+}
+
+// deleteContent releases all stored content of a paste. Content shared with
+// other pastes is kept until the last of them is deleted.
+func (s *PasteService) deleteContent(db *gorm.DB, paste *models.Paste) error {
+	if err := s.releaseContent(db, paste.StorageName, paste.StoragePaths()...); err != nil {
+		s.logger.Error("failed to delete paste content",
+			zap.String("id", paste.ID),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
 // validateFileSize checks if the file size is within the allowed limits
 func (s *PasteService) validateFileSize(size int64, apiKey *models.APIKey) error {
 	// First check against absolute maximum size for security
@@ -677,91 +992,83 @@ func (s *PasteService) validateFileSize(size int64, apiKey *models.APIKey) error
 	return nil
 }
 
-func (s *PasteService) createPaste(content io.Reader, apiKey *models.APIKey, size int64, opts *PasteOptions) (*models.Paste, error) {
-	// Read content for MIME type detection
-	contentBytes, err := io.ReadAll(content)
+// maxFileSize returns the largest upload allowed for the given API key (or
+// anonymous uploads when apiKey is nil)
+func (s *PasteService) maxFileSize(apiKey *models.APIKey) int64 {
+	limit := int64(s.config.Server.DefaultUploadSize)
+	if apiKey != nil {
+		limit = int64(s.config.Server.APIUploadSize)
+	}
+	if maxSize := int64(s.config.Server.MaxUploadSize); maxSize < limit {
+		limit = maxSize
+	}
+	return limit
+}
+
+func (s *PasteService) createPaste(content io.Reader, size int64, apiKey *models.APIKey, opts *PasteOptions) (*models.Paste, error) {
+	contentType, extension, content, err := s.detectContent(content, apiKey, opts)
 	if err != nil {
-		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to read content")
+		return nil, err
 	}
 
-	// Check file size against limit either globally or per API key
-	if err := s.validateFileSize(size, apiKey); err != nil {
+	// Choose the storage before anything is stored. Content whose size isn't
+	// known up front doesn't match routes with size conditions.
+	store, route, err := s.chooseStorage(storageRequest{
+		Size:     size,
+		MimeType: contentType,
+		APIKey:   apiKey,
+		Private:  opts.Private,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkCapacity(store, apiKey); err != nil {
+		return nil, err
+	}
+	limit, remaining, err := s.uploadLimit(apiKey, size)
+	if err != nil {
 		return nil, err
 	}
 
-	// Detect MIME type if not provided
-	mime := mimetype.Detect(contentBytes)
-	contentType := mime.String()
+	maxViews, err := viewLimit(opts)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check if the file has a markdown extension
-	if opts.Extension != "" && (opts.Extension == "md" || opts.Extension == "markdown") {
-		contentType = "text/markdown"
-	} else if opts.Filename != "" {
-		ext := strings.ToLower(filepath.Ext(opts.Filename))
-		if ext == ".md" || ext == ".markdown" {
-			contentType = "text/markdown"
-		}
+	password, err := passwordHash(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create paste record
 	paste := &models.Paste{
-		Filename:  opts.Filename,
-		MimeType:  contentType,
-		Size:      size,
-		Extension: opts.Extension,
-		Private:   opts.Private,
-	}
-
-	// Set extension in order of precedence
-	if paste.Extension == "" {
-		if paste.Filename != "" {
-			parts := strings.Split(paste.Filename, ".")
-			if len(parts) > 1 {
-				paste.Extension = parts[len(parts)-1]
-			}
-		}
-
-		if paste.Extension == "" {
-			mime := mimetype.Detect(contentBytes)
-			paste.Extension = strings.TrimPrefix(mime.Extension(), ".")
-
-			if paste.Extension == "" && strings.HasPrefix(contentType, "text/") {
-				paste.Extension = "txt"
-			}
-		}
+		Filename:     opts.Filename,
+		MimeType:     contentType,
+		Extension:    extension,
+		Private:      opts.Private,
+		Encrypted:    opts.Encrypted,
+		PasswordHash: password,
+		MaxViews:     maxViews,
+		StorageName:  store.Name,
+		StorageType:  store.Type,
+		StorageRoute: route,
 	}
 
-	// Calculate expiry time if provided
-	expiry, err := s.calculateExpiry(ExpiryOptions{
-		Size:      int64(len(contentBytes)),
-		HasAPIKey: apiKey != nil,
-		ExpiresIn: opts.ExpiresIn,
-		ExpiresAt: opts.ExpiresAt,
-	})
-	if err != nil {
-		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
-	}
-	paste.ExpiresAt = expiry
-
 	// Set API key if provided
 	if apiKey != nil {
 		paste.APIKey = apiKey.Key
 	}
 
+	// Enforce the size limit and quota while the content is being stored
+	body := &sizeLimitedReader{
+		r:     content,
+		limit: limit,
+	}
+
 	// Use a transaction for the entire creation process
-	var storagePath string
 	err = s.db.Transaction(func(tx *gorm.DB) error {
-		// Set the default storage configuration
-		for _, storage := range s.config.Storage {
-			if storage.IsDefault {
-				paste.StorageName = storage.Name
-				paste.StorageType = storage.Type
-				break
-			}
-		}
-
-		if paste.StorageName == "" {
-			return fiber.NewError(fiber.StatusInternalServerError, "No default storage configuration found")
+		if err := s.lockQuota(tx, apiKey); err != nil {
+			return err
 		}
 
 		// Create the initial database record
@@ -776,20 +1083,44 @@ func (s *PasteService) createPaste(content io.Reader, apiKey *models.APIKey, siz
 		}
 
 		// Store the content and get the storage path
-		var err error
-		storagePath, err = s.storage.Put(filename, bytes.NewReader(contentBytes))
+		storagePath, hash, isNew, err := s.putContent(tx, paste.StorageName, filename, body, paste.MimeType)
 		if err != nil {
+			if body.Exceeded() {
+				return s.sizeError(body.n, remaining, apiKey)
+			}
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to store content")
 		}
 
-		// Update the paste with the storage path
+		// The size is only known once the content has been fully streamed
 		paste.StoragePath = storagePath
+		paste.Size = body.n
+		paste.SHA256 = hash
+
+		// Calculate expiry time now that we know the size
+		expiry, err := s.calculateExpiry(ExpiryOptions{
+			Size:      paste.Size,
+			HasAPIKey: apiKey != nil,
+			ExpiresIn: opts.ExpiresIn,
+			ExpiresAt: opts.ExpiresAt,
+		})
+		if err != nil {
+			s.discardContent(paste.StorageName, storagePath, isNew)
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		paste.ExpiresAt = expiry
+
+		// Update the paste with the storage path
 		if err := tx.Save(paste).Error; err != nil {
 			// Try to cleanup the stored content since we couldn't update the record
-			_ = s.storage.Delete(storagePath)
+			s.discardContent(paste.StorageName, storagePath, isNew)
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update paste")
 		}
 
+		if err := s.checkQuota(tx, apiKey); err != nil {
+			s.discardContent(paste.StorageName, storagePath, isNew)
+			return err
+		}
+
 		return nil
 	})
 
@@ -800,6 +1131,88 @@ func (s *PasteService) createPaste(content io.Reader, apiKey *models.APIKey, siz
 	return paste, nil
 }
 
+// detectContent returns the content type and extension of uploaded content,
+// along with a reader for the content. Encrypted content is opaque to us, so
+// instead of being sniffed it's checked to be a valid envelope, and it's never
+// given a filename or extension that might reveal what it contains.
+func (s *PasteService) detectContent(content io.Reader, apiKey *models.APIKey, opts *PasteOptions) (string, string, io.Reader, error) {
+	if opts.Encrypted {
+		envelope, err := readEnvelope(content, s.maxFileSize(apiKey))
+		if err != nil {
+			return "", "", nil, err
+		}
+		opts.Filename = ""
+		return EncryptedMimeType, "", bytes.NewReader(envelope), nil
+	}
+
+	// Read just enough of the content for MIME type detection. The rest is
+	// streamed into storage without being buffered.
+	mime, content, err := sniffContent(content)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	contentType := detectContentType(mime, opts.Filename, opts.Extension)
+	return contentType, detectExtension(mime, contentType, opts.Filename, opts.Extension), content, nil
+}
+
+// sniffContent reads the start of content for MIME type detection, and returns
+// a reader that yields the full content, including the sniffed bytes
+func sniffContent(content io.Reader) (*mimetype.MIME, io.Reader, error) {
+	head := make([]byte, mimeSniffLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to read content")
+	}
+	head = head[:n]
+
+	// Check for empty content
+	if len(head) == 0 {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Empty file")
+	}
+
+	return mimetype.Detect(head), io.MultiReader(bytes.NewReader(head), content), nil
+}
+
+// detectContentType returns the content type for sniffed content, taking
+// markdown file extensions into account since they can't be detected
+func detectContentType(mime *mimetype.MIME, filename, extension string) string {
+	if extension == "md" || extension == "markdown" {
+		return "text/markdown"
+	}
+
+	if filename != "" {
+		ext := strings.ToLower(filepath.Ext(filename))
+		if ext == ".md" || ext == ".markdown" {
+			return "text/markdown"
+		}
+	}
+
+	return mime.String()
+}
+
+// detectExtension returns the file extension for content, in order of
+// precedence: the requested extension, the filename's extension, and finally
+// the extension for the detected MIME type
+func detectExtension(mime *mimetype.MIME, contentType, filename, extension string) string {
+	if extension != "" {
+		return extension
+	}
+
+	if filename != "" {
+		parts := strings.Split(filename, ".")
+		if len(parts) > 1 {
+			return parts[len(parts)-1]
+		}
+	}
+
+	extension = strings.TrimPrefix(mime.Extension(), ".")
+	if extension == "" && strings.HasPrefix(contentType, "text/") {
+		extension = "txt"
+	}
+	return extension
+}
+
 func (s *PasteService) isTextContent(mimeType string) bool {
 	switch {
 	case strings.HasPrefix(mimeType, "text/"):
@@ -823,6 +1236,28 @@ func (s *PasteService) isImageContent(mimeType string) bool {
 	return strings.HasPrefix(mimeType, "image/")
 }
 
+// sizeLimitedReader counts the bytes read through it and fails the read once
+// more than limit bytes have gone by
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.Exceeded() {
+		return n, fmt.Errorf("content exceeds limit of %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// Exceeded reports whether more than limit bytes have been read
+func (l *sizeLimitedReader) Exceeded() bool {
+	return l.n > l.limit
+}
+
 func formatExpiryTime(t *time.Time) string {
 	if t == nil {
 		return "Never"
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/database"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// keyUsage returns the bytes of pastes an API key keeps stored, counting the
+// prior revisions of its pastes. Content shared with other pastes counts in
+// full, each key pays for what it uploaded.
+func keyUsage(db *gorm.DB, key string) (int64, error) {
+	var pastes, revisions int64
+	if err := db.Model(&models.Paste{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("api_key = ?", key).
+		Row().Scan(&pastes); err != nil {
+		return 0, err
+	}
+	if err := db.Model(&models.PasteRevision{}).
+		Select("COALESCE(SUM(paste_revisions.size), 0)").
+		Joins("JOIN pastes ON pastes.id = paste_revisions.paste_id").
+		Where("pastes.api_key = ? AND pastes.deleted_at IS NULL", key).
+		Row().Scan(&revisions); err != nil {
+		return 0, err
+	}
+	return pastes + revisions, nil
+}
+
+// storageUsage returns the bytes used and the capacity of a storage. Storages
+// with a configured capacity are measured by the content stored in them, and
+// others by the filesystem they're on where it's known. The capacity is zero
+// when it isn't known.
+func storageUsage(db *gorm.DB, manager *storage.StorageManager, storageCfg config.StorageConfig) (int64, int64, error) {
+	if storageCfg.Capacity > 0 {
+		var used int64
+		if err := db.Model(&models.Blob{}).
+			Select("COALESCE(SUM(CASE WHEN stored_size > 0 THEN stored_size ELSE size END), 0)").
+			Where("storage_name = ?", storageCfg.Name).
+			Row().Scan(&used); err != nil {
+			return 0, 0, err
+		}
+		return used, storageCfg.Capacity, nil
+	}
+	return manager.DiskUsage(storageCfg.Name)
+}
+
+// storageQuota returns the bytes of pastes an API key can keep stored, or
+// zero if there's no limit
+func (s *PasteService) storageQuota(apiKey *models.APIKey) int64 {
+	if apiKey == nil {
+		return 0
+	}
+	if apiKey.StorageQuota != 0 {
+		return max(apiKey.StorageQuota, 0)
+	}
+	return s.config.Server.Quota.PerKey
+}
+
+// remainingQuota returns how many more bytes an API key can store, or -1 if
+// there's no limit
+func (s *PasteService) remainingQuota(apiKey *models.APIKey) (int64, error) {
+	quota := s.storageQuota(apiKey)
+	if quota <= 0 {
+		return -1, nil
+	}
+	used, err := keyUsage(s.db, apiKey.Key)
+	if err != nil {
+		s.logger.Error("failed to get storage used by API key", zap.Error(err))
+		return 0, fiber.NewError(fiber.StatusInternalServerError, "Failed to check storage quota")
+	}
+	return max(quota-used, 0), nil
+}
+
+// quotaError is returned for uploads that don't fit in an API key's quota
+func (s *PasteService) quotaError(apiKey *models.APIKey) error {
+	return fiber.NewError(fiber.StatusInsufficientStorage,
+		fmt.Sprintf("Upload exceeds the storage quota of %d bytes for this API key", s.storageQuota(apiKey)))
+}
+
+// uploadLimit returns the most an upload can add, which is the smaller of the
+// size limit and what's left of the API key's quota, along with what's left
+// of the quota (-1 if there's no limit). Uploads known to be too big for the
+// quota are rejected right away.
+func (s *PasteService) uploadLimit(apiKey *models.APIKey, size int64) (int64, int64, error) {
+	limit := s.maxFileSize(apiKey)
+	remaining, err := s.remainingQuota(apiKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	if remaining >= 0 {
+		if size > remaining {
+			return 0, 0, s.quotaError(apiKey)
+		}
+		limit = min(limit, remaining)
+	}
+	return limit, remaining, nil
+}
+
+// lockQuota locks the row of an API key with a quota for the rest of the
+// transaction, so its uploads are committed one at a time and checkQuota sees
+// everything committed before. It must be the first statement of the
+// transaction. SQLite has no row locks, but only runs one writing transaction
+// at a time, so nothing needs locking there.
+func (s *PasteService) lockQuota(tx *gorm.DB, apiKey *models.APIKey) error {
+	if s.storageQuota(apiKey) <= 0 || database.DialectOf(tx) == database.SQLite {
+		return nil
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("api_keys.key = ?", apiKey.Key).
+		First(&models.APIKey{}).Error; err != nil {
+		s.logger.Error("failed to lock API key", zap.Error(err))
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check storage quota")
+	}
+	return nil
+}
+
+// checkQuota checks, before a transaction locked with lockQuota is committed,
+// that the API key is still within its quota once the transaction's uploads
+// are counted. uploadLimit is checked before the content is stored, so
+// concurrent uploads can each pass it, but only those fitting together in
+// the quota are committed.
+func (s *PasteService) checkQuota(tx *gorm.DB, apiKey *models.APIKey) error {
+	quota := s.storageQuota(apiKey)
+	if quota <= 0 {
+		return nil
+	}
+	used, err := keyUsage(tx, apiKey.Key)
+	if err != nil {
+		s.logger.Error("failed to get storage used by API key", zap.Error(err))
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check storage quota")
+	}
+	if used > quota {
+		return s.quotaError(apiKey)
+	}
+	return nil
+}
+
+// sizeError returns the error for content that went past its upload limit
+func (s *PasteService) sizeError(n, remaining int64, apiKey *models.APIKey) error {
+	if remaining >= 0 && n > remaining {
+		return s.quotaError(apiKey)
+	}
+	return s.validateFileSize(n, apiKey)
+}
+
+// checkCapacity rejects uploads to a storage that's past its watermark.
+// Anonymous uploads are rejected at the anonymous watermark, so there's room
+// left for keyed ones until the storage reaches the main watermark. Storages
+// whose usage can't be found out accept uploads.
+func (s *PasteService) checkCapacity(storageCfg config.StorageConfig, apiKey *models.APIKey) error {
+	quota := s.config.Server.Quota
+	watermark := quota.Watermark
+	if apiKey == nil && quota.AnonymousWatermark > 0 && (watermark <= 0 || quota.AnonymousWatermark < watermark) {
+		watermark = quota.AnonymousWatermark
+	}
+	if watermark <= 0 {
+		return nil
+	}
+
+	used, total, err := storageUsage(s.db, s.storage, storageCfg)
+	if err != nil {
+		s.logger.Warn("failed to get storage usage",
+			zap.String("storage", storageCfg.Name),
+			zap.Error(err))
+		return nil
+	}
+	if total <= 0 || float64(used) < watermark*float64(total) {
+		return nil
+	}
+
+	if apiKey == nil && watermark < quota.Watermark {
+		return fiber.NewError(fiber.StatusInsufficientStorage, "Storage is nearly full, only uploads with an API key are accepted")
+	}
+	return fiber.NewError(fiber.StatusInsufficientStorage, "Storage is full, no uploads are accepted")
+}
+
+// storageConfig returns the configuration of the named storage, or one with
+// just the name if the storage is no longer configured
+func (s *PasteService) storageConfig(name string) config.StorageConfig {
+	for _, storageCfg := range s.config.Storage {
+		if storageCfg.Name == name {
+			return storageCfg
+		}
+	}
+	return config.StorageConfig{Name: name}
+}
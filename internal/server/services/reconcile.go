@@ -0,0 +1,286 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
+	"go.uber.org/zap"
+)
+
+// reconcileBatchSize is the number of pastes loaded at a time by Reconcile
+const reconcileBatchSize = 100
+
+// ReconcileReport sums up a run of Reconcile
+type ReconcileReport struct {
+	OrphanedContent int64 // Stored content no record refers to
+	OrphanedBytes   int64
+	BrokenContent   int64 // Content records refer to that's missing or has the wrong size
+	BrokenPastes    int64 // Pastes whose current content is broken
+	BrokenRevisions int64 // Archived revisions whose content is broken
+}
+
+// Reconcile checks the content in every storage against the records referring
+// to it. Content that no record refers to is orphaned, unless it's younger
+// than the configured minimum age, since uploads are saved before their
+// records are created. Records are broken when their content is missing or
+// doesn't have the size it was stored with. Unless repair is set, what's found
+// is only logged and counted; otherwise orphaned content is deleted, pastes
+// whose current content is broken are deleted, and broken revisions are
+// dropped from the history of their paste.
+func (s *CleanupService) Reconcile(repair bool) (ReconcileReport, error) {
+	var report ReconcileReport
+
+	_, defaultName, err := s.paste.storage.DefaultProvider()
+	if err != nil {
+		return report, err
+	}
+
+	for _, cfg := range s.config.Storage {
+		// Replicas aren't referenced by records of their own
+		if s.config.IsReplica(cfg.Name) {
+			continue
+		}
+		if err := s.reconcileStorage(cfg.Name, cfg.Name == defaultName, repair, &report); err != nil {
+			return report, fmt.Errorf("failed to reconcile storage %s: %w", cfg.Name, err)
+		}
+	}
+	return report, nil
+}
+
+// reconcileStorage reconciles the named storage, adding what it finds to report
+func (s *CleanupService) reconcileStorage(name string, isDefault, repair bool, report *ReconcileReport) error {
+	store, err := s.paste.storeFor(name)
+	if err != nil {
+		return err
+	}
+	// Content is checked in the backend itself, while deleting it goes through
+	// the cache and replica as well
+	backend, err := s.paste.backendFor(name)
+	if err != nil {
+		return err
+	}
+
+	// The content is listed before the records are read, so that content
+	// saved in between is already referenced by the time it's looked for
+	objects := make(map[string]storage.ObjectInfo)
+	if err := backend.List(func(obj storage.ObjectInfo) error {
+		objects[obj.Path] = obj
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, query := range s.paste.storagePathQueries(name, isDefault) {
+		var paths []string
+		if err := query.Distinct("storage_path").Pluck("storage_path", &paths).Error; err != nil {
+			return err
+		}
+		for _, path := range paths {
+			referenced[storage.ObjectPath(path)] = true
+		}
+	}
+
+	minAge := s.config.Server.Cleanup.Reconcile.MinAge
+	for path, obj := range objects {
+		if referenced[path] || time.Since(obj.ModTime) < minAge {
+			continue
+		}
+		report.OrphanedContent++
+		report.OrphanedBytes += obj.Size
+		s.logger.Warn("found orphaned content",
+			zap.String("storage", name),
+			zap.String("path", path),
+			zap.Int64("size", obj.Size))
+		if repair {
+			if err := store.Delete(path); err != nil {
+				s.logger.Error("failed to delete orphaned content",
+					zap.String("storage", name),
+					zap.String("path", path),
+					zap.Error(err))
+			}
+		}
+	}
+
+	var blobs []models.Blob
+	if err := s.db.Where("storage_name = ?", name).Find(&blobs).Error; err != nil {
+		return err
+	}
+	storedSizes := make(map[string]int64, len(blobs))
+	for _, blob := range blobs {
+		storedSizes[blob.StoragePath] = blob.StoredSize
+	}
+
+	// Content is checked once, however many records share it
+	broken := make(map[string]bool)
+	checked := make(map[string]bool)
+	isBroken := func(path string, size int64) (bool, error) {
+		if checked[path] {
+			return broken[path], nil
+		}
+		problem, err := checkContent(backend, objects, storedSizes, path, size)
+		if err != nil {
+			return false, err
+		}
+		checked[path] = true
+		if problem != "" {
+			broken[path] = true
+			s.logger.Warn("found broken content",
+				zap.String("storage", name),
+				zap.String("path", path),
+				zap.String("problem", problem))
+		}
+		return broken[path], nil
+	}
+
+	for _, blob := range blobs {
+		if _, err := isBroken(blob.StoragePath, blob.Size); err != nil {
+			return err
+		}
+	}
+
+	lastID := ""
+	for {
+		var pastes []models.Paste
+		if err := s.db.Preload("Files").Preload("Revisions").
+			Where("storage_name = ? AND id > ?", name, lastID).
+			Order("id ASC").
+			Limit(reconcileBatchSize).
+			Find(&pastes).Error; err != nil {
+			return err
+		}
+		if len(pastes) == 0 {
+			break
+		}
+		lastID = pastes[len(pastes)-1].ID
+
+		for i := range pastes {
+			if err := s.reconcilePaste(&pastes[i], isBroken, broken, repair, report); err != nil {
+				return err
+			}
+		}
+	}
+
+	report.BrokenContent += int64(len(broken))
+	if !repair || len(broken) == 0 {
+		return nil
+	}
+
+	// Broken content mustn't be handed out again to identical uploads
+	paths := make([]string, 0, len(broken))
+	for path := range broken {
+		paths = append(paths, path)
+	}
+	if err := s.db.Where("storage_name = ? AND storage_path IN ?", name, paths).
+		Delete(&models.Blob{}).Error; err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if _, listed := objects[storage.ObjectPath(path)]; listed {
+			if err := store.Delete(path); err != nil {
+				s.logger.Error("failed to delete broken content",
+					zap.String("storage", name),
+					zap.String("path", path),
+					zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// reconcilePaste checks the content of a paste and its revisions, deleting
+// the paste or the revisions that are broken if repair is set
+func (s *CleanupService) reconcilePaste(paste *models.Paste, isBroken func(string, int64) (bool, error), broken map[string]bool, repair bool, report *ReconcileReport) error {
+	current := map[string]int64{paste.StoragePath: paste.Size}
+	if paste.IsBundle() {
+		current = make(map[string]int64, len(paste.Files))
+		for _, file := range paste.Files {
+			current[file.StoragePath] = file.Size
+		}
+	}
+
+	for path, size := range current {
+		ok, err := isBroken(path, size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		report.BrokenPastes++
+		s.logger.Warn("found paste with broken content", zap.String("id", paste.ID))
+		if !repair {
+			return nil
+		}
+
+		// Broken content is dealt with once all records sharing it are gone
+		var intact []string
+		for _, path := range paste.StoragePaths() {
+			if !broken[path] {
+				intact = append(intact, path)
+			}
+		}
+		if err := s.paste.releaseContent(s.db, paste.StorageName, intact...); err != nil {
+			return err
+		}
+		return s.db.Delete(paste).Error
+	}
+
+	for _, rev := range paste.Revisions {
+		ok, err := isBroken(rev.StoragePath, rev.Size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		report.BrokenRevisions++
+		s.logger.Warn("found revision with broken content",
+			zap.String("id", paste.ID),
+			zap.Int("revision", rev.Number))
+		if repair {
+			if err := s.db.Delete(&rev).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkContent describes what's wrong with the content at path, or returns
+// an empty string if nothing is. Its stored size is checked against the blob
+// record when there is one, and otherwise against the size of the content if
+// it isn't compressed.
+func checkContent(store storage.Provider, objects map[string]storage.ObjectInfo, storedSizes map[string]int64, path string, size int64) (string, error) {
+	expected, known := storedSizes[path]
+	if !known && !storage.IsCompressedPath(path) {
+		expected, known = size, true
+	}
+
+	objectPath := storage.ObjectPath(path)
+	obj, listed := objects[objectPath]
+	actual := obj.Size
+	switch {
+	case !listed:
+		// The content may have been saved after it was listed
+		var err error
+		if actual, err = store.Size(path); err != nil {
+			return "missing", nil
+		}
+	case objectPath != path:
+		// What's listed of encrypted content includes its overhead
+		var err error
+		if actual, err = store.Size(path); err != nil {
+			return "", err
+		}
+	}
+
+	if known && actual != expected {
+		return fmt.Sprintf("stored size is %d, expected %d", actual, expected), nil
+	}
+	return "", nil
+}
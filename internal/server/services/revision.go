@@ -0,0 +1,255 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// UpdatePaste replaces the content of a paste, keeping the previous content
+// addressable as a prior revision
+func (s *PasteService) UpdatePaste(c *fiber.Ctx, id string) error {
+	// Strip any extension from the ID
+	if idx := strings.LastIndex(id, "."); idx != -1 {
+		id = id[:idx]
+	}
+
+	paste, err := s.GetPaste(id)
+	if err != nil {
+		return err
+	}
+
+	apiKey := c.Locals("apiKey").(*models.APIKey)
+	if paste.APIKey == "" || paste.APIKey != apiKey.Key {
+		return fiber.NewError(fiber.StatusForbidden, "Pastes can only be updated with the API key that created them")
+	}
+	if !apiKey.AllowUpdates {
+		return fiber.NewError(fiber.StatusForbidden, "API key is not allowed to update pastes")
+	}
+	if paste.IsBundle() {
+		return fiber.NewError(fiber.StatusBadRequest, "Multi-file pastes can't be updated")
+	}
+
+	p, err := s.parseOptions(c)
+	if err != nil {
+		return err
+	}
+	// Revisions of an encrypted paste must be encrypted too, and vice versa,
+	// so a paste's URL never changes from needing a key to not needing one
+	if p.Encrypted != paste.Encrypted {
+		return fiber.NewError(fiber.StatusBadRequest, "Revisions must be encrypted if and only if the paste is")
+	}
+
+	content, filename, _, err := s.openContent(c, p, apiKey)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	// Keep the current filename unless a new one was given
+	if p.Filename == "" {
+		p.Filename = filename
+	}
+	if p.Filename == "" {
+		p.Filename = paste.Filename
+	}
+
+	if err := s.createRevision(paste, content, apiKey, p); err != nil {
+		return err
+	}
+
+	return c.JSON(NewPasteResponse(paste, s.config.Server.BaseURL))
+}
+
+// GetRevision returns a copy of the paste with the content of the given
+// revision
+func (s *PasteService) GetRevision(paste *models.Paste, number int) (*models.Paste, error) {
+	revision, ok := paste.AtRevision(number)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Revision not found")
+	}
+	return revision, nil
+}
+
+// createRevision stores content as the next revision of a paste. The current
+// content becomes a PasteRevision so it stays addressable.
+func (s *PasteService) createRevision(paste *models.Paste, content io.Reader, apiKey *models.APIKey, opts *PasteOptions) error {
+	contentType, extension, content, err := s.detectContent(content, apiKey, opts)
+	if err != nil {
+		return err
+	}
+
+	// Every revision is stored under its own name so prior revisions are
+	// never overwritten
+	number := paste.Revision + 1
+	filename := fmt.Sprintf("%s-r%d", paste.ID, number)
+	if extension != "" {
+		filename = filename + "." + extension
+	}
+
+	if err := s.checkCapacity(s.storageConfig(paste.StorageName), apiKey); err != nil {
+		return err
+	}
+
+	// Prior revisions stay stored, so the new one counts towards the quota in
+	// full
+	limit, remaining, err := s.uploadLimit(apiKey, -1)
+	if err != nil {
+		return err
+	}
+	body := &sizeLimitedReader{
+		r:     content,
+		limit: limit,
+	}
+	storagePath, hash, _, err := s.putContent(s.db, paste.StorageName, filename, body, contentType)
+	if err != nil {
+		if body.Exceeded() {
+			return s.sizeError(body.n, remaining, apiKey)
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to store content")
+	}
+
+	// The current content was created with the paste unless it was revised
+	createdAt := paste.CreatedAt
+	if paste.RevisedAt != nil {
+		createdAt = *paste.RevisedAt
+	}
+	previous := models.PasteRevision{
+		PasteID:     paste.ID,
+		Number:      paste.Revision,
+		CreatedAt:   createdAt,
+		Filename:    paste.Filename,
+		MimeType:    paste.MimeType,
+		Size:        paste.Size,
+		Extension:   paste.Extension,
+		SHA256:      paste.SHA256,
+		StoragePath: paste.StoragePath,
+	}
+
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.lockQuota(tx, apiKey); err != nil {
+			return err
+		}
+
+		// Only move to the next revision if nobody else got there first
+		result := tx.Model(&models.Paste{}).
+			Where("id = ? AND revision = ?", paste.ID, paste.Revision).
+			Updates(map[string]any{
+				"revision":     number,
+				"revised_at":   now,
+				"filename":     opts.Filename,
+				"mime_type":    contentType,
+				"extension":    extension,
+				"size":         body.n,
+				"sha256":       hash,
+				"storage_path": storagePath,
+			})
+		if result.Error != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update paste")
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusConflict, "Paste was updated concurrently, please retry")
+		}
+
+		if err := tx.Create(&previous).Error; err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to save revision")
+		}
+
+		return s.checkQuota(tx, apiKey)
+	})
+	if err != nil {
+		if err := s.releaseContent(s.db, paste.StorageName, storagePath); err != nil {
+			s.logger.Error("failed to delete content of failed revision",
+				zap.String("id", paste.ID),
+				zap.String("path", storagePath),
+				zap.Error(err))
+		}
+		return err
+	}
+
+	paste.Revisions = append(paste.Revisions, previous)
+	paste.Revision = number
+	paste.RevisedAt = &now
+	paste.Filename = opts.Filename
+	paste.MimeType = contentType
+	paste.Extension = extension
+	paste.Size = body.n
+	paste.SHA256 = hash
+	paste.StoragePath = storagePath
+
+	return nil
+}
+
+// revisionPinned reports whether the request addresses a specific revision of
+// a paste rather than its latest content
+func revisionPinned(c *fiber.Ctx) bool {
+	return c.Locals("revision") != nil
+}
+
+// setContentCacheHeaders sets the cache headers for paste content. Only URLs
+// pinned to a revision are immutable, the latest content of a paste changes
+// whenever the paste is updated.
+func setContentCacheHeaders(c *fiber.Ctx, paste *models.Paste) {
+	// Protected pastes and those with a view limit must never be served
+	// from a shared cache
+	if paste.HasViewLimit() || paste.HasPassword() {
+		c.Set("Cache-Control", "private, no-store")
+		return
+	}
+
+	if revisionPinned(c) {
+		c.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Set("Cache-Control", "public, no-cache")
+	}
+	c.Set("ETag", fmt.Sprintf("%s-r%d", paste.ID, paste.Revision))
+}
+
+// revisionPath returns the URL path the paste's content is served under
+func revisionPath(c *fiber.Ctx, paste *models.Paste) string {
+	if revisionPinned(c) {
+		return fmt.Sprintf("/p/%s/rev/%d", paste.ID, paste.Revision)
+	}
+	if paste.Extension != "" {
+		return fmt.Sprintf("/p/%s.%s", paste.ID, paste.Extension)
+	}
+	return "/p/" + paste.ID
+}
+
+// revisionList builds the revision picker entries for the paste view
+func revisionList(paste *models.Paste) []fiber.Map {
+	latest := paste.LatestRevision()
+	if latest <= 1 {
+		return nil
+	}
+
+	revisions := make([]fiber.Map, 0, latest)
+	for _, rev := range paste.Revisions {
+		revisions = append(revisions, fiber.Map{
+			"number":  rev.Number,
+			"created": rev.CreatedAt.Format("2006-01-02 15:04:05"),
+			"url":     fmt.Sprintf("/p/%s/rev/%d", paste.ID, rev.Number),
+			"current": rev.Number == paste.Revision,
+		})
+	}
+
+	// The latest revision is described by the paste itself
+	created := paste.CreatedAt
+	if paste.RevisedAt != nil {
+		created = *paste.RevisedAt
+	}
+	revisions = append(revisions, fiber.Map{
+		"number":  latest,
+		"created": created.Format("2006-01-02 15:04:05"),
+		"url":     fmt.Sprintf("/p/%s/rev/%d", paste.ID, latest),
+		"current": latest == paste.Revision,
+	})
+	return revisions
+}
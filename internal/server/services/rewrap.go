@@ -0,0 +1,116 @@
+package services
+
+import (
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// storageRecords are the models that hold storage paths
+var storageRecords = []any{
+	&models.Paste{},
+	&models.PasteFile{},
+	&models.PasteRevision{},
+	&models.UploadChunk{},
+	&models.Blob{},
+}
+
+// RewrapStorageKeys moves content encrypted at rest under a previous key to
+// the current one. Only the storage paths, which carry the wrapped data keys,
+// are updated; the content itself isn't rewritten. Since deduplicated content
+// is shared, each path is rewrapped once and updated wherever it's used. It
+// returns the number of paths rewrapped.
+func (s *PasteService) RewrapStorageKeys() (int64, error) {
+	_, defaultName, err := s.storage.DefaultProvider()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, cfg := range s.config.Storage {
+		// Replicas hold the same content as their primary, under the same keys
+		if s.config.IsReplica(cfg.Name) {
+			continue
+		}
+
+		// Each storage has keys of its own
+		store, err := s.storeFor(cfg.Name)
+		if err != nil {
+			return count, err
+		}
+
+		paths, err := s.encryptedPaths(cfg.Name, cfg.Name == defaultName)
+		if err != nil {
+			return count, err
+		}
+
+		for path := range paths {
+			newPath, err := store.Rewrap(path)
+			if err != nil {
+				s.logger.Error("failed to rewrap storage key",
+					zap.String("storage", cfg.Name),
+					zap.String("path", path),
+					zap.Error(err))
+				continue
+			}
+			if newPath == path {
+				continue
+			}
+
+			// Records whose content changed in the meantime no longer match
+			for _, model := range storageRecords {
+				if err := s.db.Model(model).
+					Where("storage_path = ?", path).
+					UpdateColumn("storage_path", newPath).Error; err != nil {
+					return count, err
+				}
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// encryptedPaths returns the distinct paths of content encrypted at rest in
+// the named storage
+func (s *PasteService) encryptedPaths(name string, isDefault bool) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	for _, query := range s.storagePathQueries(name, isDefault) {
+		var found []string
+		if err := query.
+			Distinct("storage_path").
+			Where("(storage_path LIKE ? OR storage_path LIKE ?)", "enc:%", "gz:enc:%").
+			Pluck("storage_path", &found).Error; err != nil {
+			return nil, err
+		}
+		for _, path := range found {
+			paths[path] = true
+		}
+	}
+	return paths, nil
+}
+
+// storagePathQueries returns queries for each of the storageRecords kept in
+// the named storage
+func (s *PasteService) storagePathQueries(name string, isDefault bool) []*gorm.DB {
+	inStorage := func() *gorm.DB {
+		return s.db.Model(&models.Paste{}).Select("id").Where("storage_name = ?", name)
+	}
+	queries := []*gorm.DB{
+		s.db.Model(&models.Paste{}).Where("storage_name = ?", name),
+		s.db.Model(&models.PasteFile{}).Where("paste_id IN (?)", inStorage()),
+		s.db.Model(&models.PasteRevision{}).Where("paste_id IN (?)", inStorage()),
+		s.db.Model(&models.Blob{}).Where("storage_name = ?", name),
+	}
+
+	// Upload chunks are kept in the storage their upload was created in, and
+	// uploads that didn't record one use the default storage
+	uploadStorage := []string{name}
+	if isDefault {
+		uploadStorage = append(uploadStorage, "")
+	}
+	inUploads := s.db.Model(&models.Upload{}).Select("id").Where("storage_name IN ?", uploadStorage)
+	queries = append(queries, s.db.Model(&models.UploadChunk{}).Where("upload_id IN (?)", inUploads))
+	return queries
+}
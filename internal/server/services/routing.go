@@ -0,0 +1,86 @@
+package services
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+)
+
+// storageRequest describes new content for choosing the storage it goes to
+type storageRequest struct {
+	Size     int64  // -1 if it isn't known
+	MimeType string // Empty for bundles, whose files are only sniffed once stored
+	APIKey   *models.APIKey
+	Private  bool
+}
+
+// chooseStorage applies the storage routes to new content. It returns the
+// storage to put the content in, and the name of the route that chose it or
+// an empty string for the default storage.
+func (s *PasteService) chooseStorage(req storageRequest) (config.StorageConfig, string, error) {
+	for _, route := range s.config.StorageRoutes {
+		if !routeMatches(route, req) {
+			continue
+		}
+		for _, storage := range s.config.Storage {
+			if storage.Name == route.Storage {
+				return storage, routeName(route), nil
+			}
+		}
+	}
+
+	for _, storage := range s.config.Storage {
+		if storage.IsDefault {
+			return storage, "", nil
+		}
+	}
+	return config.StorageConfig{}, "", fiber.NewError(fiber.StatusInternalServerError, "No default storage configuration found")
+}
+
+// routeName returns the name a route is shown under
+func routeName(route config.StorageRouteConfig) string {
+	if route.Name != "" {
+		return route.Name
+	}
+	return route.Storage
+}
+
+// routeMatches reports whether content meets all conditions of a route
+func routeMatches(route config.StorageRouteConfig, req storageRequest) bool {
+	if route.MinSize > 0 && req.Size < route.MinSize {
+		return false
+	}
+	if route.MaxSize > 0 && (req.Size < 0 || req.Size > route.MaxSize) {
+		return false
+	}
+	if len(route.MimeTypes) > 0 && !slices.ContainsFunc(route.MimeTypes, func(pattern string) bool {
+		return mimeTypeMatches(pattern, req.MimeType)
+	}) {
+		return false
+	}
+	if len(route.APIKeys) > 0 && (req.APIKey == nil || !slices.Contains(route.APIKeys, req.APIKey.Key)) {
+		return false
+	}
+	if route.Private != nil && *route.Private != req.Private {
+		return false
+	}
+	return true
+}
+
+// mimeTypeMatches matches a MIME type, ignoring its parameters, against a
+// pattern such as "application/pdf" or "image/*"
+func mimeTypeMatches(pattern, mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.TrimSpace(mimeType)
+	if mimeType == "" {
+		return false
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.EqualFold(strings.SplitN(mimeType, "/", 2)[0], prefix)
+	}
+	return strings.EqualFold(mimeType, pattern)
+}
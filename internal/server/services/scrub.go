@@ -0,0 +1,96 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/watzon/0x45/internal/models"
+	"go.uber.org/zap"
+)
+
+// scrubBatchSize is the number of blobs loaded at a time by ScrubContent
+const scrubBatchSize = 100
+
+// ScrubContent re-hashes all stored content and compares it with the hash and
+// size it was stored with. Content that doesn't match, or can't be read, is
+// logged and marked corrupt on its blob record, which shows up in the stats;
+// content that matches again is no longer marked. It returns the number of
+// blobs checked and the number found corrupt.
+func (s *PasteService) ScrubContent() (int64, int64, error) {
+	var checked, corrupt int64
+
+	var lastID uint
+	for {
+		var blobs []models.Blob
+		if err := s.db.Where("id > ?", lastID).
+			Order("id ASC").
+			Limit(scrubBatchSize).
+			Find(&blobs).Error; err != nil {
+			return checked, corrupt, err
+		}
+		if len(blobs) == 0 {
+			break
+		}
+		lastID = blobs[len(blobs)-1].ID
+
+		for _, blob := range blobs {
+			problem := s.verifyBlob(&blob)
+
+			// Blobs released while they were being read are gone
+			now := time.Now()
+			result := s.db.Model(&models.Blob{}).
+				Where("id = ? AND storage_path = ?", blob.ID, blob.StoragePath).
+				UpdateColumns(map[string]any{"verified_at": now, "corrupt": problem != nil})
+			if result.Error != nil {
+				return checked, corrupt, result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+
+			checked++
+			if problem != nil {
+				corrupt++
+				s.logger.Error("stored content is corrupt",
+					zap.String("storage", blob.StorageName),
+					zap.String("path", blob.StoragePath),
+					zap.String("hash", blob.Hash),
+					zap.Error(problem))
+			}
+		}
+	}
+
+	return checked, corrupt, nil
+}
+
+// verifyBlob reads the content of a blob back from its storage's backend,
+// returning why it doesn't match the blob record if it doesn't
+func (s *PasteService) verifyBlob(blob *models.Blob) error {
+	store, err := s.backendFor(blob.StorageName)
+	if err != nil {
+		return err
+	}
+
+	content, err := store.Open(blob.StoragePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, content)
+	if err != nil {
+		return err
+	}
+	if size != blob.Size {
+		return fmt.Errorf("content has size %d, expected %d", size, blob.Size)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != blob.Hash {
+		return errors.New("content has hash " + sum)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/storage"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -15,19 +16,23 @@ type Services struct {
 	APIKey    *APIKeyService
 	Analytics *AnalyticsService
 	Stats     *StatsService
+	Upload    *UploadService
 	Cleanup   *CleanupService
 }
 
 // NewServices creates a new Services instance with all service dependencies
-func NewServices(db *gorm.DB, logger *zap.Logger, config *config.Config) *Services {
+func NewServices(db *gorm.DB, logger *zap.Logger, config *config.Config, storage *storage.StorageManager) *Services {
 	services := &Services{
-		Paste:     NewPasteService(db, logger, config),
+		Paste:     NewPasteService(db, logger, config, storage),
 		URL:       NewURLService(db, logger, config),
 		APIKey:    NewAPIKeyService(db, logger, config),
 		Analytics: NewAnalyticsService(db, logger, config),
-		Stats:     NewStatsService(db, logger, config),
+		Stats:     NewStatsService(db, logger, config, storage),
 	}
 
+	// Create the upload service once the paste service exists
+	services.Upload = NewUploadService(db, logger, config, services)
+
 	// Create cleanup service last since it depends on other services
 	services.Cleanup = NewCleanupService(db, logger, config, services)
 
@@ -1,13 +1,16 @@
 package services
 
 import (
+	"database/sql"
 	"encoding/json"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/watzon/0x45/internal/config"
 	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -16,14 +19,16 @@ type StatsService struct {
 	db        *gorm.DB
 	logger    *zap.Logger
 	config    *config.Config
+	storage   *storage.StorageManager
 	analytics *AnalyticsService
 }
 
-func NewStatsService(db *gorm.DB, logger *zap.Logger, config *config.Config) *StatsService {
+func NewStatsService(db *gorm.DB, logger *zap.Logger, config *config.Config, storage *storage.StorageManager) *StatsService {
 	return &StatsService{
 		db:        db,
 		logger:    logger,
 		config:    config,
+		storage:   storage,
 		analytics: NewAnalyticsService(db, logger, config),
 	}
 }
@@ -61,6 +66,14 @@ func (s *StatsService) GetSystemStats() (fiber.Map, error) {
 	// Convert to JSON
 	storageByTypeJSON, _ := json.Marshal(storageByType)
 
+	// Get storage by the route that chose it
+	storageByRoute, err := s.getStorageByRoute()
+	if err != nil {
+		s.logger.Error("failed to get storage by route", zap.Error(err))
+		storageByRoute = make(map[string]int64)
+	}
+	storageByRouteJSON, _ := json.Marshal(storageByRoute)
+
 	// Get average paste size
 	var avgSize float64
 	if err := s.db.Model(&models.Paste{}).
@@ -119,13 +132,28 @@ func (s *StatsService) GetSystemStats() (fiber.Map, error) {
 		privateRatio = float64(privatePastes) / float64(totalPastes) * 100
 	}
 
-	// Get total storage used
-	totalStorage, err := s.getStorageSize()
+	// Get total storage used, before and after deduplication and compression
+	totalStorage, physicalStorage, compressedStorage, err := s.getStorageSize()
 	if err != nil {
 		s.logger.Error("failed to get storage size", zap.Error(err))
-		totalStorage = 0
+		totalStorage, physicalStorage, compressedStorage = 0, 0, 0
+	}
+
+	// Content the scrub found to be corrupt
+	var corruptContent int64
+	if err := s.db.Model(&models.Blob{}).Where("corrupt = ?", true).Count(&corruptContent).Error; err != nil {
+		s.logger.Error("failed to count corrupt content", zap.Error(err))
 	}
 
+	// Space used in each storage, against its capacity where it's known
+	storageUsage := s.getStorageUsage()
+
+	// Work left for and given up on by storage replication
+	replication := s.getReplicationStats()
+
+	// Reads served by the storage caches since the server started
+	cache := s.getCacheStats()
+
 	// Format the private ratio to 2 decimal places
 	formattedPrivateRatio := float64(int(privateRatio*100)) / 100
 
@@ -135,12 +163,23 @@ func (s *StatsService) GetSystemStats() (fiber.Map, error) {
 			"urls":           totalUrls,
 			"storage":        totalStorage,
 			"storageByType":  string(storageByTypeJSON),
+			"storageByRoute": string(storageByRouteJSON),
 			"avgSize":        avgSize,
 			"activeApiKeys":  activeApiKeys,
 			"extensionStats": extensionStats,
 			"expiringPastes": expiringPastes,
 			"expiringUrls":   expiringUrls,
+
+			"storageSize":           formatSize(int64(totalStorage)),
+			"physicalStorage":       physicalStorage,
+			"physicalStorageSize":   formatSize(int64(physicalStorage)),
+			"compressedStorage":     compressedStorage,
+			"compressedStorageSize": formatSize(int64(compressedStorage)),
+			"corruptContent":        corruptContent,
 		},
+		"cache":        cache,
+		"storageUsage": storageUsage,
+		"replication":  replication,
 		"history": fiber.Map{
 			"pastes":  string(pastesHistory),
 			"urls":    string(urlsHistory),
@@ -148,6 +187,7 @@ func (s *StatsService) GetSystemStats() (fiber.Map, error) {
 		},
 		"storage": fiber.Map{
 			"byType":  string(storageByTypeJSON),
+			"byRoute": string(storageByRouteJSON),
 			"avgSize": avgSize,
 		},
 		"extensions": extensionStats,
@@ -165,6 +205,129 @@ func (s *StatsService) GetSystemStats() (fiber.Map, error) {
 
 // Helper functions
 
+// KeyUsage is the storage used by the pastes of an API key
+type KeyUsage struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Used  int64  `json:"used"`
+	Quota int64  `json:"quota"` // Zero if there's no limit
+}
+
+// GetKeyUsage returns the storage used by each API key with pastes, largest
+// first. It's meant for operators, the keys aren't shown on the stats page.
+func (s *StatsService) GetKeyUsage() ([]KeyUsage, error) {
+	var keys []models.APIKey
+	if err := s.db.Where("api_keys.key IN (?)", s.db.Model(&models.Paste{}).Distinct("api_key").Where("api_key != ''")).
+		Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	usage := make([]KeyUsage, 0, len(keys))
+	for _, key := range keys {
+		used, err := keyUsage(s.db, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		quota := key.StorageQuota
+		if quota == 0 {
+			quota = s.config.Server.Quota.PerKey
+		}
+		usage = append(usage, KeyUsage{
+			Key:   key.Key,
+			Name:  key.Name,
+			Used:  used,
+			Quota: max(quota, 0),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Used > usage[j].Used
+	})
+	return usage, nil
+}
+
+// getStorageUsage returns the space used in each storage, with the share of
+// its capacity as a percentage to 2 decimal places where the capacity is known
+func (s *StatsService) getStorageUsage() fiber.Map {
+	usage := fiber.Map{}
+	if s.storage == nil {
+		return usage
+	}
+	for _, storageCfg := range s.config.Storage {
+		if s.config.IsReplica(storageCfg.Name) {
+			continue
+		}
+		used, total, err := storageUsage(s.db, s.storage, storageCfg)
+		if err != nil {
+			s.logger.Error("failed to get storage usage",
+				zap.String("storage", storageCfg.Name),
+				zap.Error(err))
+			continue
+		}
+
+		stats := fiber.Map{
+			"used":     used,
+			"usedSize": formatSize(used),
+			"capacity": total,
+		}
+		if total > 0 {
+			stats["capacitySize"] = formatSize(total)
+			stats["percent"] = float64(int(float64(used)/float64(total)*10000)) / 100
+		}
+		usage[storageCfg.Name] = stats
+	}
+	return usage
+}
+
+// getReplicationStats sums up the stats of replicated storages
+func (s *StatsService) getReplicationStats() fiber.Map {
+	var total storage.ReplicationStats
+	var enabled bool
+	if s.storage != nil {
+		for _, stats := range s.storage.ReplicationStats() {
+			enabled = true
+			total.Pending += stats.Pending
+			total.Failed += stats.Failed
+			total.Failovers += stats.Failovers
+		}
+	}
+	return fiber.Map{
+		"enabled":   enabled,
+		"pending":   total.Pending,
+		"failed":    total.Failed,
+		"failovers": total.Failovers,
+	}
+}
+
+// getCacheStats sums up the stats of the storage caches, with hit rates as
+// percentages to 2 decimal places
+func (s *StatsService) getCacheStats() fiber.Map {
+	var total storage.CacheStats
+	byStorage := fiber.Map{}
+	if s.storage != nil {
+		for name, stats := range s.storage.CacheStats() {
+			total.Hits += stats.Hits
+			total.Misses += stats.Misses
+			total.MemoryBytes += stats.MemoryBytes
+			total.DiskBytes += stats.DiskBytes
+			byStorage[name] = fiber.Map{
+				"hits":    stats.Hits,
+				"misses":  stats.Misses,
+				"hitRate": float64(int(stats.HitRate()*10000)) / 100,
+			}
+		}
+	}
+
+	return fiber.Map{
+		"enabled":    len(byStorage) > 0,
+		"hits":       total.Hits,
+		"misses":     total.Misses,
+		"hitRate":    float64(int(total.HitRate()*10000)) / 100,
+		"memorySize": formatSize(total.MemoryBytes),
+		"diskSize":   formatSize(total.DiskBytes),
+		"byStorage":  byStorage,
+	}
+}
+
 func (s *StatsService) getStorageByFileType() (map[string]int64, error) {
 	result := make(map[string]int64)
 
@@ -194,6 +357,42 @@ func (s *StatsService) getStorageByFileType() (map[string]int64, error) {
 	return result, nil
 }
 
+// getStorageByRoute returns the size of the pastes put in storage by each of
+// the storage routes. Every configured route is included, along with the
+// pastes that went to the default storage.
+func (s *StatsService) getStorageByRoute() (map[string]int64, error) {
+	result := map[string]int64{"default": 0}
+	for _, route := range s.config.StorageRoutes {
+		result[routeName(route)] = 0
+	}
+
+	rows, err := s.db.Model(&models.Paste{}).
+		Select("storage_route, SUM(size) as total_size").
+		Group("storage_route").
+		Rows()
+	if err != nil {
+		s.logger.Error("failed to query storage by route", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var route sql.NullString
+		var size int64
+		if err := rows.Scan(&route, &size); err != nil {
+			s.logger.Error("failed to scan row", zap.Error(err))
+			continue
+		}
+		if route.String == "" {
+			result["default"] += size
+		} else {
+			result[route.String] += size
+		}
+	}
+
+	return result, nil
+}
+
 func (s *StatsService) categorizeMimeType(mimeType string) string {
 	switch {
 	case strings.HasPrefix(mimeType, "text/"):
@@ -213,12 +412,36 @@ func (s *StatsService) categorizeMimeType(mimeType string) string {
 	}
 }
 
-func (s *StatsService) getStorageSize() (uint64, error) {
-	var totalSize uint64
-	err := s.db.Model(&models.Paste{}).Select("COALESCE(SUM(size), 0)").Row().Scan(&totalSize)
+// getStorageSize returns the logical size of all stored content, counting
+// every paste and revision, the physical size once identical content is
+// deduplicated, and the size at rest once text content is compressed
+func (s *StatsService) getStorageSize() (uint64, uint64, uint64, error) {
+	var pasteSize, revisionSize, sharedSize uint64
+	var compressedSavings int64 // Tiny content can grow when compressed
+	err := s.db.Model(&models.Paste{}).Select("COALESCE(SUM(size), 0)").Row().Scan(&pasteSize)
+	if err == nil {
+		err = s.db.Model(&models.PasteRevision{}).Select("COALESCE(SUM(size), 0)").Row().Scan(&revisionSize)
+	}
+	if err == nil {
+		// Every reference beyond the first is content that isn't stored again
+		err = s.db.Model(&models.Blob{}).
+			Select("COALESCE(SUM(size * (ref_count - 1)), 0)").
+			Where("ref_count > 1").
+			Row().Scan(&sharedSize)
+	}
+	if err == nil {
+		err = s.db.Model(&models.Blob{}).
+			Select("COALESCE(SUM(size - stored_size), 0)").
+			Where("stored_size > 0").
+			Row().Scan(&compressedSavings)
+	}
 	if err != nil {
 		s.logger.Error("failed to get total storage size", zap.Error(err))
-		return 0, err
+		return 0, 0, 0, err
 	}
-	return totalSize, nil
+
+	logical := pasteSize + revisionSize
+	physical := logical - min(sharedSize, logical)
+	compressed := max(int64(physical)-compressedSavings, 0)
+	return logical, physical, uint64(compressed), nil
 }
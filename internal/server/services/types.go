@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"net/url"
 	"reflect"
 	"time"
 
@@ -30,6 +31,11 @@ type PasteOptions struct {
 	URL       string         `json:"url" xml:"url" form:"url"`                      // URL to be pasted
 	ExpiresIn *hdur.Duration `json:"expires_in" xml:"expires_in" form:"expires_in"` // Duration string for paste expiry (e.g. "24h")
 	ExpiresAt *time.Time     `json:"expires_at" xml:"expires_at" form:"expires_at"` // Expiration time for the paste
+
+	BurnAfterRead bool   `json:"burn_after_read" xml:"burn_after_read" form:"burn_after_read"` // Delete the paste after it has been viewed once
+	MaxViews      int    `json:"max_views" xml:"max_views" form:"max_views"`                   // Delete the paste after this many views
+	Password      string `json:"password" xml:"password" form:"password"`                      // Password required to view the paste
+	Encrypted     bool   `json:"encrypted" xml:"encrypted" form:"encrypted"`                   // Content is an encrypted envelope
 }
 
 // PasteResponse represents the response structure for creating a new paste
@@ -40,8 +46,23 @@ type PasteResponse struct {
 	DeleteURL string     `json:"delete_url" xml:"delete_url" form:"delete_url"`
 	MimeType  string     `json:"mime_type" xml:"mime_type" form:"mime_type"`
 	Size      int64      `json:"size" xml:"size" form:"size"`
+	SHA256    string     `json:"sha256,omitempty" xml:"sha256,omitempty" form:"sha256"` // Hex encoded SHA-256 of the content
 	ExpiresAt *time.Time `json:"expires_at" xml:"expires_at" form:"expires_at"`
 	Private   bool       `json:"private" xml:"private" form:"private"`
+	Revision  int        `json:"revision" xml:"revision" form:"revision"`
+	MaxViews  *int       `json:"max_views,omitempty" xml:"max_views,omitempty" form:"max_views"`
+	Encrypted bool       `json:"encrypted,omitempty" xml:"encrypted,omitempty" form:"encrypted"`
+
+	Files []PasteFileResponse `json:"files,omitempty" xml:"files,omitempty" form:"files"` // Only set for multi-file pastes
+}
+
+// PasteFileResponse describes a single file within a multi-file paste
+type PasteFileResponse struct {
+	Filename string `json:"filename" xml:"filename" form:"filename"`
+	URL      string `json:"url" xml:"url" form:"url"`
+	MimeType string `json:"mime_type" xml:"mime_type" form:"mime_type"`
+	Size     int64  `json:"size" xml:"size" form:"size"`
+	SHA256   string `json:"sha256,omitempty" xml:"sha256,omitempty" form:"sha256"`
 }
 
 // UpdatePasteExpirationRequest represents the request structure for updating a paste's expiration time
@@ -65,10 +86,39 @@ func NewPasteResponse(paste *models.Paste, baseURL string) PasteResponse {
 		Private:   paste.Private,
 		MimeType:  paste.MimeType,
 		Size:      paste.Size,
+		SHA256:    paste.SHA256,
 		ExpiresAt: paste.ExpiresAt,
+		Revision:  paste.Revision,
+		MaxViews:  paste.MaxViews,
+		Encrypted: paste.Encrypted,
+		Files:     NewPasteFileResponses(paste, baseURL),
 	}
 }
 
+// NewPasteFileResponses creates responses for each file in a multi-file paste
+func NewPasteFileResponses(paste *models.Paste, baseURL string) []PasteFileResponse {
+	if !paste.IsBundle() {
+		return nil
+	}
+
+	files := make([]PasteFileResponse, len(paste.Files))
+	for i, file := range paste.Files {
+		files[i] = PasteFileResponse{
+			Filename: file.Filename,
+			URL:      PasteFileURL(baseURL, paste.ID, file.Filename),
+			MimeType: file.MimeType,
+			Size:     file.Size,
+			SHA256:   file.SHA256,
+		}
+	}
+	return files
+}
+
+// PasteFileURL returns the raw URL of a file within a multi-file paste
+func PasteFileURL(baseURL, pasteID, filename string) string {
+	return fmt.Sprintf("%s/p/%s/files/%s", baseURL, pasteID, url.PathEscape(filename))
+}
+
 // ListPastesResponse represents the response structure for listing pastes
 type ListPastesResponse struct {
 	Pastes []PasteResponse `json:"pastes"`
@@ -0,0 +1,581 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/storage"
+	"github.com/watzon/hdur"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// TusVersion is the version of the tus protocol implemented by the upload service
+	TusVersion = "1.0.0"
+
+	// tusExtensions lists the tus protocol extensions supported by the upload service
+	tusExtensions = "creation,termination,expiration"
+
+	// tusContentType is the content type required for PATCH requests
+	tusContentType = "application/offset+octet-stream"
+
+	// defaultUploadExpiry is used when no resumable upload expiry is configured
+	defaultUploadExpiry = 24 * time.Hour
+
+	// assemblingPasteID is the paste ID of an upload while a request is
+	// assembling it. It's shorter than any paste ID, so it never matches one.
+	assemblingPasteID = "-"
+)
+
+// UploadService implements resumable uploads using the tus protocol
+// (https://tus.io/protocols/resumable-upload). Each PATCH request is stored as
+// its own chunk, and the chunks are streamed into a regular paste once the
+// upload is complete.
+type UploadService struct {
+	db     *gorm.DB
+	logger *zap.Logger
+	config *config.Config
+	paste  *PasteService
+}
+
+func NewUploadService(db *gorm.DB, logger *zap.Logger, config *config.Config, services *Services) *UploadService {
+	return &UploadService{
+		db:     db,
+		logger: logger,
+		config: config,
+		paste:  services.Paste,
+	}
+}
+
+// Options advertises the server's tus capabilities
+func (s *UploadService) Options(c *fiber.Ctx) error {
+	var apiKey *models.APIKey
+	if key := c.Locals("apiKey"); key != nil {
+		apiKey = key.(*models.APIKey)
+	}
+
+	c.Set("Tus-Version", TusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(s.paste.maxFileSize(apiKey), 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateUpload starts a new resumable upload
+func (s *UploadService) CreateUpload(c *fiber.Ctx) error {
+	var apiKey *models.APIKey
+	if key := c.Locals("apiKey"); key != nil {
+		apiKey = key.(*models.APIKey)
+	}
+
+	if c.Get("Upload-Defer-Length") != "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Deferred upload length is not supported")
+	}
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid or missing Upload-Length header")
+	}
+
+	if length == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Empty file")
+	}
+
+	if maxSize := s.paste.maxFileSize(apiKey); length > maxSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload exceeds maximum allowed size of %d bytes", maxSize))
+	}
+
+	metadata, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Metadata header")
+	}
+
+	upload := &models.Upload{
+		UploadLength: length,
+		Filename:     metadata["filename"],
+		Extension:    metadata["extension"],
+		Private:      metadata["private"] == "true",
+		ExpiresIn:    metadata["expires_in"],
+		ExpiresAt:    time.Now().Add(s.uploadExpiry()),
+	}
+
+	// Check if the user is attempting to do something they're not allowed to do
+	if upload.Private && apiKey == nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Private pastes can only be created with an API key")
+	}
+
+	if apiKey != nil {
+		upload.APIKey = apiKey.Key
+	}
+
+	// Validate the paste expiry now, rather than after all of the data has
+	// been sent. The retention rules only depend on the declared size.
+	opts, err := uploadPasteOptions(upload)
+	if err != nil {
+		return err
+	}
+	if _, err := s.paste.calculateExpiry(ExpiryOptions{
+		Size:      length,
+		HasAPIKey: apiKey != nil,
+		ExpiresIn: opts.ExpiresIn,
+	}); err != nil {
+		return err
+	}
+
+	// Chunks are only kept until the upload is assembled, so they always go
+	// to the default storage. It's recorded in case the default changes
+	// before then.
+	_, storageName, err := s.paste.storage.DefaultProvider()
+	if err != nil {
+		s.logger.Error("no default storage configured", zap.Error(err))
+		return fiber.NewError(fiber.StatusInternalServerError, "Storage not available")
+	}
+	upload.StorageName = storageName
+
+	if err := s.db.Create(upload).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+
+	c.Set("Location", fmt.Sprintf("%s/p/uploads/%s", s.config.Server.BaseURL, upload.ID))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// GetUploadOffset reports how much of an upload has been received
+func (s *UploadService) GetUploadOffset(c *fiber.Ctx) error {
+	upload, err := s.findUpload(c)
+	if err != nil {
+		return err
+	}
+
+	s.setUploadHeaders(c, upload)
+	c.Set("Cache-Control", "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// AppendChunk stores the request body as the next chunk of an upload, and
+// assembles the paste once the final chunk has been received
+func (s *UploadService) AppendChunk(c *fiber.Ctx) error {
+	if !strings.HasPrefix(c.Get("Content-Type"), tusContentType) {
+		return rejectChunk(c, fiber.NewError(fiber.StatusUnsupportedMediaType,
+			fmt.Sprintf("Content-Type must be %s", tusContentType)))
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return rejectChunk(c, fiber.NewError(fiber.StatusBadRequest, "Invalid or missing Upload-Offset header"))
+	}
+
+	upload, err := s.findUpload(c)
+	if err != nil {
+		return rejectChunk(c, err)
+	}
+
+	if offset != upload.UploadOffset {
+		return rejectChunk(c, fiber.NewError(fiber.StatusConflict,
+			fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, upload.UploadOffset)))
+	}
+
+	if !upload.IsComplete() {
+		if err := s.storeChunk(c, upload); err != nil {
+			return rejectChunk(c, err)
+		}
+	}
+
+	// An upload still being assembled by another request is handed to
+	// finalizeUpload too, which reports the conflict
+	if upload.IsComplete() && (upload.PasteID == "" || upload.PasteID == assemblingPasteID) {
+		if err := s.finalizeUpload(c, upload); err != nil {
+			return err
+		}
+	}
+
+	s.setUploadHeaders(c, upload)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// TerminateUpload cancels an upload and removes any data received so far
+func (s *UploadService) TerminateUpload(c *fiber.Ctx) error {
+	upload, err := s.findUpload(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.deleteUpload(upload); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete upload")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CleanupExpired removes expired uploads and any chunks they still hold
+func (s *UploadService) CleanupExpired() (int64, error) {
+	var uploads []models.Upload
+	if err := s.db.Where("expires_at < ?", time.Now()).Find(&uploads).Error; err != nil {
+		return 0, err
+	}
+
+	var totalDeleted int64
+	for i := range uploads {
+		if err := s.deleteUpload(&uploads[i]); err != nil {
+			s.logger.Error("failed to delete expired upload",
+				zap.String("id", uploads[i].ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		totalDeleted++
+	}
+
+	return totalDeleted, nil
+}
+
+// Helper functions
+
+// findUpload looks up the upload referenced by the request and checks that
+// the caller is allowed to access it
+func (s *UploadService) findUpload(c *fiber.Ctx) (*models.Upload, error) {
+	var upload models.Upload
+	err := s.db.Where("id = ? AND expires_at > ?", c.Params("id"), time.Now()).First(&upload).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Upload not found or expired")
+		}
+		return nil, err
+	}
+
+	// Uploads started with an API key can only be continued with the same key
+	if upload.APIKey != "" {
+		apiKey, _ := c.Locals("apiKey").(*models.APIKey)
+		if apiKey == nil || apiKey.Key != upload.APIKey {
+			return nil, fiber.NewError(fiber.StatusForbidden, "Upload belongs to a different API key")
+		}
+	}
+
+	return &upload, nil
+}
+
+// storeChunk streams the request body into storage and advances the upload offset
+func (s *UploadService) storeChunk(c *fiber.Ctx, upload *models.Upload) error {
+	stream := c.Context().RequestBodyStream()
+	if stream == nil {
+		stream = bytes.NewReader(c.Body())
+	}
+
+	body := &sizeLimitedReader{
+		r:     stream,
+		limit: upload.UploadLength - upload.UploadOffset,
+	}
+
+	store, err := s.paste.storeFor(upload.StorageName)
+	if err != nil {
+		return err
+	}
+
+	chunkName := fmt.Sprintf("%s-%d.part", upload.ID, upload.UploadOffset)
+	storagePath, err := store.Put(chunkName, body)
+	if err != nil {
+		if body.Exceeded() {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds the declared Upload-Length")
+		}
+		s.logger.Error("failed to store upload chunk",
+			zap.String("id", upload.ID),
+			zap.Error(err),
+		)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to store chunk")
+	}
+
+	// Nothing was sent, so there's nothing to record
+	if body.n == 0 {
+		_ = store.Delete(storagePath)
+		return nil
+	}
+
+	newOffset := upload.UploadOffset + body.n
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Only advance the offset if nobody else has in the meantime
+		result := tx.Model(&models.Upload{}).
+			Where("id = ? AND upload_offset = ?", upload.ID, upload.UploadOffset).
+			Update("upload_offset", newOffset)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusConflict, "Upload was modified by another request")
+		}
+
+		return tx.Create(&models.UploadChunk{
+			UploadID:    upload.ID,
+			StartOffset: upload.UploadOffset,
+			Size:        body.n,
+			StoragePath: storagePath,
+		}).Error
+	})
+	if err != nil {
+		_ = store.Delete(storagePath)
+		if _, ok := err.(*fiber.Error); ok {
+			return err
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save chunk")
+	}
+
+	upload.UploadOffset = newOffset
+	return nil
+}
+
+// finalizeUpload assembles the chunks of a complete upload into a paste. The
+// upload is claimed first, so that concurrent requests completing it don't
+// each create a paste.
+func (s *UploadService) finalizeUpload(c *fiber.Ctx, upload *models.Upload) error {
+	result := s.db.Model(&models.Upload{}).
+		Where("id = ? AND paste_id = ?", upload.ID, "").
+		Update("paste_id", assemblingPasteID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return s.claimedUpload(upload)
+	}
+
+	paste, chunks, err := s.assembleUpload(c, upload)
+	if err != nil {
+		// Give up the claim so the client can retry
+		if err := s.db.Model(&models.Upload{}).
+			Where("id = ? AND paste_id = ?", upload.ID, assemblingPasteID).
+			Update("paste_id", "").Error; err != nil {
+			s.logger.Error("failed to release upload",
+				zap.String("id", upload.ID),
+				zap.Error(err),
+			)
+		}
+		return err
+	}
+
+	upload.PasteID = paste.ID
+	if err := s.db.Model(upload).Update("paste_id", paste.ID).Error; err != nil {
+		return err
+	}
+
+	// The chunks are no longer needed now that they've been copied into the paste
+	s.deleteChunks(upload, chunks)
+	if err := s.db.Where("upload_id = ?", upload.ID).Delete(&models.UploadChunk{}).Error; err != nil {
+		s.logger.Error("failed to delete upload chunk records",
+			zap.String("id", upload.ID),
+			zap.Error(err),
+		)
+	}
+
+	response := NewPasteResponse(paste, s.config.Server.BaseURL)
+	c.Set("Upload-Paste-URL", response.URL)
+	c.Set("Upload-Paste-Delete-URL", response.DeleteURL)
+	return nil
+}
+
+// claimedUpload handles a complete upload that another request has already
+// claimed. Once that request has created the paste, the upload is reported
+// as finished; until then the request conflicts with it.
+func (s *UploadService) claimedUpload(upload *models.Upload) error {
+	var current models.Upload
+	if err := s.db.Select("paste_id").Where("id = ?", upload.ID).First(&current).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "Upload not found or expired")
+		}
+		return err
+	}
+
+	if current.PasteID == assemblingPasteID {
+		return fiber.NewError(fiber.StatusConflict, "Upload is already being assembled by another request")
+	}
+	upload.PasteID = current.PasteID
+	return nil
+}
+
+// assembleUpload creates a paste from the chunks of a complete upload, and
+// returns it along with the chunks it was created from
+func (s *UploadService) assembleUpload(c *fiber.Ctx, upload *models.Upload) (*models.Paste, []models.UploadChunk, error) {
+	// Only apply the key the upload was started with, findUpload has already
+	// made sure the request carries the same one
+	var apiKey *models.APIKey
+	if upload.APIKey != "" {
+		apiKey = c.Locals("apiKey").(*models.APIKey)
+	}
+
+	var chunks []models.UploadChunk
+	if err := s.db.Where("upload_id = ?", upload.ID).Order("start_offset ASC").Find(&chunks).Error; err != nil {
+		return nil, nil, err
+	}
+
+	opts, err := uploadPasteOptions(upload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := s.paste.storeFor(upload.StorageName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content := &chunkReader{storage: store, chunks: chunks}
+	defer content.Close()
+
+	paste, err := s.paste.createPaste(content, upload.UploadLength, apiKey, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paste, chunks, nil
+}
+
+// deleteUpload removes an upload, its chunk records and its stored chunks
+func (s *UploadService) deleteUpload(upload *models.Upload) error {
+	var chunks []models.UploadChunk
+	if err := s.db.Where("upload_id = ?", upload.ID).Find(&chunks).Error; err != nil {
+		return err
+	}
+
+	s.deleteChunks(upload, chunks)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&models.UploadChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(upload).Error
+	})
+}
+
+// deleteChunks removes the stored chunks of an upload
+func (s *UploadService) deleteChunks(upload *models.Upload, chunks []models.UploadChunk) {
+	store, err := s.paste.storeFor(upload.StorageName)
+	if err != nil {
+		return
+	}
+
+	for _, chunk := range chunks {
+		if err := store.Delete(chunk.StoragePath); err != nil {
+			s.logger.Error("failed to delete upload chunk",
+				zap.String("upload_id", chunk.UploadID),
+				zap.String("path", chunk.StoragePath),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (s *UploadService) setUploadHeaders(c *fiber.Ctx, upload *models.Upload) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.PasteID != "" && upload.PasteID != assemblingPasteID {
+		c.Set("Upload-Paste-URL", fmt.Sprintf("%s/p/%s", s.config.Server.BaseURL, upload.PasteID))
+	}
+}
+
+func (s *UploadService) uploadExpiry() time.Duration {
+	if expiry := s.config.Server.ResumableUploads.Expiry; expiry > 0 {
+		return expiry
+	}
+	return defaultUploadExpiry
+}
+
+// rejectChunk closes the connection after responding to a PATCH request that
+// failed before its body was fully read, so the unread bytes aren't mistaken
+// for the start of the next request
+func rejectChunk(c *fiber.Ctx, err error) error {
+	c.Context().SetConnectionClose()
+	return err
+}
+
+// uploadPasteOptions converts an upload's metadata into options for createPaste
+func uploadPasteOptions(upload *models.Upload) (*PasteOptions, error) {
+	opts := &PasteOptions{
+		Filename:  upload.Filename,
+		Extension: upload.Extension,
+		Private:   upload.Private,
+	}
+
+	if upload.ExpiresIn != "" {
+		expiresIn, err := hdur.ParseDuration(upload.ExpiresIn)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid expires_in value")
+		}
+		opts.ExpiresIn = &expiresIn
+	}
+
+	return opts, nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, which is a comma
+// separated list of keys and base64 encoded values
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// chunkReader streams a sequence of stored chunks as a single reader, only
+// opening each chunk once the previous one has been exhausted
+type chunkReader struct {
+	storage storage.Provider
+	chunks  []models.UploadChunk
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			current, err := r.storage.Open(r.chunks[0].StoragePath)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open chunk: %w", err)
+			}
+			r.current = current
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
@@ -1,19 +1,30 @@
 package tests
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
 	"github.com/watzon/0x45/internal/server/services"
 	"github.com/watzon/0x45/internal/server/tests/testutils"
 )
@@ -397,3 +408,961 @@ func TestPasteWithExpiresIn(t *testing.T) {
 		})
 	}
 }
+
+func TestMultipartFileUpload(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	uploadTestData := []struct {
+		name           string
+		filename       string
+		content        string
+		expectedStatus int
+		withAuth       bool
+	}{
+		{
+			name:           "Small text file",
+			filename:       "small.txt",
+			content:        "test content",
+			expectedStatus: 200,
+		},
+		{
+			name:           "File larger than the MIME sniffing window",
+			filename:       "large.log",
+			content:        strings.Repeat("0123456789abcdef\n", 64*1024), // ~1MB
+			expectedStatus: 200,
+		},
+		{
+			name:           "File within API limit",
+			filename:       "api.txt",
+			content:        strings.Repeat("a", 1024*1024*7), // 7MB
+			expectedStatus: 200,
+			withAuth:       true,
+		},
+		{
+			name:           "File exceeding default limit",
+			filename:       "huge.txt",
+			content:        strings.Repeat("a", 1024*1024*6), // 6MB
+			expectedStatus: 400,
+		},
+		{
+			name:           "Empty file",
+			filename:       "empty.txt",
+			content:        "",
+			expectedStatus: 400,
+		},
+	}
+
+	for _, tt := range uploadTestData {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create multipart form with a file part
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+
+			part, err := writer.CreateFormFile("file", tt.filename)
+			require.NoError(t, err)
+			_, err = part.Write([]byte(tt.content))
+			require.NoError(t, err)
+			writer.Close()
+
+			req := httptest.NewRequest("POST", "/p/", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			if tt.withAuth {
+				req.Header.Set("Authorization", "Bearer test-api-key")
+			}
+
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+
+			if resp.StatusCode != tt.expectedStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Logf("Response body: %s", string(body))
+			}
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+
+			if tt.expectedStatus != 200 {
+				return
+			}
+
+			var paste services.PasteResponse
+			err = json.NewDecoder(resp.Body).Decode(&paste)
+			require.NoError(t, err)
+			assert.Equal(t, tt.filename, paste.Filename)
+			assert.Equal(t, int64(len(tt.content)), paste.Size)
+
+			// The stored content should round-trip intact
+			rawReq := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", paste.ID), nil)
+			rawResp, err := env.App.Test(rawReq, -1)
+			require.NoError(t, err)
+			assert.Equal(t, 200, rawResp.StatusCode)
+
+			raw, err := io.ReadAll(rawResp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.content, string(raw))
+		})
+	}
+}
+
+func TestMultiFilePaste(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	files := []struct {
+		filename string
+		content  string
+	}{
+		{filename: "main.go", content: "package main\n\nfunc main() {}\n"},
+		{filename: "go.mod", content: "module example.com/repro\n"},
+		{filename: "output.log", content: "panic: something went wrong\n"},
+	}
+
+	upload := func(t *testing.T, names ...string) *http.Response {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for i, name := range names {
+			part, err := writer.CreateFormFile("file", name)
+			require.NoError(t, err)
+			_, err = part.Write([]byte(files[i%len(files)].content))
+			require.NoError(t, err)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/p/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Duplicate filenames", func(t *testing.T) {
+		resp := upload(t, "main.go", "main.go")
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.filename
+	}
+	resp := upload(t, names...)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var paste services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+	require.Len(t, paste.Files, len(files))
+	assert.Equal(t, "main.go", paste.Filename)
+
+	var total int64
+	for _, f := range files {
+		total += int64(len(f.content))
+	}
+	assert.Equal(t, total, paste.Size)
+
+	t.Run("Per-file raw URLs", func(t *testing.T) {
+		for i, f := range files {
+			assert.Equal(t, f.filename, paste.Files[i].Filename)
+
+			req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/files/%s", paste.ID, f.filename), nil)
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+
+			raw, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, f.content, string(raw))
+		}
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/files/missing.txt", paste.ID), nil)
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Zip download", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/download", paste.ID), nil)
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		require.Len(t, archive.File, len(files))
+
+		for i, entry := range archive.File {
+			assert.Equal(t, files[i].filename, entry.Name)
+
+			r, err := entry.Open()
+			require.NoError(t, err)
+			content, err := io.ReadAll(r)
+			r.Close()
+			require.NoError(t, err)
+			assert.Equal(t, files[i].content, string(content))
+		}
+	})
+
+	t.Run("HTML view", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s", paste.ID), nil)
+		req.Header.Set("Accept", "application/xhtml+xml")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		html, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		for _, f := range files {
+			assert.Contains(t, string(html), f.filename)
+		}
+	})
+}
+
+func TestPasteRevisions(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	// A second key that isn't allowed to update pastes
+	require.NoError(t, env.DB.Create(&models.APIKey{Email: "other@example.com", Key: "no-updates-key", Verified: true}).Error)
+	require.NoError(t, env.DB.Model(&models.APIKey{}).Where("key = ?", "no-updates-key").Update("allow_updates", false).Error)
+
+	request := func(method, target, body, apiKey string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	readBody := func(resp *http.Response) string {
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	resp := request("POST", "/p/", `{"content": "first version", "filename": "notes.txt"}`, "test-api-key")
+	require.Equal(t, 200, resp.StatusCode)
+
+	var paste services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+	assert.Equal(t, 1, paste.Revision)
+
+	anonResp := request("POST", "/p/", `{"content": "anonymous"}`, "")
+	require.Equal(t, 200, anonResp.StatusCode)
+	var anonPaste services.PasteResponse
+	require.NoError(t, json.NewDecoder(anonResp.Body).Decode(&anonPaste))
+
+	updateTests := []struct {
+		name           string
+		id             string
+		apiKey         string
+		expectedStatus int
+	}{
+		{
+			name:           "Without API key",
+			id:             paste.ID,
+			expectedStatus: 401,
+		},
+		{
+			name:           "Key that doesn't own the paste",
+			id:             anonPaste.ID,
+			apiKey:         "test-api-key",
+			expectedStatus: 403,
+		},
+		{
+			name:           "Key without update permission",
+			id:             paste.ID,
+			apiKey:         "no-updates-key",
+			expectedStatus: 403,
+		},
+		{
+			name:           "Owner",
+			id:             paste.ID,
+			apiKey:         "test-api-key",
+			expectedStatus: 200,
+		},
+	}
+
+	for _, tt := range updateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := request("PUT", "/p/"+tt.id, `{"content": "second version"}`, tt.apiKey)
+			if resp.StatusCode != tt.expectedStatus {
+				t.Logf("Response body: %s", readBody(resp))
+			}
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+
+	t.Run("Latest content is served and revalidated", func(t *testing.T) {
+		resp := request("GET", fmt.Sprintf("/p/%s/raw", paste.ID), "", "")
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "second version", readBody(resp))
+		assert.NotContains(t, resp.Header.Get("Cache-Control"), "immutable")
+	})
+
+	t.Run("Prior revisions stay addressable", func(t *testing.T) {
+		for number, content := range map[int]string{1: "first version", 2: "second version"} {
+			resp := request("GET", fmt.Sprintf("/p/%s/rev/%d/raw", paste.ID, number), "", "")
+			require.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, content, readBody(resp))
+			assert.Contains(t, resp.Header.Get("Cache-Control"), "immutable")
+		}
+
+		resp := request("GET", fmt.Sprintf("/p/%s/rev/3/raw", paste.ID), "", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Revision picker", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/rev/1", paste.ID), nil)
+		req.Header.Set("Accept", "application/xhtml+xml")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		html := readBody(resp)
+		assert.Contains(t, html, fmt.Sprintf("/p/%s/rev/2", paste.ID))
+		assert.Contains(t, html, fmt.Sprintf("/p/%s/rev/1/raw", paste.ID))
+	})
+}
+
+func TestPasteDiff(t *testing.T) {
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.MaxDiffSize = 64
+	})
+	defer env.CleanupFn()
+
+	request := func(method, target, body string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	upload := func(content string) services.PasteResponse {
+		body, err := json.Marshal(map[string]string{"content": content, "filename": "app.yaml"})
+		require.NoError(t, err)
+		resp := request("POST", "/p/", string(body), map[string]string{
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer test-api-key",
+		})
+		require.Equal(t, 200, resp.StatusCode)
+
+		var paste services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+		return paste
+	}
+
+	before := upload("name: app\nreplicas: 1\nport: 8080\n")
+	after := upload("name: app\nreplicas: 3\nport: 8080\n")
+	large := upload(strings.Repeat("replicas: 3\n", 8))
+
+	// Give the first paste a second revision to diff against
+	resp := request("PUT", "/p/"+before.ID, `{"content": "name: app\nport: 9090\n"}`, map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer test-api-key",
+	})
+	require.Equal(t, 200, resp.StatusCode)
+
+	diffTests := []struct {
+		name           string
+		path           string
+		accept         string
+		expectedStatus int
+		contains       []string
+		immutable      bool
+	}{
+		{
+			name:           "Raw diff between pastes",
+			path:           fmt.Sprintf("/p/%s@1/diff/%s/raw", before.ID, after.ID),
+			expectedStatus: 200,
+			contains:       []string{"-replicas: 1", "+replicas: 3"},
+		},
+		{
+			name:           "Plain clients get the raw diff",
+			path:           fmt.Sprintf("/p/%s@1/diff/%s@2", before.ID, before.ID),
+			expectedStatus: 200,
+			contains:       []string{"-replicas: 1", "-port: 8080", "+port: 9090"},
+			immutable:      true,
+		},
+		{
+			name:           "Unified HTML view",
+			path:           fmt.Sprintf("/p/%s@1/diff/%s@2", before.ID, before.ID),
+			accept:         "application/xhtml+xml",
+			expectedStatus: 200,
+			contains:       []string{"replicas", "?view=split"},
+			immutable:      true,
+		},
+		{
+			name:           "Split HTML view",
+			path:           fmt.Sprintf("/p/%s@1/diff/%s?view=split", before.ID, after.ID),
+			accept:         "application/xhtml+xml",
+			expectedStatus: 200,
+			contains:       []string{"diff-table", "diff-replace"},
+		},
+		{
+			name:           "Missing revision",
+			path:           fmt.Sprintf("/p/%s@5/diff/%s", before.ID, after.ID),
+			expectedStatus: 404,
+		},
+		{
+			name:           "Invalid revision",
+			path:           fmt.Sprintf("/p/%s@latest/diff/%s", before.ID, after.ID),
+			expectedStatus: 400,
+		},
+		{
+			name:           "Paste too large to diff",
+			path:           fmt.Sprintf("/p/%s@1/diff/%s/raw", before.ID, large.ID),
+			expectedStatus: 413,
+		},
+	}
+
+	for _, tt := range diffTests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.accept != "" {
+				headers["Accept"] = tt.accept
+			}
+			resp := request("GET", tt.path, "", headers)
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			if resp.StatusCode != tt.expectedStatus {
+				t.Logf("Response body: %s", string(body))
+			}
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+
+			if tt.expectedStatus != 200 {
+				return
+			}
+			if tt.accept == "" {
+				assert.Contains(t, resp.Header.Get("Content-Type"), "text/x-diff")
+			}
+			for _, s := range tt.contains {
+				assert.Contains(t, string(body), s)
+			}
+			assert.Equal(t, tt.immutable, strings.Contains(resp.Header.Get("Cache-Control"), "immutable"))
+		})
+	}
+}
+
+func TestViewLimitedPastes(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	upload := func(t *testing.T, body string) (*http.Response, services.PasteResponse) {
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+
+		var paste services.PasteResponse
+		if resp.StatusCode == 200 {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+		}
+		return resp, paste
+	}
+
+	get := func(t *testing.T, target, accept string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Invalid options", func(t *testing.T) {
+		resp, _ := upload(t, `{"content": "secret", "max_views": -1}`)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		resp, _ = upload(t, `{"content": "secret", "burn_after_read": true, "max_views": 3}`)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
+	t.Run("Burn after read", func(t *testing.T) {
+		resp, paste := upload(t, `{"content": "hunter2", "burn_after_read": true}`)
+		require.Equal(t, 200, resp.StatusCode)
+		require.NotNil(t, paste.MaxViews)
+		assert.Equal(t, 1, *paste.MaxViews)
+
+		// Opening the page in a browser doesn't use up the view
+		resp = get(t, "/p/"+paste.ID, "text/html,application/xhtml+xml")
+		require.Equal(t, 200, resp.StatusCode)
+		page, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(page), "hunter2")
+		assert.Equal(t, 404, get(t, fmt.Sprintf("/p/%s/image", paste.ID), "").StatusCode)
+
+		resp = get(t, fmt.Sprintf("/p/%s/raw", paste.ID), "")
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "private, no-store", resp.Header.Get("Cache-Control"))
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hunter2", string(content))
+
+		assert.Equal(t, 404, get(t, fmt.Sprintf("/p/%s/raw", paste.ID), "").StatusCode)
+
+		// The content is deleted straight away
+		var burned models.Paste
+		require.NoError(t, env.DB.Unscoped().First(&burned, "id = ?", paste.ID).Error)
+		assert.True(t, burned.DeletedAt.Valid)
+		_, err = os.Stat(diskPath(env, burned.StoragePath))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Concurrent readers share the view limit", func(t *testing.T) {
+		const maxViews = 3
+		const readers = 10
+
+		resp, paste := upload(t, fmt.Sprintf(`{"content": "shared secret", "max_views": %d}`, maxViews))
+		require.Equal(t, 200, resp.StatusCode)
+
+		var wg sync.WaitGroup
+		statuses := make(chan int, readers)
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/download", paste.ID), nil)
+				resp, err := env.App.Test(req, -1)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		served := 0
+		for status := range statuses {
+			if status == 200 {
+				served++
+			}
+		}
+		assert.Equal(t, maxViews, served)
+	})
+}
+
+func TestPasswordProtectedPastes(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(`{"content": "top secret", "password": "opensesame"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var paste services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+	rawURL := fmt.Sprintf("/p/%s/raw", paste.ID)
+
+	tests := []struct {
+		name           string
+		setup          func(req *http.Request)
+		expectedStatus int
+	}{
+		{
+			name:           "No password",
+			setup:          func(req *http.Request) {},
+			expectedStatus: 401,
+		},
+		{
+			name: "Password header",
+			setup: func(req *http.Request) {
+				req.Header.Set(services.PastePasswordHeader, "opensesame")
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "Basic auth",
+			setup: func(req *http.Request) {
+				req.SetBasicAuth("", "opensesame")
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "Wrong password",
+			setup: func(req *http.Request) {
+				req.Header.Set(services.PastePasswordHeader, "letmein")
+			},
+			expectedStatus: 401,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", rawURL, nil)
+			tt.setup(req)
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, "private, no-store", resp.Header.Get("Cache-Control"))
+				content, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "top secret", string(content))
+			} else {
+				assert.Equal(t, `Basic realm="paste"`, resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	t.Run("Image is not rendered", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/image", paste.ID), nil)
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("Unlock in the browser", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/p/"+paste.ID, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode)
+		page, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(page), fmt.Sprintf("/p/%s/unlock", paste.ID))
+		assert.NotContains(t, string(page), "top secret")
+
+		unlock := func(password, next string) *http.Response {
+			form := url.Values{"password": {password}, "next": {next}}
+			req := httptest.NewRequest("POST", fmt.Sprintf("/p/%s/unlock", paste.ID), strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+			return resp
+		}
+
+		resp = unlock("letmein", rawURL)
+		assert.Equal(t, 401, resp.StatusCode)
+		assert.Empty(t, resp.Cookies())
+
+		// Redirects are limited to pages of the paste
+		resp = unlock("opensesame", "https://example.com/")
+		require.Equal(t, 303, resp.StatusCode)
+		assert.Equal(t, "/p/"+paste.ID, resp.Header.Get("Location"))
+
+		resp = unlock("opensesame", rawURL)
+		require.Equal(t, 303, resp.StatusCode)
+		assert.Equal(t, rawURL, resp.Header.Get("Location"))
+		cookies := resp.Cookies()
+		require.Len(t, cookies, 1)
+
+		req = httptest.NewRequest("GET", rawURL, nil)
+		req.AddCookie(cookies[0])
+		resp, err = env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		// A forged cookie is ignored
+		req = httptest.NewRequest("GET", rawURL, nil)
+		req.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: "forged"})
+		resp, err = env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(`{"content": "public"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var other services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&other))
+		diffURL := fmt.Sprintf("/p/%s@1/diff/%s@1", other.ID, paste.ID)
+
+		req = httptest.NewRequest("GET", diffURL, nil)
+		resp, err = env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+		assert.Equal(t, `Basic realm="paste"`, resp.Header.Get("WWW-Authenticate"))
+
+		// Browsers get the form to unlock the protected side
+		req = httptest.NewRequest("GET", diffURL, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		resp, err = env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 401, resp.StatusCode)
+		page, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(page), fmt.Sprintf("/p/%s/unlock", paste.ID))
+
+		// Even when pinned, a diff of a protected paste isn't kept by shared caches
+		req = httptest.NewRequest("GET", diffURL, nil)
+		req.SetBasicAuth("", "opensesame")
+		resp, err = env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "private, no-store", resp.Header.Get("Cache-Control"))
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "+top secret")
+	})
+}
+
+func TestEncryptedPastes(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	// Encrypt the content the way clients do, keeping the key to ourselves
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	plaintext := "# secret plans\nfunc main() {}\n"
+	envelope, err := json.Marshal(services.Envelope{
+		Version:    1,
+		Algorithm:  "AES-GCM",
+		IV:         base64.RawURLEncoding.EncodeToString(iv),
+		Ciphertext: base64.RawURLEncoding.EncodeToString(gcm.Seal(nil, iv, []byte(plaintext), nil)),
+	})
+	require.NoError(t, err)
+
+	upload := func(t *testing.T, content string) (*http.Response, services.PasteResponse) {
+		body, err := json.Marshal(map[string]any{
+			"content":   content,
+			"encrypted": true,
+			"filename":  "plans.md",
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("POST", "/p/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+
+		var paste services.PasteResponse
+		if resp.StatusCode == 200 {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+		}
+		return resp, paste
+	}
+
+	get := func(t *testing.T, target, accept string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Invalid envelopes", func(t *testing.T) {
+		for _, content := range []string{
+			plaintext,
+			`{"v": 2, "alg": "AES-GCM", "iv": "AAAAAAAAAAAAAAAA", "ct": "AAAAAAAAAAAAAAAAAAAAAA"}`,
+			`{"v": 1, "alg": "AES-GCM", "iv": "AAAA", "ct": "AAAAAAAAAAAAAAAAAAAAAA"}`,
+			`{"v": 1, "alg": "AES-GCM", "iv": "AAAAAAAAAAAAAAAA", "ct": "AAAAAAAAAAAAAAAAAAAAAA", "filename": "plans.md"}`,
+		} {
+			resp, _ := upload(t, content)
+			assert.Equal(t, 400, resp.StatusCode, content)
+		}
+	})
+
+	resp, paste := upload(t, string(envelope))
+	require.Equal(t, 200, resp.StatusCode)
+	assert.True(t, paste.Encrypted)
+	assert.Equal(t, services.EncryptedMimeType, paste.MimeType)
+	assert.NotContains(t, paste.Filename, "plans")
+	assert.Equal(t, "/p/"+paste.ID, strings.TrimPrefix(paste.URL, env.Config.Server.BaseURL))
+
+	t.Run("Raw content is the envelope", func(t *testing.T) {
+		resp := get(t, fmt.Sprintf("/p/%s/raw", paste.ID), "")
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, services.EncryptedMimeType, resp.Header.Get("Content-Type"))
+
+		var stored services.Envelope
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stored))
+		iv, err := base64.RawURLEncoding.DecodeString(stored.IV)
+		require.NoError(t, err)
+		ciphertext, err := base64.RawURLEncoding.DecodeString(stored.Ciphertext)
+		require.NoError(t, err)
+		decrypted, err := gcm.Open(nil, iv, ciphertext, nil)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, string(decrypted))
+	})
+
+	t.Run("JSON view has no content", func(t *testing.T) {
+		resp := get(t, "/p/"+paste.ID, "application/vnd.0x45.paste+json")
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "", body["content"])
+		assert.Equal(t, true, body["encrypted"])
+	})
+
+	t.Run("HTML view decrypts in the browser", func(t *testing.T) {
+		resp := get(t, "/p/"+paste.ID, "text/html,application/xhtml+xml")
+		require.Equal(t, 200, resp.StatusCode)
+		page, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(page), `id="encrypted-paste"`)
+		assert.Contains(t, string(page), "data-envelope=")
+		assert.NotContains(t, string(page), fmt.Sprintf("/p/%s/image", paste.ID))
+	})
+
+	t.Run("Server side rendering is unavailable", func(t *testing.T) {
+		assert.Equal(t, 404, get(t, fmt.Sprintf("/p/%s/image", paste.ID), "").StatusCode)
+		assert.Equal(t, 400, get(t, fmt.Sprintf("/p/%s/preview", paste.ID), "").StatusCode)
+		assert.Equal(t, 400, get(t, fmt.Sprintf("/p/%s/diff/%s", paste.ID, paste.ID), "").StatusCode)
+	})
+}
+
+func TestRangeAndConditionalRequests(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	content := strings.Repeat("0123456789", 100)
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var created services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	rawURL := fmt.Sprintf("/p/%s/raw", created.ID)
+
+	get := func(t *testing.T, target string, headers map[string]string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp = get(t, rawURL, nil)
+	require.Equal(t, 200, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, etag)
+	assert.NotEmpty(t, lastModified)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	t.Run("Ranges are served as partial content", func(t *testing.T) {
+		tests := []struct {
+			header       string
+			contentRange string
+			body         string
+		}{
+			{"bytes=10-19", "bytes 10-19/1000", content[10:20]},
+			{"bytes=995-", "bytes 995-999/1000", content[995:]},
+			{"bytes=-3", "bytes 997-999/1000", content[997:]},
+			{"bytes=990-2000", "bytes 990-999/1000", content[990:]},
+		}
+		for _, tt := range tests {
+			resp := get(t, rawURL, map[string]string{"Range": tt.header})
+			require.Equal(t, 206, resp.StatusCode, tt.header)
+			assert.Equal(t, tt.contentRange, resp.Header.Get("Content-Range"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		}
+	})
+
+	t.Run("Unsatisfiable ranges are rejected", func(t *testing.T) {
+		resp := get(t, rawURL, map[string]string{"Range": "bytes=1000-"})
+		assert.Equal(t, 416, resp.StatusCode)
+		assert.Equal(t, "bytes */1000", resp.Header.Get("Content-Range"))
+	})
+
+	t.Run("If-Range only applies ranges to the same content", func(t *testing.T) {
+		resp := get(t, rawURL, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+		assert.Equal(t, 206, resp.StatusCode)
+
+		resp = get(t, rawURL, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+
+	t.Run("Conditional requests are answered with Not Modified", func(t *testing.T) {
+		resp := get(t, rawURL, map[string]string{"If-None-Match": etag})
+		assert.Equal(t, 304, resp.StatusCode)
+
+		resp = get(t, rawURL, map[string]string{"If-None-Match": `"stale"`})
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp = get(t, rawURL, map[string]string{"If-Modified-Since": lastModified})
+		assert.Equal(t, 304, resp.StatusCode)
+
+		resp = get(t, rawURL, map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)})
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Pinned revisions are dated by their own content", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(`{"content": "first version"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-api-key")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var paste services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&paste))
+
+		for _, content := range []string{"second version", "third version"} {
+			req := httptest.NewRequest("PUT", "/p/"+paste.ID, strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer test-api-key")
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+		}
+
+		// Spread the revisions out, so each is dated differently
+		created := map[int]time.Time{
+			1: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			2: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		}
+		for number, createdAt := range created {
+			require.NoError(t, env.DB.Model(&models.PasteRevision{}).
+				Where("paste_id = ? AND number = ?", paste.ID, number).
+				Update("created_at", createdAt).Error)
+		}
+		require.NoError(t, env.DB.Model(&models.Paste{}).Where("id = ?", paste.ID).
+			Update("revised_at", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)).Error)
+
+		resp = get(t, fmt.Sprintf("/p/%s/rev/2/raw", paste.ID), nil)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, created[2].Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+	})
+
+	t.Run("Downloads support ranges", func(t *testing.T) {
+		resp := get(t, fmt.Sprintf("/p/%s/download", created.ID), map[string]string{"Range": "bytes=0-4"})
+		require.Equal(t, 206, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content[:5], string(body))
+	})
+}
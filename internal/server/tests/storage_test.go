@@ -0,0 +1,961 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/server/services"
+	"github.com/watzon/0x45/internal/server/tests/testutils"
+	"github.com/watzon/0x45/internal/storage"
+	"github.com/watzon/0x45/internal/storage/local"
+)
+
+func newEncryptionKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// diskPath returns where content stored in the test environment's local
+// storage is on disk, without the markers of encryption and compression
+func diskPath(env *testutils.TestEnv, storagePath string) string {
+	return filepath.Join(env.TempDir, storagePath[strings.LastIndex(storagePath, ":")+1:])
+}
+
+func TestStorageEncryptionAtRest(t *testing.T) {
+	oldKey := newEncryptionKey(t)
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		cfg.Storage[0].EncryptionKey = oldKey
+	})
+	defer env.CleanupFn()
+
+	const content = "2024-01-01 12:00:00 customer@example.com logged in\n"
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var created services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, int64(len(content)), created.Size)
+
+	var paste models.Paste
+	require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+	// Text is compressed before it's encrypted
+	require.True(t, strings.HasPrefix(paste.StoragePath, "gz:enc:"))
+
+	// The path carries the wrapped data key, the file on disk is at the end
+	innerPath := paste.StoragePath[strings.LastIndex(paste.StoragePath, ":")+1:]
+
+	t.Run("Content is encrypted on disk", func(t *testing.T) {
+		stored, err := os.ReadFile(filepath.Join(env.TempDir, innerPath))
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), "customer@example.com")
+	})
+
+	t.Run("Content is decrypted when served", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", created.ID), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+
+	t.Run("Rotating the key rewraps stored paths", func(t *testing.T) {
+		newKey := newEncryptionKey(t)
+		rotatedCfg := *env.Config
+		rotatedCfg.Storage = []config.StorageConfig{env.Config.Storage[0]}
+		rotatedCfg.Storage[0].EncryptionKey = newKey
+		rotatedCfg.Storage[0].EncryptionPreviousKeys = []string{oldKey}
+
+		rotatedStorage, err := storage.NewStorageManager(&rotatedCfg)
+		require.NoError(t, err)
+		rotated := services.NewPasteService(env.DB.DB, env.Logger, &rotatedCfg, rotatedStorage)
+		count, err := rotated.RewrapStorageKeys()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		var updated models.Paste
+		require.NoError(t, env.DB.First(&updated, "id = ?", created.ID).Error)
+		assert.NotEqual(t, paste.StoragePath, updated.StoragePath)
+		assert.True(t, strings.HasSuffix(updated.StoragePath, ":"+innerPath))
+
+		// Nothing is left to rewrap
+		count, err = rotated.RewrapStorageKeys()
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+
+		// The new key alone is enough to read the content
+		inner, err := local.New(env.TempDir, "", true, local.Options{})
+		require.NoError(t, err)
+		encrypted, err := storage.NewEncryptedStore(inner, newKey, nil)
+		require.NoError(t, err)
+		store := storage.NewCompressedStore(encrypted)
+
+		reader, err := store.Get(updated.StoragePath)
+		require.NoError(t, err)
+		defer reader.Close()
+		body, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+}
+
+func TestContentDeduplication(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	const content = "the same content, uploaded twice\n"
+	create := func(t *testing.T, content string) models.Paste {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		return paste
+	}
+
+	first := create(t, content)
+	second := create(t, content)
+	other := create(t, "something else entirely\n")
+
+	t.Run("Identical content is stored once", func(t *testing.T) {
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.NotEqual(t, first.DeleteKey, second.DeleteKey)
+		assert.Equal(t, first.StoragePath, second.StoragePath)
+		assert.NotEqual(t, first.StoragePath, other.StoragePath)
+
+		var blob models.Blob
+		require.NoError(t, env.DB.First(&blob, "storage_path = ?", first.StoragePath).Error)
+		assert.Equal(t, int64(2), blob.RefCount)
+		assert.Equal(t, int64(len(content)), blob.Size)
+
+		// Only the two distinct pieces of content are on disk
+		var files int
+		err := filepath.WalkDir(env.TempDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && (d.Name() == "views" || d.Name() == "public") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && !strings.Contains(d.Name(), ".db") {
+				files++
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, files)
+	})
+
+	t.Run("Stats report logical and physical size", func(t *testing.T) {
+		stats, err := services.NewStatsService(env.DB.DB, env.Logger, env.Config, env.Storage).GetSystemStats()
+		require.NoError(t, err)
+
+		current := stats["current"].(fiber.Map)
+		logical := uint64(2*len(content) + len("something else entirely\n"))
+		assert.Equal(t, logical, current["storage"])
+		assert.Equal(t, logical-uint64(len(content)), current["physicalStorage"])
+	})
+
+	t.Run("Shared content outlives the first paste", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("DELETE", fmt.Sprintf("/p/%s/%s", first.ID, first.DeleteKey), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		resp, err = env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", second.ID), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+
+		var blob models.Blob
+		require.NoError(t, env.DB.First(&blob, "storage_path = ?", second.StoragePath).Error)
+		assert.Equal(t, int64(1), blob.RefCount)
+	})
+
+	t.Run("Content is deleted with the last paste", func(t *testing.T) {
+		require.NoError(t, env.DB.Model(&models.Paste{}).
+			Where("id = ?", second.ID).
+			Update("expires_at", time.Now().Add(-time.Hour)).Error)
+
+		deleted, err := services.NewPasteService(env.DB.DB, env.Logger, env.Config, env.Storage).CleanupExpired()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+
+		var count int64
+		require.NoError(t, env.DB.Model(&models.Blob{}).Where("storage_path = ?", second.StoragePath).Count(&count).Error)
+		assert.Zero(t, count)
+
+		_, err = os.Stat(diskPath(env, second.StoragePath))
+		assert.True(t, os.IsNotExist(err))
+
+		// Other content is untouched
+		_, err = os.Stat(diskPath(env, other.StoragePath))
+		assert.NoError(t, err)
+	})
+}
+
+func TestCompressionAtRest(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	upload := func(t *testing.T, filename, content string) models.Paste {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", filename)
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest("POST", "/p/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		assert.Equal(t, int64(len(content)), created.Size)
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		return paste
+	}
+
+	logs := strings.Repeat("2024-01-01 12:00:00 INFO request handled in 3ms\n", 500)
+	text := upload(t, "server.log", logs)
+	image := upload(t, "pixel.png", string([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}))
+
+	t.Run("Text is compressed at rest", func(t *testing.T) {
+		assert.Equal(t, int64(len(logs)), text.Size)
+
+		stored, err := os.ReadFile(diskPath(env, text.StoragePath))
+		require.NoError(t, err)
+		assert.Less(t, len(stored), len(logs)/10)
+	})
+
+	t.Run("Binary content is stored as is", func(t *testing.T) {
+		stored, err := os.ReadFile(diskPath(env, image.StoragePath))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}, stored)
+	})
+
+	t.Run("Compressed content is served to clients that accept it", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", text.ID), nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Contains(t, resp.Header.Get("Vary"), "Accept-Encoding")
+
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, logs, string(body))
+	})
+
+	t.Run("Content is decompressed for other clients", func(t *testing.T) {
+		for _, accept := range []string{"", "identity"} {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", text.ID), nil)
+			if accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			}
+			resp, err := env.App.Test(req, -1)
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, logs, string(body))
+		}
+	})
+
+	t.Run("Stats report the compressed size", func(t *testing.T) {
+		stats, err := services.NewStatsService(env.DB.DB, env.Logger, env.Config, env.Storage).GetSystemStats()
+		require.NoError(t, err)
+
+		current := stats["current"].(fiber.Map)
+		logical := uint64(text.Size + image.Size)
+		assert.Equal(t, logical, current["storage"])
+		assert.Equal(t, logical, current["physicalStorage"])
+		assert.Less(t, current["compressedStorage"], uint64(len(logs)/10))
+	})
+}
+
+func TestMultipleStorages(t *testing.T) {
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		// Pastes from before the default was changed are in the archive
+		cfg.Storage = append(cfg.Storage, config.StorageConfig{
+			Name: "archive",
+			Type: "local",
+			Path: filepath.Join(cfg.Storage[0].Path, "archive"),
+		})
+	})
+	defer env.CleanupFn()
+
+	const content = "written before the default storage changed\n"
+	archive, err := env.Storage.GetStore("archive")
+	require.NoError(t, err)
+	path, err := archive.Save(strings.NewReader(content), "old.txt")
+	require.NoError(t, err)
+
+	old := models.Paste{
+		Filename:    "old.txt",
+		MimeType:    "text/plain; charset=utf-8",
+		Size:        int64(len(content)),
+		StorageName: "archive",
+		StorageType: "local",
+		StoragePath: path,
+	}
+	require.NoError(t, env.DB.Create(&old).Error)
+	archivedPath := filepath.Join(env.TempDir, "archive", path)
+
+	t.Run("Pastes are read from their own storage", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", old.ID), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+
+	t.Run("New pastes go to the default storage", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		assert.Equal(t, "local", paste.StorageName)
+		_, err = os.Stat(diskPath(env, paste.StoragePath))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Pastes are deleted from their own storage", func(t *testing.T) {
+		_, err := os.Stat(archivedPath)
+		require.NoError(t, err)
+
+		resp, err := env.App.Test(httptest.NewRequest("DELETE", fmt.Sprintf("/p/%s/%s", old.ID, old.DeleteKey), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		_, err = os.Stat(archivedPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Pastes in an unknown storage fail cleanly", func(t *testing.T) {
+		lost := models.Paste{
+			Filename:    "lost.txt",
+			MimeType:    "text/plain; charset=utf-8",
+			StorageName: "removed",
+			StorageType: "local",
+			StoragePath: "lost.txt",
+		}
+		require.NoError(t, env.DB.Create(&lost).Error)
+
+		resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", lost.ID), nil), -1)
+		require.NoError(t, err)
+		assert.Equal(t, 500, resp.StatusCode)
+	})
+}
+
+func TestStorageRouting(t *testing.T) {
+	private := true
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		for _, name := range []string{"large", "keyed", "private"} {
+			cfg.Storage = append(cfg.Storage, config.StorageConfig{
+				Name: name,
+				Type: "local",
+				Path: filepath.Join(cfg.Storage[0].Path, name),
+			})
+		}
+		cfg.StorageRoutes = []config.StorageRouteConfig{
+			{Storage: "private", Private: &private},
+			{Name: "api", Storage: "keyed", APIKeys: []string{"test-api-key"}},
+			{Name: "big-text", Storage: "large", MinSize: 64, MimeTypes: []string{"text/*"}},
+		}
+	})
+	defer env.CleanupFn()
+
+	upload := func(t *testing.T, body string, apiKey string) models.Paste {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		return paste
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		apiKey  string
+		storage string
+		route   string
+	}{
+		{"Small text goes to the default storage", `{"content": "small"}`, "", "local", ""},
+		{"Large text is routed by size and type", fmt.Sprintf(`{"content": %q}`, strings.Repeat("large ", 20)), "", "large", "big-text"},
+		{"API keys are routed before size", fmt.Sprintf(`{"content": %q}`, strings.Repeat("large ", 20)), "test-api-key", "keyed", "api"},
+		{"Earlier routes are tried first", `{"content": "secret", "private": true}`, "test-api-key", "private", "private"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paste := upload(t, tt.body, tt.apiKey)
+			assert.Equal(t, tt.storage, paste.StorageName)
+			assert.Equal(t, tt.route, paste.StorageRoute)
+
+			resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", paste.ID), nil), -1)
+			require.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		})
+	}
+
+	t.Run("Routes to unknown storages are rejected", func(t *testing.T) {
+		cfg := *env.Config
+		cfg.StorageRoutes = []config.StorageRouteConfig{{Name: "missing", Storage: "nowhere"}}
+		_, err := storage.NewStorageManager(&cfg)
+		assert.Error(t, err)
+	})
+}
+
+func TestStorageMigration(t *testing.T) {
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		cfg.Storage = append(cfg.Storage, config.StorageConfig{
+			Name: "archive",
+			Type: "local",
+			Path: filepath.Join(cfg.Storage[0].Path, "archive"),
+		})
+	})
+	defer env.CleanupFn()
+
+	create := func(t *testing.T, content string) models.Paste {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		return paste
+	}
+
+	large := strings.Repeat("moved to the archive\n", 10)
+	small := create(t, "stays where it is\n")
+	moved := create(t, large)
+	service := env.Server.GetServices().Paste
+
+	t.Run("Dry runs leave pastes where they are", func(t *testing.T) {
+		var listed []string
+		result, err := service.MigrateStorage(context.Background(), services.StorageMigrationOptions{
+			To:       "archive",
+			MinSize:  100,
+			DryRun:   true,
+			Progress: func(paste *models.Paste, err error) { listed = append(listed, paste.ID) },
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), result.Migrated)
+		assert.Equal(t, []string{moved.ID}, listed)
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", moved.ID).Error)
+		assert.Equal(t, "local", paste.StorageName)
+	})
+
+	t.Run("Pastes matching the filter are moved", func(t *testing.T) {
+		result, err := service.MigrateStorage(context.Background(), services.StorageMigrationOptions{
+			From:    "local",
+			To:      "archive",
+			MinSize: 100,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), result.Migrated)
+		assert.Equal(t, int64(0), result.Failed)
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", moved.ID).Error)
+		assert.Equal(t, "archive", paste.StorageName)
+		_, err = os.Stat(diskPath(env, moved.StoragePath))
+		assert.True(t, os.IsNotExist(err), "source content should be deleted")
+		_, err = os.Stat(filepath.Join(env.TempDir, "archive", paste.StoragePath[strings.LastIndex(paste.StoragePath, ":")+1:]))
+		assert.NoError(t, err)
+
+		resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", moved.ID), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(body))
+
+		require.NoError(t, env.DB.First(&paste, "id = ?", small.ID).Error)
+		assert.Equal(t, "local", paste.StorageName)
+	})
+
+	t.Run("Running again only moves what's left", func(t *testing.T) {
+		result, err := service.MigrateStorage(context.Background(), services.StorageMigrationOptions{To: "archive"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), result.Migrated)
+
+		var count int64
+		require.NoError(t, env.DB.Model(&models.Paste{}).Where("storage_name = ?", "local").Count(&count).Error)
+		assert.Zero(t, count)
+
+		var blobs int64
+		require.NoError(t, env.DB.Model(&models.Blob{}).Where("storage_name = ?", "local").Count(&blobs).Error)
+		assert.Zero(t, blobs)
+	})
+
+	t.Run("Unknown target storages are rejected", func(t *testing.T) {
+		_, err := service.MigrateStorage(context.Background(), services.StorageMigrationOptions{To: "nowhere"})
+		assert.Error(t, err)
+	})
+}
+
+func TestStorageReconciliation(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	create := func(t *testing.T, content string) models.Paste {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var created services.PasteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		return paste
+	}
+
+	intact := create(t, "left alone\n")
+	missing := create(t, "deleted behind the server's back\n")
+	require.NoError(t, os.Remove(diskPath(env, missing.StoragePath)))
+	truncated := create(t, "cut short by a full disk\n")
+	require.NoError(t, os.Truncate(diskPath(env, truncated.StoragePath), 4))
+
+	orphan := filepath.Join(env.TempDir, time.Now().Format("2006/01/02"), "orphan.txt")
+	require.NoError(t, os.WriteFile(orphan, []byte("saved but never recorded"), 0644))
+	unrelated := filepath.Join(env.TempDir, "notes.txt")
+	require.NoError(t, os.WriteFile(unrelated, []byte("not saved by the server"), 0644))
+
+	cleanup := env.Server.GetServices().Cleanup
+
+	t.Run("Problems are only reported without repair", func(t *testing.T) {
+		report, err := cleanup.Reconcile(false)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), report.OrphanedContent)
+		assert.Equal(t, int64(len("saved but never recorded")), report.OrphanedBytes)
+		assert.Equal(t, int64(2), report.BrokenContent)
+		assert.Equal(t, int64(2), report.BrokenPastes)
+
+		assert.FileExists(t, orphan)
+		var count int64
+		require.NoError(t, env.DB.Model(&models.Paste{}).Count(&count).Error)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("Repair deletes orphaned content and broken pastes", func(t *testing.T) {
+		_, err := cleanup.Reconcile(true)
+		require.NoError(t, err)
+
+		assert.NoFileExists(t, orphan)
+		assert.FileExists(t, unrelated)
+		assert.FileExists(t, diskPath(env, intact.StoragePath))
+
+		var ids []string
+		require.NoError(t, env.DB.Model(&models.Paste{}).Pluck("id", &ids).Error)
+		assert.Equal(t, []string{intact.ID}, ids)
+
+		var blobs int64
+		require.NoError(t, env.DB.Model(&models.Blob{}).Count(&blobs).Error)
+		assert.Equal(t, int64(1), blobs)
+
+		report, err := cleanup.Reconcile(false)
+		require.NoError(t, err)
+		assert.Equal(t, services.ReconcileReport{}, report)
+	})
+
+	t.Run("Identical content is stored again after repair", func(t *testing.T) {
+		paste := create(t, "deleted behind the server's back\n")
+		assert.FileExists(t, diskPath(env, paste.StoragePath))
+	})
+}
+
+func TestContentChecksums(t *testing.T) {
+	// The content is cached once read, which mustn't hide it going bad on disk
+	env := testutils.SetupTestEnv(t, func(cfg *config.Config) {
+		cfg.Storage[0].CacheSize = 1024 * 1024
+	})
+	defer env.CleanupFn()
+
+	content := "release artifact\n"
+	sum := sha256.Sum256([]byte(content))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var created services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, hex.EncodeToString(sum[:]), created.SHA256)
+
+	t.Run("Raw downloads carry the digest", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("GET", "/p/"+created.ID+"/raw", nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "sha-256=:"+digest+":", resp.Header.Get("Repr-Digest"))
+		assert.Equal(t, "SHA-256="+digest, resp.Header.Get("Digest"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+
+	t.Run("Content with a digest isn't compressed on the fly", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/p/"+created.ID+"/raw", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "sha-256=:"+digest+":", resp.Header.Get("Repr-Digest"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	})
+
+	t.Run("Encoded content carries no digest", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/p/"+created.ID+"/raw", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Empty(t, resp.Header.Get("Repr-Digest"))
+	})
+
+	t.Run("The JSON view includes the checksum", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/p/"+created.ID, nil)
+		req.Header.Set("Accept", "application/vnd.0x45.paste+json")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var view struct {
+			SHA256 string `json:"sha256"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&view))
+		assert.Equal(t, created.SHA256, view.SHA256)
+	})
+
+	t.Run("The scrub flags corrupt content", func(t *testing.T) {
+		service := env.Server.GetServices().Paste
+		checked, corrupt, err := service.ScrubContent()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), checked)
+		assert.Zero(t, corrupt)
+
+		var paste models.Paste
+		require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+		require.NoError(t, os.WriteFile(diskPath(env, paste.StoragePath), []byte("bit rot"), 0644))
+
+		checked, corrupt, err = service.ScrubContent()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), checked)
+		assert.Equal(t, int64(1), corrupt)
+
+		var blob models.Blob
+		require.NoError(t, env.DB.First(&blob, "hash = ?", created.SHA256).Error)
+		assert.True(t, blob.Corrupt)
+		assert.NotNil(t, blob.VerifiedAt)
+
+		stats, err := env.Server.GetServices().Stats.GetSystemStats()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), stats["current"].(fiber.Map)["corruptContent"])
+	})
+}
+
+func TestStorageCache(t *testing.T) {
+	env := testutils.SetupTestEnv(t, testutils.WithMemoryStorage, func(cfg *config.Config) {
+		cfg.Storage[0].CacheSize = 1024 * 1024
+	})
+	defer env.CleanupFn()
+
+	content := strings.Repeat("served from the cache\n", 50)
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var created services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	var paste models.Paste
+	require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+
+	cacheStats := func() storage.CacheStats {
+		return env.Storage.CacheStats()["memory"]
+	}
+
+	t.Run("Content is served from the cache once read", func(t *testing.T) {
+		before := cacheStats()
+		for i := 0; i < 3; i++ {
+			resp, err := env.App.Test(httptest.NewRequest("GET", fmt.Sprintf("/p/%s/raw", created.ID), nil), -1)
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(body))
+		}
+
+		after := cacheStats()
+		assert.Equal(t, before.Misses+1, after.Misses)
+		assert.GreaterOrEqual(t, after.Hits, before.Hits+2)
+		assert.Positive(t, after.MemoryBytes)
+	})
+
+	t.Run("Stats report the hit rate", func(t *testing.T) {
+		stats, err := services.NewStatsService(env.DB.DB, env.Logger, env.Config, env.Storage).GetSystemStats()
+		require.NoError(t, err)
+
+		cache := stats["cache"].(fiber.Map)
+		assert.Equal(t, true, cache["enabled"])
+		assert.Positive(t, cache["hitRate"])
+	})
+
+	t.Run("The scrub reads past the cache", func(t *testing.T) {
+		before := cacheStats()
+		checked, corrupt, err := env.Server.GetServices().Paste.ScrubContent()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), checked)
+		assert.Zero(t, corrupt)
+		assert.Equal(t, before, cacheStats())
+	})
+
+	t.Run("Deleted content is dropped from the cache", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("DELETE", fmt.Sprintf("/p/%s/%s", paste.ID, paste.DeleteKey), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		assert.Zero(t, cacheStats().MemoryBytes)
+	})
+}
+
+func TestStorageQuotas(t *testing.T) {
+	// upload stores random, incompressible content, with the API key if one
+	// is given, and returns the response status
+	upload := func(t *testing.T, env *testutils.TestEnv, size int, apiKey string) (int, string) {
+		t.Helper()
+		content := make([]byte, size)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "random.bin")
+		require.NoError(t, err)
+		_, err = part.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest("POST", "/p/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		message, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(message)
+	}
+
+	t.Run("API keys can't store more than their quota", func(t *testing.T) {
+		env := testutils.SetupTestEnv(t, testutils.WithMemoryStorage, func(cfg *config.Config) {
+			cfg.Server.Quota.PerKey = 3000
+		})
+		defer env.CleanupFn()
+
+		status, _ := upload(t, env, 2000, "test-api-key")
+		require.Equal(t, 200, status)
+
+		status, message := upload(t, env, 2000, "test-api-key")
+		assert.Equal(t, fiber.StatusInsufficientStorage, status)
+		assert.Contains(t, message, "storage quota of 3000 bytes")
+
+		// Anonymous uploads have no quota
+		status, _ = upload(t, env, 2000, "")
+		assert.Equal(t, 200, status)
+
+		// The quota can be lifted for a single key
+		require.NoError(t, env.DB.Model(&models.APIKey{}).
+			Where("key = ?", "test-api-key").
+			Update("storage_quota", -1).Error)
+		status, _ = upload(t, env, 2000, "test-api-key")
+		assert.Equal(t, 200, status)
+
+		usage, err := services.NewStatsService(env.DB.DB, env.Logger, env.Config, env.Storage).GetKeyUsage()
+		require.NoError(t, err)
+		require.Len(t, usage, 1)
+		assert.Equal(t, "test-api-key", usage[0].Key)
+		assert.Equal(t, int64(4000), usage[0].Used)
+		assert.Zero(t, usage[0].Quota)
+	})
+
+	t.Run("Uploads are rejected past the watermarks", func(t *testing.T) {
+		env := testutils.SetupTestEnv(t, testutils.WithMemoryStorage, func(cfg *config.Config) {
+			cfg.Storage[0].Capacity = 10000
+			cfg.Server.Quota.AnonymousWatermark = 0.5
+			cfg.Server.Quota.Watermark = 0.8
+		})
+		defer env.CleanupFn()
+
+		status, _ := upload(t, env, 6000, "")
+		require.Equal(t, 200, status)
+
+		// Anonymous uploads are rejected first
+		status, message := upload(t, env, 100, "")
+		assert.Equal(t, fiber.StatusInsufficientStorage, status)
+		assert.Contains(t, message, "only uploads with an API key")
+
+		status, message = upload(t, env, 2000, "test-api-key")
+		require.Equal(t, 200, status)
+		var paste services.PasteResponse
+		require.NoError(t, json.Unmarshal([]byte(message), &paste))
+
+		// And then keyed ones
+		status, message = upload(t, env, 100, "test-api-key")
+		assert.Equal(t, fiber.StatusInsufficientStorage, status)
+		assert.Contains(t, message, "Storage is full")
+
+		// Including new revisions of existing pastes
+		req := httptest.NewRequest("PUT", "/p/"+paste.ID, strings.NewReader(`{"content": "revised"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-api-key")
+		resp, err := env.App.Test(req, -1)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusInsufficientStorage, resp.StatusCode)
+
+		stats, err := services.NewStatsService(env.DB.DB, env.Logger, env.Config, env.Storage).GetSystemStats()
+		require.NoError(t, err)
+		usage := stats["storageUsage"].(fiber.Map)["memory"].(fiber.Map)
+		assert.Equal(t, int64(8000), usage["used"])
+		assert.Equal(t, int64(10000), usage["capacity"])
+		assert.Equal(t, 80.0, usage["percent"])
+	})
+}
+
+func TestStorageReplication(t *testing.T) {
+	replicaDir := t.TempDir()
+	env := testutils.SetupTestEnv(t, testutils.WithMemoryStorage, func(cfg *config.Config) {
+		cfg.Storage[0].Replica = "replica"
+		cfg.Storage = append(cfg.Storage, config.StorageConfig{
+			Name: "replica",
+			Type: "local",
+			Path: replicaDir,
+		})
+	})
+	defer env.CleanupFn()
+
+	const content = "mirrored for disaster recovery\n"
+	req := httptest.NewRequest("POST", "/p/", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var created services.PasteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	var paste models.Paste
+	require.NoError(t, env.DB.First(&paste, "id = ?", created.ID).Error)
+	assert.Equal(t, "memory", paste.StorageName)
+	replicaPath := filepath.Join(replicaDir, storage.ObjectPath(paste.StoragePath))
+
+	t.Run("Writes are mirrored to the replica", func(t *testing.T) {
+		_, err := os.Stat(replicaPath)
+		assert.NoError(t, err)
+	})
+
+	t.Run("The replica isn't a storage of its own", func(t *testing.T) {
+		_, err := env.Storage.GetStore("replica")
+		assert.Error(t, err)
+	})
+
+	t.Run("Deletes reach the replica", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("DELETE", fmt.Sprintf("/p/%s/%s", paste.ID, paste.DeleteKey), nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		_, err = os.Stat(replicaPath)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/watzon/0x45/internal/config"
@@ -25,7 +26,21 @@ type TestEnv struct {
 	CleanupFn func()
 }
 
-func SetupTestEnv(t *testing.T) *TestEnv {
+// WithMemoryStorage keeps the content of the test environment in memory
+// instead of in its temporary directory
+func WithMemoryStorage(cfg *config.Config) {
+	cfg.Storage = []config.StorageConfig{
+		{
+			Name:      "memory",
+			Type:      "memory",
+			IsDefault: true,
+		},
+	}
+}
+
+// SetupTestEnv creates a server backed by a temporary database and storage.
+// Options can adjust the test config before the server is created.
+func SetupTestEnv(t *testing.T, opts ...func(*config.Config)) *TestEnv {
 	t.Helper()
 
 	// Create temp directory for uploads and views
@@ -69,6 +84,10 @@ func SetupTestEnv(t *testing.T) *TestEnv {
 			ServerHeader:      "0x45-test",
 			ViewsDirectory:    viewsDir,
 			PublicDirectory:   pubDir,
+			ResumableUploads: config.ResumableUploadConfig{
+				Enabled: true,
+				Expiry:  time.Hour,
+			},
 		},
 		Retention: config.RetentionConfig{
 			NoKey: config.RetentionLimitConfig{
@@ -82,6 +101,10 @@ func SetupTestEnv(t *testing.T) *TestEnv {
 		},
 	}
 
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
 	// Initialize test logger
 	logger, err := zap.NewDevelopment()
 	if err != nil {
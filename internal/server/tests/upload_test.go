@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/server/tests/testutils"
+)
+
+func tusRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	return req
+}
+
+func createTusUpload(t *testing.T, env *testutils.TestEnv, length int, filename string) string {
+	t.Helper()
+
+	req := tusRequest("POST", "/p/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+
+	resp, err := env.App.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+
+	location := resp.Header.Get("Location")
+	require.NotEmpty(t, location)
+	return location[strings.Index(location, "/p/uploads/"):]
+}
+
+func patchTusUpload(t *testing.T, env *testutils.TestEnv, location string, offset int, chunk string) *http.Response {
+	t.Helper()
+
+	req := tusRequest("PATCH", location, strings.NewReader(chunk))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+
+	resp, err := env.App.Test(req, -1)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestResumableUpload(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	content := strings.Repeat("line of a build log\n", 1024)
+	half := len(content) / 2
+
+	location := createTusUpload(t, env, len(content), "build.log")
+
+	// Send the first half
+	resp := patchTusUpload(t, env, location, 0, content[:half])
+	require.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(half), resp.Header.Get("Upload-Offset"))
+	assert.Empty(t, resp.Header.Get("Upload-Paste-URL"))
+
+	// Resuming from the wrong offset is rejected
+	resp = patchTusUpload(t, env, location, 0, content[:half])
+	assert.Equal(t, 409, resp.StatusCode)
+
+	// The server reports how far along the upload is
+	headResp, err := env.App.Test(tusRequest("HEAD", location, nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, headResp.StatusCode)
+	assert.Equal(t, strconv.Itoa(half), headResp.Header.Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(content)), headResp.Header.Get("Upload-Length"))
+
+	// Sending the rest assembles the paste
+	resp = patchTusUpload(t, env, location, half, content[half:])
+	require.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header.Get("Upload-Offset"))
+
+	pasteURL := resp.Header.Get("Upload-Paste-URL")
+	require.NotEmpty(t, pasteURL)
+	assert.NotEmpty(t, resp.Header.Get("Upload-Paste-Delete-URL"))
+
+	rawReq := httptest.NewRequest("GET", pasteURL[strings.Index(pasteURL, "/p/"):]+"/raw", nil)
+	rawResp, err := env.App.Test(rawReq, -1)
+	require.NoError(t, err)
+	require.Equal(t, 200, rawResp.StatusCode)
+
+	raw, err := io.ReadAll(rawResp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(raw))
+}
+
+func TestResumableUploadValidation(t *testing.T) {
+	env := testutils.SetupTestEnv(t)
+	defer env.CleanupFn()
+
+	t.Run("Missing protocol version", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/p/uploads", nil)
+		req.Header.Set("Upload-Length", "10")
+
+		resp, err := env.App.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 412, resp.StatusCode)
+		assert.Equal(t, "1.0.0", resp.Header.Get("Tus-Version"))
+	})
+
+	t.Run("Discovery", func(t *testing.T) {
+		resp, err := env.App.Test(httptest.NewRequest("OPTIONS", "/p/uploads", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 204, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Tus-Extension"), "creation")
+		assert.Equal(t, fmt.Sprint(env.Config.Server.DefaultUploadSize), resp.Header.Get("Tus-Max-Size"))
+	})
+
+	t.Run("Upload larger than the limit", func(t *testing.T) {
+		req := tusRequest("POST", "/p/uploads", nil)
+		req.Header.Set("Upload-Length", strconv.Itoa(env.Config.Server.DefaultUploadSize+1))
+
+		resp, err := env.App.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 413, resp.StatusCode)
+	})
+
+	t.Run("Chunk larger than the declared length", func(t *testing.T) {
+		location := createTusUpload(t, env, 4, "small.txt")
+
+		resp := patchTusUpload(t, env, location, 0, "too much content")
+		assert.Equal(t, 413, resp.StatusCode)
+	})
+
+	t.Run("Upload assembled by another request", func(t *testing.T) {
+		location := createTusUpload(t, env, 4, "racing.txt")
+		id := strings.TrimPrefix(location, "/p/uploads/")
+
+		// Another request has received the last chunk and claimed the upload
+		require.NoError(t, env.DB.Model(&models.Upload{}).Where("id = ?", id).
+			Updates(map[string]any{"upload_offset": 4, "paste_id": "-"}).Error)
+
+		resp := patchTusUpload(t, env, location, 4, "")
+		assert.Equal(t, 409, resp.StatusCode)
+
+		headResp, err := env.App.Test(tusRequest("HEAD", location, nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, headResp.StatusCode)
+		assert.Empty(t, headResp.Header.Get("Upload-Paste-URL"))
+
+		// Once it has created the paste, the upload is reported as finished
+		require.NoError(t, env.DB.Model(&models.Upload{}).Where("id = ?", id).
+			Update("paste_id", "abcd1234").Error)
+
+		resp = patchTusUpload(t, env, location, 4, "")
+		require.Equal(t, 204, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Upload-Paste-URL"), "/p/abcd1234")
+	})
+
+	t.Run("Termination", func(t *testing.T) {
+		location := createTusUpload(t, env, 100, "cancelled.txt")
+
+		resp := patchTusUpload(t, env, location, 0, "partial")
+		require.Equal(t, 204, resp.StatusCode)
+
+		delResp, err := env.App.Test(tusRequest("DELETE", location, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 204, delResp.StatusCode)
+
+		headResp, err := env.App.Test(tusRequest("HEAD", location, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 404, headResp.StatusCode)
+	})
+}
@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheFileSuffix marks the files of the disk tier of a cache
+const cacheFileSuffix = ".cache"
+
+// CacheOptions sizes the tiers of a CachedStore
+type CacheOptions struct {
+	MemorySize  int64  // Bytes of content kept in memory
+	MaxItemSize int64  // Largest content kept in memory, an eighth of MemorySize if zero
+	DiskPath    string // Directory of the disk tier, which is left out if empty
+	DiskSize    int64  // Bytes of content kept on disk
+}
+
+// CacheStats counts the reads served by a CachedStore
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	MemoryBytes int64
+	DiskBytes   int64
+}
+
+// HitRate returns the share of reads served from the cache, from 0 to 1
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CachedStore is a read-through cache in front of another store. Content read
+// in full is kept in memory, and on local disk when a disk tier is configured,
+// with the least recently used content evicted first. Content never changes
+// once it's saved, so cached content only has to be dropped when it's
+// deleted.
+type CachedStore struct {
+	store  Store
+	opts   CacheOptions
+	memory *lru
+	disk   *lru // Holds no data, the content is in the files
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	// Incremented on every delete, content read before a delete isn't cached
+	// since it may be of the deleted path
+	generation atomic.Int64
+}
+
+// NewCachedStore wraps store in a cache. Files left in the disk tier by a
+// previous run are removed, since which paths they hold isn't known.
+func NewCachedStore(store Store, opts CacheOptions) (*CachedStore, error) {
+	if opts.MaxItemSize == 0 {
+		opts.MaxItemSize = opts.MemorySize / 8
+	}
+
+	s := &CachedStore{
+		store:  store,
+		opts:   opts,
+		memory: newLRU(opts.MemorySize, nil),
+	}
+
+	if opts.DiskPath != "" {
+		if err := os.MkdirAll(opts.DiskPath, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		entries, err := os.ReadDir(opts.DiskPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache directory: %w", err)
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); strings.HasSuffix(name, cacheFileSuffix) || strings.HasPrefix(name, ".fill-") {
+				os.Remove(filepath.Join(opts.DiskPath, name))
+			}
+		}
+
+		s.disk = newLRU(opts.DiskSize, func(path string) {
+			os.Remove(s.diskFile(path))
+		})
+	}
+
+	return s, nil
+}
+
+// diskFile returns where the disk tier keeps the content at path
+func (s *CachedStore) diskFile(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(s.opts.DiskPath, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+// Stats returns the hits and misses of the cache so far, and how much content
+// it holds
+func (s *CachedStore) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:        s.hits.Load(),
+		Misses:      s.misses.Load(),
+		MemoryBytes: s.memory.size(),
+	}
+	if s.disk != nil {
+		stats.DiskBytes = s.disk.size()
+	}
+	return stats
+}
+
+func (s *CachedStore) Save(content io.Reader, filename string) (string, error) {
+	return s.store.Save(content, filename)
+}
+
+// Get serves content from memory or disk when it's cached. Otherwise it's
+// read from the underlying store and cached once it's been read in full.
+func (s *CachedStore) Get(path string) (io.ReadCloser, error) {
+	if entry, ok := s.memory.get(path); ok {
+		s.hits.Add(1)
+		return io.NopCloser(bytes.NewReader(entry.data)), nil
+	}
+
+	if s.disk != nil {
+		if entry, ok := s.disk.get(path); ok {
+			if file, err := os.Open(s.diskFile(path)); err == nil {
+				s.hits.Add(1)
+				if entry.size > s.opts.MaxItemSize {
+					return file, nil
+				}
+
+				// Small content is moved up to memory
+				defer file.Close()
+				data, err := io.ReadAll(file)
+				if err != nil {
+					return nil, err
+				}
+				s.memory.add(path, int64(len(data)), data)
+				return io.NopCloser(bytes.NewReader(data)), nil
+			}
+			s.disk.remove(path)
+		}
+	}
+
+	s.misses.Add(1)
+	content, err := s.store.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.fill(path, content), nil
+}
+
+// GetRange serves a range of cached content, and reads it from the underlying
+// store otherwise. Ranges aren't cached, only content that's read in full is.
+func (s *CachedStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if entry, ok := s.memory.get(path); ok {
+		s.hits.Add(1)
+		offset = min(offset, entry.size)
+		end := min(offset+length, entry.size)
+		return io.NopCloser(bytes.NewReader(entry.data[offset:end])), nil
+	}
+
+	if s.disk != nil {
+		if _, ok := s.disk.get(path); ok {
+			if file, err := os.Open(s.diskFile(path)); err == nil {
+				if _, err := file.Seek(offset, io.SeekStart); err != nil {
+					file.Close()
+					return nil, err
+				}
+				s.hits.Add(1)
+				return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+			}
+			s.disk.remove(path)
+		}
+	}
+
+	s.misses.Add(1)
+	return getRange(s.store, path, offset, length)
+}
+
+// Delete drops the content from the cache before it's deleted from the
+// underlying store
+func (s *CachedStore) Delete(path string) error {
+	s.generation.Add(1)
+	s.memory.remove(path)
+	if s.disk != nil {
+		s.disk.remove(path)
+	}
+	return s.store.Delete(path)
+}
+
+func (s *CachedStore) GetURL(path string) string {
+	return s.store.GetURL(path)
+}
+
+func (s *CachedStore) PresignGet(path, contentType, contentDisposition string) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", nil
+	}
+	return presigner.PresignGet(path, contentType, contentDisposition)
+}
+
+func (s *CachedStore) DiskUsage() (int64, int64, error) {
+	return diskUsage(s.store)
+}
+
+func (s *CachedStore) GetSize(path string) (int64, error) {
+	if entry, ok := s.memory.peek(path); ok {
+		return entry.size, nil
+	}
+	if s.disk != nil {
+		if entry, ok := s.disk.peek(path); ok {
+			return entry.size, nil
+		}
+	}
+	return s.store.GetSize(path)
+}
+
+func (s *CachedStore) SetExpiry(path string, expiry time.Time) error {
+	return s.store.SetExpiry(path, expiry)
+}
+
+func (s *CachedStore) Type() string {
+	return s.store.Type()
+}
+
+func (s *CachedStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return s.store.List(fn)
+}
+
+func (s *CachedStore) SetDefault() error {
+	return s.store.SetDefault()
+}
+
+func (s *CachedStore) IsDefault() bool {
+	return s.store.IsDefault()
+}
+
+// fill returns a stream of content read from the underlying store, which
+// copies the content into the cache as it's read
+func (s *CachedStore) fill(path string, content io.ReadCloser) io.ReadCloser {
+	r := &cachingReader{
+		ReadCloser: content,
+		cache:      s,
+		path:       path,
+		generation: s.generation.Load(),
+	}
+	if s.opts.MemorySize > 0 && s.opts.MaxItemSize > 0 {
+		r.buf = &bytes.Buffer{}
+	}
+	if s.disk != nil && s.opts.DiskSize > 0 {
+		if file, err := os.CreateTemp(s.opts.DiskPath, ".fill-*"); err == nil {
+			r.file = file
+		}
+	}
+	return r
+}
+
+// cachingReader copies content into the cache while it's read. Content is
+// only cached if it's read to the end; whatever doesn't fit a tier is left
+// out of it.
+type cachingReader struct {
+	io.ReadCloser
+	cache      *CachedStore
+	path       string
+	generation int64
+
+	buf  *bytes.Buffer // Content for the memory tier, nil once it doesn't fit
+	file *os.File      // Content for the disk tier, nil once it doesn't fit
+	n    int64
+	eof  bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		if r.buf != nil {
+			if r.n > r.cache.opts.MaxItemSize {
+				r.buf = nil
+			} else {
+				r.buf.Write(p[:n])
+			}
+		}
+		if r.file != nil {
+			if _, werr := r.file.Write(p[:n]); werr != nil || r.n > r.cache.opts.DiskSize {
+				r.discardFile()
+			}
+		}
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	err := r.ReadCloser.Close()
+
+	if !r.eof || err != nil || r.cache.generation.Load() != r.generation {
+		r.buf = nil
+		r.discardFile()
+		return err
+	}
+
+	if r.buf != nil {
+		r.cache.memory.add(r.path, r.n, r.buf.Bytes())
+	}
+	if r.file != nil {
+		tempPath := r.file.Name()
+		if closeErr := r.file.Close(); closeErr != nil {
+			os.Remove(tempPath)
+		} else if renameErr := os.Rename(tempPath, r.cache.diskFile(r.path)); renameErr != nil {
+			os.Remove(tempPath)
+		} else {
+			r.cache.disk.add(r.path, r.n, nil)
+		}
+		r.file = nil
+	}
+	return nil
+}
+
+// discardFile drops the content copied for the disk tier
+func (r *cachingReader) discardFile() {
+	if r.file == nil {
+		return
+	}
+	r.file.Close()
+	os.Remove(r.file.Name())
+	r.file = nil
+}
+
+// lruEntry is content held by an lru
+type lruEntry struct {
+	path string
+	size int64
+	data []byte
+}
+
+// lru holds entries up to a total size, evicting the least recently used
+// entries to make room for new ones
+type lru struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	order    *list.List // Most recently used first
+	items    map[string]*list.Element
+	onEvict  func(path string)
+}
+
+func newLRU(capacity int64, onEvict func(path string)) *lru {
+	return &lru{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+// get returns the entry for path, marking it as recently used
+func (c *lru) get(path string) (*lruEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[path]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry), true
+}
+
+// peek returns the entry for path without marking it as used
+func (c *lru) peek(path string) (*lruEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[path]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*lruEntry), true
+}
+
+// add adds an entry, evicting others until it fits. Entries bigger than the
+// whole capacity aren't added.
+func (c *lru) add(path string, size int64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > c.capacity {
+		if c.onEvict != nil {
+			c.onEvict(path)
+		}
+		return
+	}
+	if element, ok := c.items[path]; ok {
+		c.used -= element.Value.(*lruEntry).size
+		c.order.Remove(element)
+		delete(c.items, path)
+	}
+
+	for c.used+size > c.capacity {
+		c.evict(c.order.Back())
+	}
+	c.items[path] = c.order.PushFront(&lruEntry{path: path, size: size, data: data})
+	c.used += size
+}
+
+// remove drops the entry for path
+func (c *lru) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[path]; ok {
+		c.evict(element)
+	}
+}
+
+// evict drops an entry, the lock must be held
+func (c *lru) evict(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+	c.order.Remove(element)
+	delete(c.items, entry.path)
+	c.used -= entry.size
+	if c.onEvict != nil {
+		c.onEvict(entry.path)
+	}
+}
+
+// size returns the total size of the entries
+func (c *lru) size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
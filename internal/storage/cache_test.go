@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/storage/memory"
+)
+
+// countingStore counts the reads that reach the store it wraps
+type countingStore struct {
+	*memory.MemoryStore
+	reads int
+}
+
+func (s *countingStore) Get(path string) (io.ReadCloser, error) {
+	s.reads++
+	return s.MemoryStore.Get(path)
+}
+
+func readAll(t *testing.T, store Store, path string) string {
+	t.Helper()
+	reader, err := store.Get(path)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCachedStore(t *testing.T) {
+	inner := &countingStore{MemoryStore: memory.New(true)}
+	diskPath := t.TempDir()
+	store, err := NewCachedStore(inner, CacheOptions{
+		MemorySize:  100,
+		MaxItemSize: 40,
+		DiskPath:    diskPath,
+		DiskSize:    1000,
+	})
+	require.NoError(t, err)
+
+	small := strings.Repeat("s", 30)
+	smallPath, err := store.Save(strings.NewReader(small), "small.txt")
+	require.NoError(t, err)
+	large := strings.Repeat("l", 300)
+	largePath, err := store.Save(strings.NewReader(large), "large.txt")
+	require.NoError(t, err)
+
+	t.Run("Content is read through the cache", func(t *testing.T) {
+		assert.Equal(t, small, readAll(t, store, smallPath))
+		assert.Equal(t, small, readAll(t, store, smallPath))
+		assert.Equal(t, 1, inner.reads)
+
+		stats := store.Stats()
+		assert.Equal(t, int64(1), stats.Hits)
+		assert.Equal(t, int64(1), stats.Misses)
+		assert.Equal(t, 0.5, stats.HitRate())
+		assert.Equal(t, int64(len(small)), stats.MemoryBytes)
+	})
+
+	t.Run("Large content is only cached on disk", func(t *testing.T) {
+		assert.Equal(t, large, readAll(t, store, largePath))
+		assert.Equal(t, large, readAll(t, store, largePath))
+		assert.Equal(t, 2, inner.reads)
+
+		stats := store.Stats()
+		assert.Equal(t, int64(len(small)), stats.MemoryBytes)
+		assert.Equal(t, int64(len(small)+len(large)), stats.DiskBytes)
+	})
+
+	t.Run("Ranges are served from the cache", func(t *testing.T) {
+		for _, path := range []string{smallPath, largePath} {
+			reader, err := store.GetRange(path, 10, 5)
+			require.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			reader.Close()
+			assert.Len(t, data, 5)
+		}
+		assert.Equal(t, 2, inner.reads)
+	})
+
+	var partialPath string
+	t.Run("Partly read content isn't cached", func(t *testing.T) {
+		partialPath, err = store.Save(strings.NewReader(small), "partial.txt")
+		require.NoError(t, err)
+
+		reader, err := store.Get(partialPath)
+		require.NoError(t, err)
+		_, err = io.ReadFull(reader, make([]byte, 10))
+		require.NoError(t, err)
+		reader.Close()
+
+		assert.Equal(t, small, readAll(t, store, partialPath))
+		assert.Equal(t, 4, inner.reads)
+	})
+
+	t.Run("The least recently used content is evicted", func(t *testing.T) {
+		// The small content is used again, making the partial one the oldest
+		readAll(t, store, smallPath)
+		for _, name := range []string{"newer.txt", "newest.txt"} {
+			path, err := store.Save(strings.NewReader(small), name)
+			require.NoError(t, err)
+			readAll(t, store, path)
+		}
+
+		_, ok := store.memory.peek(smallPath)
+		assert.True(t, ok)
+		_, ok = store.memory.peek(partialPath)
+		assert.False(t, ok)
+		assert.Equal(t, int64(90), store.Stats().MemoryBytes)
+
+		// Content evicted from memory is still on disk
+		reads := inner.reads
+		assert.Equal(t, small, readAll(t, store, partialPath))
+		assert.Equal(t, reads, inner.reads)
+	})
+
+	t.Run("Deleted content is dropped from the cache", func(t *testing.T) {
+		require.NoError(t, store.Delete(largePath))
+
+		_, err := store.Get(largePath)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		files, err := filepath.Glob(filepath.Join(diskPath, "*"+cacheFileSuffix))
+		require.NoError(t, err)
+		for _, file := range files {
+			assert.NotEqual(t, store.diskFile(largePath), file)
+		}
+	})
+
+	t.Run("The disk tier is cleared on startup", func(t *testing.T) {
+		_, err := NewCachedStore(inner, CacheOptions{DiskPath: diskPath, DiskSize: 1000})
+		require.NoError(t, err)
+
+		entries, err := os.ReadDir(diskPath)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"time"
+)
+
+// compressedPathPrefix marks storage paths of compressed content. Paths
+// without it are read from the underlying store as is.
+const compressedPathPrefix = "gz:"
+
+// CompressedEncoding is the HTTP content coding of compressed content, which
+// can be sent to clients that accept it without decompressing it first
+const CompressedEncoding = "gzip"
+
+// Compressor is implemented by stores that can compress content at rest
+type Compressor interface {
+	// SaveCompressed stores content compressed and returns the storage path
+	SaveCompressed(content io.Reader, filename string) (string, error)
+	// GetCompressed returns the compressed stream of the content at path. It
+	// returns false, and no stream, if the content wasn't stored compressed.
+	GetCompressed(path string) (io.ReadCloser, bool, error)
+}
+
+// CompressedStore gzips content before it reaches another store. Content is
+// only compressed when saved with SaveCompressed, since most binary formats
+// are already compressed; everything else is passed through.
+type CompressedStore struct {
+	store Store
+}
+
+// NewCompressedStore wraps store so that content can be compressed at rest
+func NewCompressedStore(store Store) *CompressedStore {
+	return &CompressedStore{store: store}
+}
+
+func (s *CompressedStore) Save(content io.Reader, filename string) (string, error) {
+	return s.store.Save(content, filename)
+}
+
+// SaveCompressed compresses content while it's streamed to the underlying
+// store
+func (s *CompressedStore) SaveCompressed(content io.Reader, filename string) (string, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gz := gzip.NewWriter(pw)
+		if _, err := io.Copy(gz, content); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(gz.Close())
+	}()
+
+	innerPath, err := s.store.Save(pr, filename)
+	// Stop the compression if the store gave up early, and wait for it so
+	// the content isn't read after returning
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return "", err
+	}
+	return compressedPathPrefix + innerPath, nil
+}
+
+func (s *CompressedStore) Get(path string) (io.ReadCloser, error) {
+	content, compressed, err := s.GetCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return s.store.Get(path)
+	}
+
+	gz, err := gzip.NewReader(content)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gz, content: content}, nil
+}
+
+func (s *CompressedStore) GetCompressed(path string) (io.ReadCloser, bool, error) {
+	innerPath, compressed := strings.CutPrefix(path, compressedPathPrefix)
+	if !compressed {
+		return nil, false, nil
+	}
+
+	content, err := s.store.Get(innerPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+// GetRange reads a range of the content. Compressed content has to be
+// decompressed from the start.
+func (s *CompressedStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, compressedPathPrefix) {
+		return getRange(s.store, path, offset, length)
+	}
+
+	content, err := s.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return skipToRange(content, offset, length)
+}
+
+func (s *CompressedStore) Delete(path string) error {
+	return s.store.Delete(strings.TrimPrefix(path, compressedPathPrefix))
+}
+
+// GetURL returns an empty string for compressed content, since the underlying
+// store would serve it without a content coding
+func (s *CompressedStore) GetURL(path string) string {
+	if strings.HasPrefix(path, compressedPathPrefix) {
+		return ""
+	}
+	return s.store.GetURL(path)
+}
+
+// PresignGet returns an empty string for compressed content, for the same
+// reason as GetURL
+func (s *CompressedStore) PresignGet(path, contentType, contentDisposition string) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok || strings.HasPrefix(path, compressedPathPrefix) {
+		return "", nil
+	}
+	return presigner.PresignGet(path, contentType, contentDisposition)
+}
+
+func (s *CompressedStore) DiskUsage() (int64, int64, error) {
+	return diskUsage(s.store)
+}
+
+// GetSize returns the size of the content as stored, which for compressed
+// content is its compressed size
+func (s *CompressedStore) GetSize(path string) (int64, error) {
+	return s.store.GetSize(strings.TrimPrefix(path, compressedPathPrefix))
+}
+
+func (s *CompressedStore) SetExpiry(path string, expiry time.Time) error {
+	return s.store.SetExpiry(strings.TrimPrefix(path, compressedPathPrefix), expiry)
+}
+
+func (s *CompressedStore) Type() string {
+	return s.store.Type()
+}
+
+func (s *CompressedStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return s.store.List(fn)
+}
+
+func (s *CompressedStore) SetDefault() error {
+	return s.store.SetDefault()
+}
+
+func (s *CompressedStore) IsDefault() bool {
+	return s.store.IsDefault()
+}
+
+// Rewrap passes rewrapping on to the underlying store, keeping the path
+// marked as compressed
+func (s *CompressedStore) Rewrap(path string) (string, error) {
+	rewrapper, ok := s.store.(Rewrapper)
+	if !ok {
+		return path, nil
+	}
+
+	innerPath, compressed := strings.CutPrefix(path, compressedPathPrefix)
+	newPath, err := rewrapper.Rewrap(innerPath)
+	if err != nil || !compressed {
+		return newPath, err
+	}
+	return compressedPathPrefix + newPath, nil
+}
+
+// gzipReadCloser closes the compressed content along with its reader
+type gzipReadCloser struct {
+	*gzip.Reader
+	content io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.content.Close()
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/storage/local"
+)
+
+func TestCompressedStore(t *testing.T) {
+	tempDir := t.TempDir()
+	inner, err := local.New(tempDir, "http://localhost:3000", true, local.Options{})
+	require.NoError(t, err)
+	store := NewCompressedStore(inner)
+
+	content := strings.Repeat("2024-01-01 12:00:00 INFO request handled\n", 1000)
+
+	t.Run("Content is compressed at rest", func(t *testing.T) {
+		path, err := store.SaveCompressed(strings.NewReader(content), "log.txt")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(path, compressedPathPrefix))
+
+		stored, err := os.ReadFile(filepath.Join(tempDir, strings.TrimPrefix(path, compressedPathPrefix)))
+		require.NoError(t, err)
+		assert.Less(t, len(stored), len(content)/10)
+
+		size, err := store.GetSize(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(stored)), size)
+
+		// Reading decompresses
+		reader, err := store.Get(path)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		assert.Equal(t, content, string(data))
+
+		// The compressed stream can be read as is
+		compressed, ok, err := store.GetCompressed(path)
+		require.NoError(t, err)
+		require.True(t, ok)
+		defer compressed.Close()
+		gz, err := gzip.NewReader(compressed)
+		require.NoError(t, err)
+		data, err = io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("Other content is passed through", func(t *testing.T) {
+		path, err := store.Save(strings.NewReader(content), "log.txt")
+		require.NoError(t, err)
+		assert.False(t, strings.HasPrefix(path, compressedPathPrefix))
+
+		compressed, ok, err := store.GetCompressed(path)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Nil(t, compressed)
+
+		reader, err := store.Get(path)
+		require.NoError(t, err)
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("Read errors are passed on", func(t *testing.T) {
+		failure := errors.New("read failed")
+		_, err := store.SaveCompressed(io.MultiReader(bytes.NewReader([]byte(content)), &failingReader{err: failure}), "log.txt")
+		assert.ErrorIs(t, err, failure)
+	})
+
+	t.Run("Encrypted content is compressed first", func(t *testing.T) {
+		encrypted, err := NewEncryptedStore(inner, newTestKey(t), nil)
+		require.NoError(t, err)
+		store := NewCompressedStore(encrypted)
+
+		path, err := store.SaveCompressed(strings.NewReader(content), "log.txt")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(path, compressedPathPrefix+encryptedPathPrefix))
+
+		size, err := store.GetSize(path)
+		require.NoError(t, err)
+		assert.Less(t, size, int64(len(content)/10))
+
+		reader, err := store.Get(path)
+		require.NoError(t, err)
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Content is encrypted in chunks so it can be streamed in and out of storage.
+// Each chunk is sealed with the data key under a nonce made of the chunk index
+// and a flag marking the final chunk, so chunks can't be reordered, dropped or
+// truncated without decryption failing.
+const (
+	encryptedChunkSize = 64 * 1024
+	encryptedTagSize   = 16
+	dataKeySize        = 32
+)
+
+// encryptedPathPrefix marks storage paths of encrypted content. Paths without
+// it are read from the underlying store as is, so encryption can be enabled on
+// a store that already holds content.
+const encryptedPathPrefix = "enc:"
+
+var (
+	// ErrUnknownKey is returned when content was encrypted under a master key
+	// that isn't configured
+	ErrUnknownKey = errors.New("content was encrypted with an unknown key")
+	// ErrCorrupt is returned when encrypted content fails to authenticate
+	ErrCorrupt = errors.New("encrypted content is corrupt or was tampered with")
+)
+
+// Rewrapper is implemented by stores that can move content to their current
+// encryption key without rewriting it
+type Rewrapper interface {
+	// Rewrap returns the path under which content stored at path is wrapped
+	// with the current key. It returns path itself if nothing changed.
+	Rewrap(path string) (string, error)
+}
+
+// masterKey is a key used to wrap the data keys of encrypted content
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// EncryptedStore encrypts content before it reaches another store. Every blob
+// gets its own random data key, which is wrapped with a master key and kept in
+// the storage path rather than in the blob, so rotating the master key only
+// changes the path and never the content.
+type EncryptedStore struct {
+	store   Store
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+// NewEncryptedStore wraps store so that content is encrypted with key. Content
+// encrypted with any of the previous keys can still be read and rewrapped.
+func NewEncryptedStore(store Store, key string, previous []string) (*EncryptedStore, error) {
+	current, err := newMasterKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	keys := map[string]*masterKey{current.id: current}
+	for _, encoded := range previous {
+		old, err := newMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous encryption key: %w", err)
+		}
+		keys[old.id] = old
+	}
+
+	return &EncryptedStore{
+		store:   store,
+		current: current,
+		keys:    keys,
+	}, nil
+}
+
+// newMasterKey decodes a base64 encoded 256-bit master key. Keys are
+// identified by a prefix of their hash so the ID can be stored with content.
+func newMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 encoded: %w", err)
+	}
+	if len(raw) != dataKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", dataKeySize, len(raw))
+	}
+
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(raw)
+	return &masterKey{
+		id:   hex.EncodeToString(sum[:4]),
+		aead: aead,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptedStore) Save(content io.Reader, filename string) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	innerPath, err := s.store.Save(newEncryptReader(content, aead), filename)
+	if err != nil {
+		return "", err
+	}
+
+	return s.wrap(s.current, dataKey, innerPath)
+}
+
+func (s *EncryptedStore) Get(path string) (io.ReadCloser, error) {
+	aead, innerPath, err := s.unwrap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.store.Get(innerPath)
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return content, nil
+	}
+	return newDecryptReader(content, aead), nil
+}
+
+// GetRange reads a range of the content. Encrypted content has to be
+// decrypted from the start, since each chunk is authenticated in sequence.
+func (s *EncryptedStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, encryptedPathPrefix) {
+		return getRange(s.store, path, offset, length)
+	}
+
+	content, err := s.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return skipToRange(content, offset, length)
+}
+
+func (s *EncryptedStore) Delete(path string) error {
+	return s.store.Delete(innerStoragePath(path))
+}
+
+// GetURL returns an empty string, since the underlying store only ever serves
+// the ciphertext
+func (s *EncryptedStore) GetURL(path string) string {
+	if !strings.HasPrefix(path, encryptedPathPrefix) {
+		return s.store.GetURL(path)
+	}
+	return ""
+}
+
+// PresignGet returns an empty string for encrypted content, for the same
+// reason as GetURL
+func (s *EncryptedStore) PresignGet(path, contentType, contentDisposition string) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok || strings.HasPrefix(path, encryptedPathPrefix) {
+		return "", nil
+	}
+	return presigner.PresignGet(path, contentType, contentDisposition)
+}
+
+func (s *EncryptedStore) DiskUsage() (int64, int64, error) {
+	return diskUsage(s.store)
+}
+
+// GetSize returns the size of the content before it was encrypted
+func (s *EncryptedStore) GetSize(path string) (int64, error) {
+	size, err := s.store.GetSize(innerStoragePath(path))
+	if err != nil || !strings.HasPrefix(path, encryptedPathPrefix) {
+		return size, err
+	}
+
+	chunks := (size + encryptedChunkSize + encryptedTagSize - 1) / (encryptedChunkSize + encryptedTagSize)
+	return size - chunks*encryptedTagSize, nil
+}
+
+func (s *EncryptedStore) SetExpiry(path string, expiry time.Time) error {
+	return s.store.SetExpiry(innerStoragePath(path), expiry)
+}
+
+func (s *EncryptedStore) Type() string {
+	return s.store.Type()
+}
+
+// List lists the underlying store, whose sizes are those of the ciphertext
+func (s *EncryptedStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return s.store.List(fn)
+}
+
+func (s *EncryptedStore) SetDefault() error {
+	return s.store.SetDefault()
+}
+
+func (s *EncryptedStore) IsDefault() bool {
+	return s.store.IsDefault()
+}
+
+// Rewrap re-wraps the data key of content stored under a previous master key
+// with the current one. Only the path changes, the content is left in place.
+func (s *EncryptedStore) Rewrap(path string) (string, error) {
+	keyID, _, innerPath, ok := parseEncryptedPath(path)
+	if !ok || keyID == s.current.id {
+		return path, nil
+	}
+
+	dataKey, err := s.dataKey(path)
+	if err != nil {
+		return "", err
+	}
+	return s.wrap(s.current, dataKey, innerPath)
+}
+
+// wrap seals a data key with a master key and builds the storage path that
+// carries it. The inner path is authenticated along with the data key so a
+// wrapped key can't be moved to another blob.
+func (s *EncryptedStore) wrap(key *masterKey, dataKey []byte, innerPath string) (string, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	wrapped := key.aead.Seal(nonce, nonce, dataKey, []byte(innerPath))
+	return fmt.Sprintf("%s%s:%s:%s", encryptedPathPrefix, key.id, base64.RawURLEncoding.EncodeToString(wrapped), innerPath), nil
+}
+
+// unwrap returns the cipher for the content at path and the path within the
+// underlying store. The cipher is nil for content that isn't encrypted.
+func (s *EncryptedStore) unwrap(path string) (cipher.AEAD, string, error) {
+	if !strings.HasPrefix(path, encryptedPathPrefix) {
+		return nil, path, nil
+	}
+
+	dataKey, err := s.dataKey(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return aead, innerStoragePath(path), nil
+}
+
+// dataKey unwraps the data key carried by an encrypted storage path
+func (s *EncryptedStore) dataKey(path string) ([]byte, error) {
+	keyID, wrapped, innerPath, ok := parseEncryptedPath(path)
+	if !ok {
+		return nil, fmt.Errorf("invalid encrypted storage path: %s", path)
+	}
+
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted storage path: %s", path)
+	}
+
+	nonce, sealed := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+	dataKey, err := key.aead.Open(nil, nonce, sealed, []byte(innerPath))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+// parseEncryptedPath splits an encrypted storage path of the form
+// enc:<key id>:<wrapped data key>:<inner path>
+func parseEncryptedPath(path string) (keyID, wrapped, innerPath string, ok bool) {
+	rest, ok := strings.CutPrefix(path, encryptedPathPrefix)
+	if !ok {
+		return "", "", "", false
+	}
+
+	parts := strings.SplitN(rest, ":", 3)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// innerStoragePath returns the path of content within the underlying store
+func innerStoragePath(path string) string {
+	if _, _, innerPath, ok := parseEncryptedPath(path); ok {
+		return innerPath
+	}
+	return path
+}
+
+// chunkNonce returns the nonce for a chunk of encrypted content. Data keys
+// are never reused, so a counter is enough to keep nonces unique.
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader encrypts content as it's read
+type encryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	index uint64
+	plain []byte
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+func newEncryptReader(src io.Reader, aead cipher.AEAD) *encryptReader {
+	return &encryptReader{
+		src:   bufio.NewReaderSize(src, encryptedChunkSize),
+		aead:  aead,
+		plain: make([]byte, encryptedChunkSize),
+	}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next encrypts the next chunk of content
+func (r *encryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	final := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is only the final one if nothing follows it
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.buf = r.aead.Seal(r.buf[:0], chunkNonce(r.index, final), r.plain[:n], nil)
+	r.out = r.buf
+	r.index++
+	r.done = final
+	return nil
+}
+
+// decryptReader decrypts content as it's read
+type decryptReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	index  uint64
+	sealed []byte
+	buf    []byte
+	out    []byte
+	done   bool
+}
+
+func newDecryptReader(src io.ReadCloser, aead cipher.AEAD) *decryptReader {
+	return &decryptReader{
+		src:    bufio.NewReaderSize(src, encryptedChunkSize+encryptedTagSize),
+		closer: src,
+		aead:   aead,
+		sealed: make([]byte, encryptedChunkSize+encryptedTagSize),
+	}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk of content
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err == io.EOF:
+		// The final chunk is never empty, it always has at least a tag
+		return ErrCorrupt
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.buf, err = r.aead.Open(r.buf[:0], chunkNonce(r.index, final), r.sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.out = r.buf
+	r.index++
+	r.done = final
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.closer.Close()
+}
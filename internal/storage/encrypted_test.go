@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/storage/local"
+)
+
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	tempDir := t.TempDir()
+	inner, err := local.New(tempDir, "http://localhost:3000", true, local.Options{})
+	require.NoError(t, err)
+
+	oldKey := newTestKey(t)
+	store, err := NewEncryptedStore(inner, oldKey, nil)
+	require.NoError(t, err)
+
+	read := func(t *testing.T, store Store, path string) ([]byte, error) {
+		reader, err := store.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "Empty", size: 0},
+		{name: "Small", size: 100},
+		{name: "Exactly one chunk", size: encryptedChunkSize},
+		{name: "Several chunks", size: 3*encryptedChunkSize + 123},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, tt.size)
+			_, err := rand.Read(content)
+			require.NoError(t, err)
+
+			path, err := store.Save(bytes.NewReader(content), "test.txt")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(path, "enc:"))
+
+			data, err := read(t, store, path)
+			require.NoError(t, err)
+			assert.Equal(t, content, data)
+
+			size, err := store.GetSize(path)
+			require.NoError(t, err)
+			assert.Equal(t, int64(tt.size), size)
+		})
+	}
+
+	plaintext := "customer log line\n"
+	path, err := store.Save(strings.NewReader(plaintext), "log.txt")
+	require.NoError(t, err)
+	innerPath := innerStoragePath(path)
+
+	t.Run("Content is encrypted at rest", func(t *testing.T) {
+		stored, err := os.ReadFile(filepath.Join(tempDir, innerPath))
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), "customer log line")
+	})
+
+	t.Run("Tampering is detected", func(t *testing.T) {
+		tampered, err := store.Save(strings.NewReader(plaintext), "log.txt")
+		require.NoError(t, err)
+
+		file := filepath.Join(tempDir, innerStoragePath(tampered))
+		stored, err := os.ReadFile(file)
+		require.NoError(t, err)
+		stored[0] ^= 1
+		require.NoError(t, os.WriteFile(file, stored, 0644))
+
+		_, err = read(t, store, tampered)
+		assert.ErrorIs(t, err, ErrCorrupt)
+
+		// Truncating the content is detected too
+		require.NoError(t, os.WriteFile(file, stored[:len(stored)-1], 0644))
+		_, err = read(t, store, tampered)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("Unencrypted content is passed through", func(t *testing.T) {
+		legacy, err := inner.Save(strings.NewReader(plaintext), "legacy.txt")
+		require.NoError(t, err)
+
+		data, err := read(t, store, legacy)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, string(data))
+	})
+
+	t.Run("Rotation rewraps without rewriting content", func(t *testing.T) {
+		before, err := os.ReadFile(filepath.Join(tempDir, innerPath))
+		require.NoError(t, err)
+
+		rotated, err := NewEncryptedStore(inner, newTestKey(t), []string{oldKey})
+		require.NoError(t, err)
+
+		newPath, err := rotated.Rewrap(path)
+		require.NoError(t, err)
+		assert.NotEqual(t, path, newPath)
+		assert.Equal(t, innerPath, innerStoragePath(newPath))
+
+		// Rewrapping again is a no-op
+		again, err := rotated.Rewrap(newPath)
+		require.NoError(t, err)
+		assert.Equal(t, newPath, again)
+
+		after, err := os.ReadFile(filepath.Join(tempDir, innerPath))
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+
+		data, err := read(t, rotated, newPath)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, string(data))
+
+		// A store without the new key can't read the rewrapped path
+		_, err = read(t, store, newPath)
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	})
+
+	t.Run("Wrapped keys are bound to their content", func(t *testing.T) {
+		other, err := store.Save(strings.NewReader("other"), "other.txt")
+		require.NoError(t, err)
+
+		keyID, wrapped, _, ok := parseEncryptedPath(path)
+		require.True(t, ok)
+		swapped := encryptedPathPrefix + keyID + ":" + wrapped + ":" + innerStoragePath(other)
+
+		_, err = read(t, store, swapped)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("Invalid keys", func(t *testing.T) {
+		_, err := NewEncryptedStore(inner, "not base64!", nil)
+		assert.Error(t, err)
+
+		_, err = NewEncryptedStore(inner, base64.StdEncoding.EncodeToString([]byte("too short")), nil)
+		assert.Error(t, err)
+
+		_, err = NewEncryptedStore(inner, newTestKey(t), []string{"not base64!"})
+		assert.Error(t, err)
+	})
+}
@@ -2,51 +2,192 @@ package storage
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 
 	"github.com/watzon/0x45/internal/config"
 	"github.com/watzon/0x45/internal/storage/local"
+	"github.com/watzon/0x45/internal/storage/memory"
 	"github.com/watzon/0x45/internal/storage/s3"
+	"github.com/watzon/0x45/internal/storage/webdav"
 )
 
 type StorageManager struct {
-	stores map[string]Store
+	stores   map[string]Store
+	backends map[string]Store // Stores without their cache and replica
+	caches   map[string]*CachedStore
+	replicas map[string]*ReplicatedStore
 }
 
 func NewStorageManager(cfg *config.Config) (*StorageManager, error) {
 	manager := &StorageManager{
-		stores: make(map[string]Store),
+		stores:   make(map[string]Store),
+		backends: make(map[string]Store),
+		caches:   make(map[string]*CachedStore),
+		replicas: make(map[string]*ReplicatedStore),
 	}
 
+	// Backends are created up front, since replicas are configured as
+	// storages of their own
+	backends := make(map[string]Store, len(cfg.Storage))
 	for _, storageCfg := range cfg.Storage {
-		var store Store
-		var err error
+		store, err := newBackend(cfg, storageCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize storage %s: %w", storageCfg.Name, err)
+		}
+		backends[storageCfg.Name] = store
+	}
 
-		switch storageCfg.Type {
-		case "local":
-			store, err = local.New(storageCfg.Path, cfg.Server.BaseURL, storageCfg.IsDefault)
-		case "s3":
-			store, err = s3.New(
-				storageCfg.S3Bucket,
-				storageCfg.S3Region,
-				storageCfg.S3Key,
-				storageCfg.S3Secret,
-				storageCfg.S3Endpoint,
-				storageCfg.IsDefault,
-			)
-		default:
-			return nil, fmt.Errorf("unsupported storage type: %s", storageCfg.Type)
+	for _, storageCfg := range cfg.Storage {
+		// Replicas are only reached through the storage they replicate
+		if cfg.IsReplica(storageCfg.Name) {
+			if storageCfg.IsDefault || storageCfg.Replica != "" {
+				return nil, fmt.Errorf("replica storage %s can't be the default or have a replica of its own", storageCfg.Name)
+			}
+			continue
 		}
 
+		store := backends[storageCfg.Name]
+
+		// Integrity checks read straight from the backend, so they see what's
+		// really stored there and don't churn the cache
+		backend, err := contentLayers(store, storageCfg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize storage %s: %w", storageCfg.Name, err)
 		}
+		manager.backends[storageCfg.Name] = backend
 
+		// Replication goes right in front of the backend, so the replica gets
+		// the content exactly as it's stored
+		if storageCfg.Replica != "" {
+			replica, ok := backends[storageCfg.Replica]
+			if !ok || storageCfg.Replica == storageCfg.Name {
+				return nil, fmt.Errorf("storage %s uses unknown replica: %s", storageCfg.Name, storageCfg.Replica)
+			}
+			opts, err := replicaOptions(storageCfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to initialize storage %s: %w", storageCfg.Name, err)
+			}
+			replicated, err := NewReplicatedStore(store, replica, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to initialize storage %s: %w", storageCfg.Name, err)
+			}
+			manager.replicas[storageCfg.Name] = replicated
+			store = replicated
+		}
+
+		// The cache goes in front of the backend, so it's keyed by the
+		// backend's paths and holds content as it's stored
+		if storageCfg.CacheSize > 0 || storageCfg.CacheDiskPath != "" {
+			cached, err := NewCachedStore(store, CacheOptions{
+				MemorySize:  storageCfg.CacheSize,
+				MaxItemSize: storageCfg.CacheMaxItemSize,
+				DiskPath:    storageCfg.CacheDiskPath,
+				DiskSize:    storageCfg.CacheDiskSize,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to initialize cache for storage %s: %w", storageCfg.Name, err)
+			}
+			manager.caches[storageCfg.Name] = cached
+			store = cached
+		}
+
+		store, err = contentLayers(store, storageCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize storage %s: %w", storageCfg.Name, err)
+		}
 		manager.stores[storageCfg.Name] = store
 	}
 
+	for _, route := range cfg.StorageRoutes {
+		if _, ok := manager.stores[route.Storage]; !ok {
+			return nil, fmt.Errorf("storage route %q uses unknown storage: %s", route.Name, route.Storage)
+		}
+	}
+
 	return manager, nil
 }
 
+// newBackend creates the backend of a storage, without any of the layers put
+// in front of it
+func newBackend(cfg *config.Config, storageCfg config.StorageConfig) (Store, error) {
+	switch storageCfg.Type {
+	case "local":
+		opts, err := localOptions(storageCfg)
+		if err != nil {
+			return nil, err
+		}
+		return local.New(storageCfg.Path, cfg.Server.BaseURL, storageCfg.IsDefault, opts)
+	case "s3":
+		return s3.New(
+			storageCfg.S3Bucket,
+			storageCfg.S3Region,
+			storageCfg.S3Key,
+			storageCfg.S3Secret,
+			storageCfg.S3Endpoint,
+			storageCfg.S3PresignExpiry,
+			storageCfg.IsDefault,
+		)
+	case "webdav":
+		return webdav.New(
+			storageCfg.WebDAVURL,
+			storageCfg.WebDAVUsername,
+			storageCfg.WebDAVPassword,
+			storageCfg.WebDAVTimeout,
+			storageCfg.IsDefault,
+		)
+	case "memory":
+		return memory.New(storageCfg.IsDefault), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", storageCfg.Type)
+	}
+}
+
+// contentLayers puts the layers encoding content at rest in front of a store
+func contentLayers(store Store, storageCfg config.StorageConfig) (Store, error) {
+	// Encrypt content at rest if a key is configured for this storage
+	if storageCfg.EncryptionKey != "" {
+		var err error
+		store, err = NewEncryptedStore(store, storageCfg.EncryptionKey, storageCfg.EncryptionPreviousKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Compression goes in front of encryption, encrypted content doesn't
+	// compress
+	return NewCompressedStore(store), nil
+}
+
+// replicaOptions returns how a storage is replicated
+func replicaOptions(cfg config.StorageConfig) (ReplicaOptions, error) {
+	switch cfg.ReplicaMode {
+	case "", "sync":
+		return ReplicaOptions{}, nil
+	case "async":
+		return ReplicaOptions{Async: true}, nil
+	default:
+		return ReplicaOptions{}, fmt.Errorf("unknown replica mode: %s", cfg.ReplicaMode)
+	}
+}
+
+// Close stops the background work of the stores
+func (m *StorageManager) Close() error {
+	for _, replicated := range m.replicas {
+		replicated.Close()
+	}
+	return nil
+}
+
+// ReplicationStats returns the stats of replicated stores, by store name
+func (m *StorageManager) ReplicationStats() map[string]ReplicationStats {
+	stats := make(map[string]ReplicationStats, len(m.replicas))
+	for name, replicated := range m.replicas {
+		stats[name] = replicated.Stats()
+	}
+	return stats
+}
+
 func (m *StorageManager) GetStore(name string) (Store, error) {
 	store, ok := m.stores[name]
 	if !ok {
@@ -69,3 +210,78 @@ func (m *StorageManager) GetDefaultStore() (Store, string, error) {
 
 	return nil, "", fmt.Errorf("no storage configurations available")
 }
+
+// CacheStats returns the stats of the caches in front of stores, by store
+// name
+func (m *StorageManager) CacheStats() map[string]CacheStats {
+	stats := make(map[string]CacheStats, len(m.caches))
+	for name, cache := range m.caches {
+		stats[name] = cache.Stats()
+	}
+	return stats
+}
+
+// DiskUsage returns the space used and the total space of the filesystem the
+// named store keeps its content on, with a total of zero for stores that
+// aren't on a local filesystem
+func (m *StorageManager) DiskUsage(name string) (int64, int64, error) {
+	store, err := m.GetStore(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return diskUsage(store)
+}
+
+// Provider returns a provider for the named store
+func (m *StorageManager) Provider(name string) (Provider, error) {
+	store, err := m.GetStore(name)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreProvider{store: store}, nil
+}
+
+// BackendProvider returns a provider for the named store that goes straight
+// to its backend, leaving out the cache and replica in front of it. Content
+// read through it isn't cached, and content missing from the backend isn't
+// read from the replica instead.
+func (m *StorageManager) BackendProvider(name string) (Provider, error) {
+	store, ok := m.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("storage not found: %s", name)
+	}
+	return &StoreProvider{store: store}, nil
+}
+
+// DefaultProvider returns a provider for the default store, along with its
+// name
+func (m *StorageManager) DefaultProvider() (Provider, string, error) {
+	store, name, err := m.GetDefaultStore()
+	if err != nil {
+		return nil, "", err
+	}
+	return &StoreProvider{store: store}, name, nil
+}
+
+// localOptions returns the options of a local storage, whose permissions are
+// configured as octal strings such as "0640"
+func localOptions(cfg config.StorageConfig) (local.Options, error) {
+	opts := local.Options{Layout: cfg.Layout}
+	for _, mode := range []struct {
+		value string
+		mode  *os.FileMode
+	}{
+		{cfg.FileMode, &opts.FileMode},
+		{cfg.DirMode, &opts.DirMode},
+	} {
+		if mode.value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(mode.value, 8, 32)
+		if err != nil || parsed > 0777 {
+			return opts, fmt.Errorf("invalid permissions: %s", mode.value)
+		}
+		*mode.mode = os.FileMode(parsed)
+	}
+	return opts, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// ObjectInfo describes a piece of content kept by a storage backend
+type ObjectInfo struct {
+	Path    string // Path within the backend, see ObjectPath
+	Size    int64  // Size as kept by the backend, after encryption and compression
+	ModTime time.Time
+}
+
+// ObjectPath returns the path under which content with the given storage
+// path is kept by the storage backend, without the markers added by
+// encryption and compression
+func ObjectPath(path string) string {
+	return innerStoragePath(strings.TrimPrefix(path, compressedPathPrefix))
+}
+
+// IsCompressedPath reports whether content with the given storage path is
+// compressed at rest
+func IsCompressedPath(path string) bool {
+	return strings.HasPrefix(path, compressedPathPrefix)
+}
+
+// isSavedPath reports whether a path is laid out like those of content saved
+// by the storage backends, which is put either in a directory per day or in
+// directories named after the hash of the filename
+func isSavedPath(path string) bool {
+	parts := strings.Split(path, "/")
+	if parts[len(parts)-1] == "" {
+		return false
+	}
+
+	switch len(parts) {
+	case 4:
+		_, err := time.Parse("2006/01/02", strings.Join(parts[:3], "/"))
+		return err == nil
+	case 3:
+		return isShard(parts[0]) && isShard(parts[1])
+	default:
+		return false
+	}
+}
+
+// isShard reports whether a directory name is part of a hash
+func isShard(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
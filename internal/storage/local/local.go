@@ -1,24 +1,64 @@
 package local
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Directory layouts for new content. Content is always read from the path it
+// was saved under, so the layout can be changed at any time.
+const (
+	LayoutDate = "date" // A directory per day, such as 2006/01/02
+	LayoutHash = "hash" // Two levels of directories named after the hash of the filename, such as 3f/a2
+)
+
+// ErrInvalidPath is returned for paths that would lead outside of the store
+var ErrInvalidPath = errors.New("invalid storage path")
+
+// Options adjusts how a LocalStore lays out and writes files. The zero value
+// uses the date layout and the usual permissions.
+type Options struct {
+	Layout   string
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
 type LocalStore struct {
 	basePath  string
 	baseURL   string
 	isDefault bool
+	layout    string
+	fileMode  os.FileMode
+	dirMode   os.FileMode
 }
 
-func New(basePath, baseURL string, isDefault bool) (*LocalStore, error) {
+func New(basePath, baseURL string, isDefault bool, opts Options) (*LocalStore, error) {
+	switch opts.Layout {
+	case "":
+		opts.Layout = LayoutDate
+	case LayoutDate, LayoutHash:
+	default:
+		return nil, fmt.Errorf("unknown storage layout: %s", opts.Layout)
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = 0644
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = 0755
+	}
+
 	// Ensure base path exists
-	if err := os.MkdirAll(basePath, 0755); err != nil {
+	if err := os.MkdirAll(basePath, opts.DirMode); err != nil {
 		return nil, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
@@ -26,45 +66,158 @@ func New(basePath, baseURL string, isDefault bool) (*LocalStore, error) {
 		basePath:  basePath,
 		baseURL:   baseURL,
 		isDefault: isDefault,
+		layout:    opts.Layout,
+		fileMode:  opts.FileMode,
+		dirMode:   opts.DirMode,
 	}, nil
 }
 
-func (s *LocalStore) Save(content io.Reader, filename string) (string, error) {
-	// First read all content into memory
-	data, err := io.ReadAll(content)
-	if err != nil {
-		return "", fmt.Errorf("failed to read content: %w", err)
+// fullPath returns where the content at a storage path is on disk, making
+// sure it's within the base path
+func (s *LocalStore) fullPath(path string) (string, error) {
+	path = filepath.FromSlash(path)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPath, path)
 	}
+	return filepath.Join(s.basePath, path), nil
+}
+
+// storagePath returns the path new content with the given unique filename is
+// saved under
+func (s *LocalStore) storagePath(filename string) string {
+	if s.layout == LayoutHash {
+		sum := sha256.Sum256([]byte(filename))
+		shard := hex.EncodeToString(sum[:2])
+		return filepath.Join(shard[:2], shard[2:], filename)
+	}
+	return filepath.Join(time.Now().Format("2006/01/02"), filename)
+}
 
+// Save writes content to a temporary file next to its destination, which is
+// only renamed into place once it's been flushed to disk. Readers never see
+// partially written content, and content is never lost to a crash once saved.
+func (s *LocalStore) Save(content io.Reader, filename string) (string, error) {
 	// Generate unique filename by adding UUID
+	filename = filepath.Base(filename)
 	ext := filepath.Ext(filename)
 	baseFilename := filename[:len(filename)-len(ext)]
 	uniqueFilename := fmt.Sprintf("%s-%s%s", baseFilename, uuid.New().String(), ext)
 
-	// Generate unique path
-	storagePath := filepath.Join(time.Now().Format("2006/01/02"), uniqueFilename)
-	fullPath := filepath.Join(s.basePath, storagePath)
+	storagePath := s.storagePath(uniqueFilename)
+	if err := s.write(content, storagePath); err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(storagePath), nil
+}
+
+// SaveAt writes content at the given storage path, the same way Save does
+func (s *LocalStore) SaveAt(content io.Reader, path string) error {
+	return s.write(content, path)
+}
+
+// write streams content to a temporary file and renames it to the storage
+// path once it's on disk
+func (s *LocalStore) write(content io.Reader, storagePath string) error {
+	fullPath, err := s.fullPath(storagePath)
+	if err != nil {
+		return err
+	}
 
 	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-		return "", fmt.Errorf("failed to create directory: %w", err)
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, s.dirMode); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Write the file
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
-		return "", fmt.Errorf("failed to write file: %w", err)
+	// Temporary files are hidden, so they aren't listed as content
+	file, err := os.CreateTemp(dir, "."+filepath.Base(fullPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	tempPath := file.Name()
+	fail := func(msg string, err error) error {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+
+	// Stream the content straight to disk
+	if _, err := io.Copy(file, content); err != nil {
+		return fail("failed to write file", err)
+	}
+	if err := file.Chmod(s.fileMode); err != nil {
+		return fail("failed to set file permissions", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail("failed to sync file", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to close file: %w", err)
 	}
 
-	return storagePath, nil
+	if err := os.Rename(tempPath, fullPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	// The rename only survives a crash once the directory is synced too
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory's entries to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func (s *LocalStore) Get(path string) (io.ReadCloser, error) {
-	fullPath := filepath.Join(s.basePath, path)
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 	return os.Open(fullPath)
 }
 
+// GetRange seeks to offset in the file, so the content before it isn't read
+func (s *LocalStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rangeReader{Reader: io.LimitReader(file, length), file: file}, nil
+}
+
+// rangeReader reads part of a file
+type rangeReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *rangeReader) Close() error {
+	return r.file.Close()
+}
+
 func (s *LocalStore) Delete(path string) error {
-	fullPath := filepath.Join(s.basePath, path)
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return err
+	}
 	return os.Remove(fullPath)
 }
 
@@ -73,7 +226,10 @@ func (s *LocalStore) GetURL(path string) string {
 }
 
 func (s *LocalStore) GetSize(path string) (int64, error) {
-	fullPath := filepath.Join(s.basePath, path)
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return 0, err
+	}
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		return 0, err
@@ -87,6 +243,29 @@ func (s *LocalStore) SetExpiry(path string, expiry time.Time) error {
 	return nil
 }
 
+// List walks the base path, leaving out the temporary files of content that's
+// still being saved
+func (s *LocalStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return filepath.WalkDir(s.basePath, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(s.basePath, fullPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(path), info.Size(), info.ModTime())
+	})
+}
+
 func (s *LocalStore) SetDefault() error {
 	s.isDefault = true
 	return nil
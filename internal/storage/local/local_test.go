@@ -4,16 +4,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLocalStorage(t *testing.T) {
 	tempDir := t.TempDir()
 	baseURL := "http://localhost:3000"
-	store, err := New(tempDir, baseURL, true)
+	store, err := New(tempDir, baseURL, true, Options{})
 	assert.NoError(t, err)
 
 	t.Run("Save and Get", func(t *testing.T) {
@@ -49,3 +52,77 @@ func TestLocalStorage(t *testing.T) {
 		assert.True(t, os.IsNotExist(err))
 	})
 }
+
+func TestLocalStoragePaths(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := New(filepath.Join(tempDir, "uploads"), "", true, Options{})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "secret.txt"), []byte("outside"), 0644))
+
+	t.Run("Paths outside the base path are rejected", func(t *testing.T) {
+		for _, path := range []string{"../secret.txt", "2024/../../secret.txt", "/etc/passwd", ""} {
+			_, err := store.Get(path)
+			assert.ErrorIs(t, err, ErrInvalidPath, path)
+			_, err = store.GetSize(path)
+			assert.ErrorIs(t, err, ErrInvalidPath, path)
+			assert.ErrorIs(t, store.Delete(path), ErrInvalidPath, path)
+		}
+		assert.FileExists(t, filepath.Join(tempDir, "secret.txt"))
+	})
+
+	t.Run("Filenames can't choose the directory", func(t *testing.T) {
+		path, err := store.Save(strings.NewReader("content"), "../../escape.txt")
+		require.NoError(t, err)
+		assert.Regexp(t, `^\d{4}/\d{2}/\d{2}/escape-[0-9a-f-]+\.txt$`, path)
+	})
+}
+
+func TestLocalStorageLayouts(t *testing.T) {
+	tempDir := t.TempDir()
+	dated, err := New(tempDir, "", true, Options{})
+	require.NoError(t, err)
+	datedPath, err := dated.Save(strings.NewReader("saved by day"), "dated.txt")
+	require.NoError(t, err)
+
+	store, err := New(tempDir, "", true, Options{Layout: LayoutHash, FileMode: 0600, DirMode: 0700})
+	require.NoError(t, err)
+
+	path, err := store.Save(strings.NewReader("saved by hash"), "hashed.txt")
+	require.NoError(t, err)
+
+	t.Run("New content is sharded by hash", func(t *testing.T) {
+		assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}/hashed-[0-9a-f-]+\.txt$`), path)
+
+		info, err := os.Stat(filepath.Join(tempDir, path))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		info, err = os.Stat(filepath.Dir(filepath.Join(tempDir, path)))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm()&0700)
+	})
+
+	t.Run("Content in the date layout is still read", func(t *testing.T) {
+		file, err := store.Get(datedPath)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, "saved by day", string(data))
+	})
+
+	t.Run("Content in both layouts is listed", func(t *testing.T) {
+		var listed []string
+		require.NoError(t, store.List(func(path string, size int64, modTime time.Time) error {
+			listed = append(listed, path)
+			return nil
+		}))
+		assert.ElementsMatch(t, []string{datedPath, path}, listed)
+	})
+
+	t.Run("Unknown layouts are rejected", func(t *testing.T) {
+		_, err := New(tempDir, "", true, Options{Layout: "random"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package local
+
+import "syscall"
+
+// DiskUsage returns the space used and the total space of the filesystem the
+// storage is on. Space reserved for the superuser counts as used, since the
+// server can't write to it.
+func (s *LocalStore) DiskUsage() (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.basePath, &stat); err != nil {
+		return 0, 0, err
+	}
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	return total - available, total, nil
+}
@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// file is content held by a MemoryStore
+type file struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryStore keeps content in memory. Content is lost when the server stops,
+// so it's meant for tests and throwaway instances.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	files     map[string]file
+	isDefault bool
+}
+
+func New(isDefault bool) *MemoryStore {
+	return &MemoryStore{
+		files:     make(map[string]file),
+		isDefault: isDefault,
+	}
+}
+
+func (s *MemoryStore) Save(content io.Reader, filename string) (string, error) {
+	// Generate unique filename by adding UUID
+	filename = path.Base(filename)
+	ext := path.Ext(filename)
+	baseFilename := filename[:len(filename)-len(ext)]
+	uniqueFilename := fmt.Sprintf("%s-%s%s", baseFilename, uuid.New().String(), ext)
+	storagePath := path.Join(time.Now().Format("2006/01/02"), uniqueFilename)
+
+	if err := s.SaveAt(content, storagePath); err != nil {
+		return "", err
+	}
+	return storagePath, nil
+}
+
+// SaveAt stores content at the given path, replacing whatever is there
+func (s *MemoryStore) SaveAt(content io.Reader, p string) error {
+	if !fs.ValidPath(p) || p == "." {
+		return fmt.Errorf("invalid storage path: %s", p)
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("failed to read content: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = file{data: data, modTime: time.Now()}
+	return nil
+}
+
+// get returns the content at p
+func (s *MemoryStore) get(p string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[p]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+	}
+	return f.data, nil
+}
+
+func (s *MemoryStore) Get(path string) (io.ReadCloser, error) {
+	data, err := s.get(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// GetRange slices the content, nothing before the range is read
+func (s *MemoryStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	data, err := s.get(path)
+	if err != nil {
+		return nil, err
+	}
+	offset = min(offset, int64(len(data)))
+	end := min(offset+length, int64(len(data)))
+	return io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (s *MemoryStore) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; !ok {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *MemoryStore) GetURL(path string) string {
+	// Content in memory has no URL of its own
+	return ""
+}
+
+func (s *MemoryStore) GetSize(path string) (int64, error) {
+	data, err := s.get(path)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (s *MemoryStore) SetExpiry(path string, expiry time.Time) error {
+	// Expired content is deleted by the cleanup task
+	return nil
+}
+
+// List calls fn in path order, without holding the lock while it runs
+func (s *MemoryStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	s.mu.RLock()
+	paths := make([]string, 0, len(s.files))
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	s.mu.RUnlock()
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		s.mu.RLock()
+		f, ok := s.files[p]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(p, int64(len(f.data)), f.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetDefault() error {
+	s.isDefault = true
+	return nil
+}
+
+func (s *MemoryStore) IsDefault() bool {
+	return s.isDefault
+}
+
+func (s *MemoryStore) Type() string {
+	return "memory"
+}
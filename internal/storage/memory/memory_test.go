@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	store := New(true)
+
+	content := "kept in memory"
+	path, err := store.Save(strings.NewReader(content), "notes.txt")
+	require.NoError(t, err)
+	assert.Regexp(t, `^\d{4}/\d{2}/\d{2}/notes-[0-9a-f-]+\.txt$`, path)
+
+	t.Run("Get", func(t *testing.T) {
+		file, err := store.Get(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		file, err := store.GetRange(path, 8, 100)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, "memory", string(data))
+	})
+
+	t.Run("GetSize", func(t *testing.T) {
+		size, err := store.GetSize(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), size)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		listed := make(map[string]int64)
+		require.NoError(t, store.List(func(path string, size int64, modTime time.Time) error {
+			listed[path] = size
+			assert.False(t, modTime.IsZero())
+			return nil
+		}))
+		assert.Equal(t, map[string]int64{path: int64(len(content))}, listed)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, store.Delete(path))
+
+		_, err := store.Get(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.ErrorIs(t, store.Delete(path), fs.ErrNotExist)
+	})
+}
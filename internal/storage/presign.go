@@ -0,0 +1,11 @@
+package storage
+
+// Presigner is implemented by stores that can hand out short-lived URLs for
+// clients to fetch content from directly, instead of through the server
+type Presigner interface {
+	// PresignGet returns a URL the content at path can be downloaded from
+	// for a limited time, or an empty string if the content can't be served
+	// that way. Responses from the URL carry the given Content-Type and
+	// Content-Disposition where they're set.
+	PresignGet(path, contentType, contentDisposition string) (string, error)
+}
@@ -2,8 +2,7 @@ package storage
 
 import (
 	"io"
-
-	"github.com/watzon/0x45/internal/config"
+	"time"
 )
 
 // Provider defines the interface for storage implementations
@@ -12,8 +11,30 @@ type Provider interface {
 	Put(path string, content io.Reader) (string, error)
 	// Get retrieves content at the given path
 	Get(path string) ([]byte, error)
+	// Open returns a stream of the content at the given path
+	Open(path string) (io.ReadCloser, error)
+	// OpenRange returns a stream of length bytes of the content at the given
+	// path, starting at offset
+	OpenRange(path string, offset, length int64) (io.ReadCloser, error)
 	// Delete removes content at the given path
 	Delete(path string) error
+	// Rewrap moves encrypted content at the given path to the current
+	// encryption key, returning its new path
+	Rewrap(path string) (string, error)
+	// PutCompressed stores content compressed at rest where supported and
+	// returns the full storage path
+	PutCompressed(path string, content io.Reader) (string, error)
+	// OpenCompressed returns a stream of the content at the given path as it
+	// was compressed, or false if it wasn't stored compressed
+	OpenCompressed(path string) (io.ReadCloser, bool, error)
+	// Size returns the size of the content at the given path as stored
+	Size(path string) (int64, error)
+	// List calls fn for all content saved in the store, leaving out anything
+	// else that happens to be kept in the same place
+	List(fn func(ObjectInfo) error) error
+	// Presign returns a short-lived URL to download the content at the given
+	// path from directly, or an empty string where that isn't supported
+	Presign(path, contentType, contentDisposition string) (string, error)
 }
 
 // StoreProvider wraps a Store to implement the Provider interface
@@ -21,21 +42,6 @@ type StoreProvider struct {
 	store Store
 }
 
-// NewProvider creates a new storage provider based on configuration
-func NewProvider(cfg *config.Config) Provider {
-	manager, err := NewStorageManager(cfg)
-	if err != nil {
-		panic(err) // TODO: Better error handling
-	}
-
-	store, _, err := manager.GetDefaultStore()
-	if err != nil {
-		panic(err) // TODO: Better error handling
-	}
-
-	return &StoreProvider{store: store}
-}
-
 func (p *StoreProvider) Put(path string, content io.Reader) (string, error) {
 	return p.store.Save(content, path)
 }
@@ -50,6 +56,60 @@ func (p *StoreProvider) Get(path string) ([]byte, error) {
 	return io.ReadAll(reader)
 }
 
+func (p *StoreProvider) Open(path string) (io.ReadCloser, error) {
+	return p.store.Get(path)
+}
+
+func (p *StoreProvider) OpenRange(path string, offset, length int64) (io.ReadCloser, error) {
+	return getRange(p.store, path, offset, length)
+}
+
 func (p *StoreProvider) Delete(path string) error {
 	return p.store.Delete(path)
 }
+
+func (p *StoreProvider) Rewrap(path string) (string, error) {
+	rewrapper, ok := p.store.(Rewrapper)
+	if !ok {
+		return path, nil
+	}
+	return rewrapper.Rewrap(path)
+}
+
+func (p *StoreProvider) PutCompressed(path string, content io.Reader) (string, error) {
+	compressor, ok := p.store.(Compressor)
+	if !ok {
+		return p.store.Save(content, path)
+	}
+	return compressor.SaveCompressed(content, path)
+}
+
+func (p *StoreProvider) OpenCompressed(path string) (io.ReadCloser, bool, error) {
+	compressor, ok := p.store.(Compressor)
+	if !ok {
+		return nil, false, nil
+	}
+
+	return compressor.GetCompressed(path)
+}
+
+func (p *StoreProvider) Size(path string) (int64, error) {
+	return p.store.GetSize(path)
+}
+
+func (p *StoreProvider) List(fn func(ObjectInfo) error) error {
+	return p.store.List(func(path string, size int64, modTime time.Time) error {
+		if !isSavedPath(path) {
+			return nil
+		}
+		return fn(ObjectInfo{Path: path, Size: size, ModTime: modTime})
+	})
+}
+
+func (p *StoreProvider) Presign(path, contentType, contentDisposition string) (string, error) {
+	presigner, ok := p.store.(Presigner)
+	if !ok {
+		return "", nil
+	}
+	return presigner.PresignGet(path, contentType, contentDisposition)
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"io"
+)
+
+// Ranger is implemented by stores that can read part of their content
+// without reading everything before it
+type Ranger interface {
+	// GetRange returns a stream of length bytes of the content at path,
+	// starting at offset
+	GetRange(path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// getRange reads a range of content from store, seeking where the store
+// supports it and skipping over the content before the range otherwise
+func getRange(store Store, path string, offset, length int64) (io.ReadCloser, error) {
+	if ranger, ok := store.(Ranger); ok {
+		return ranger.GetRange(path, offset, length)
+	}
+
+	content, err := store.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return skipToRange(content, offset, length)
+}
+
+// skipToRange discards content up to offset and limits what's left to
+// length bytes
+func skipToRange(content io.ReadCloser, offset, length int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, content, offset); err != nil {
+		content.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(content, length), Closer: content}, nil
+}
+
+// limitedReadCloser reads part of a stream and closes the whole of it
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
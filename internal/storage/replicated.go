@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PathSaver is implemented by stores that can save content at a path of the
+// caller's choosing, which replicas need to keep content at the same paths as
+// their primary
+type PathSaver interface {
+	// SaveAt stores content at path, replacing any content already there
+	SaveAt(content io.Reader, path string) error
+}
+
+// ReplicaOptions configures how a ReplicatedStore keeps its replica up to
+// date
+type ReplicaOptions struct {
+	Async       bool          // Replicate through a background queue instead of before returning
+	MaxAttempts int           // Attempts at each queued write or delete, 10 if zero
+	MaxQueued   int           // Writes and deletes the queue holds before new ones fail, 10000 if zero
+	RetryDelay  time.Duration // Pause after a failed attempt, doubled while attempts keep failing; a second if zero
+}
+
+// ReplicationStats counts the work of a ReplicatedStore
+type ReplicationStats struct {
+	Pending   int64 // Writes and deletes queued for the replica
+	Failed    int64 // Writes and deletes given up on, or that didn't fit in the queue
+	Failovers int64 // Reads served by the replica after the primary failed
+}
+
+// maxRetryDelay caps the pause after failed attempts at queued replication
+const maxRetryDelay = 5 * time.Minute
+
+// ReplicatedStore mirrors a primary store to a replica, keeping content at
+// the same paths in both. Content is read from the primary, and from the
+// replica when the primary fails. Deletes go to both.
+//
+// In sync mode writes return once the content is in both stores. In async
+// mode they return once it's in the primary, and a background queue copies it
+// to the replica. A failed write or delete goes to the back of the queue, so
+// it doesn't hold up the others, and the queue pauses for a growing delay
+// while the replica keeps failing. The queue is bounded and kept in memory,
+// so what doesn't fit in it, or is left in it when the server stops, is lost;
+// the replica then misses that content until it's written again.
+type ReplicatedStore struct {
+	primary Store
+	replica Store
+	saver   PathSaver
+	opts    ReplicaOptions
+
+	mu     sync.Mutex
+	queue  []string                   // Paths with a queued task, oldest first
+	tasks  map[string]replicationTask // Queued task for each path
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+
+	pending   atomic.Int64
+	failed    atomic.Int64
+	failovers atomic.Int64
+}
+
+// replicationTask is a queued write or delete for the replica
+type replicationTask struct {
+	path     string
+	delete   bool
+	attempts int // Failed attempts so far
+}
+
+// NewReplicatedStore mirrors primary to replica, which must be able to save
+// content at given paths
+func NewReplicatedStore(primary, replica Store, opts ReplicaOptions) (*ReplicatedStore, error) {
+	saver, ok := replica.(PathSaver)
+	if !ok {
+		return nil, fmt.Errorf("%s storage can't be used as a replica", replica.Type())
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 10
+	}
+	if opts.MaxQueued == 0 {
+		opts.MaxQueued = 10000
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = time.Second
+	}
+
+	s := &ReplicatedStore{
+		primary: primary,
+		replica: replica,
+		saver:   saver,
+		opts:    opts,
+		tasks:   make(map[string]replicationTask),
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	if opts.Async {
+		go s.run()
+	}
+	return s, nil
+}
+
+// Stats returns how much replication is pending and how much failed so far
+func (s *ReplicatedStore) Stats() ReplicationStats {
+	return ReplicationStats{
+		Pending:   s.pending.Load(),
+		Failed:    s.failed.Load(),
+		Failovers: s.failovers.Load(),
+	}
+}
+
+// Close stops the background queue, dropping what's left in it
+func (s *ReplicatedStore) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+// Save stores content in the primary, and copies it from there to the
+// replica. In sync mode content that can't be copied is deleted from the
+// primary again, so a successful save is always in both stores.
+func (s *ReplicatedStore) Save(content io.Reader, filename string) (string, error) {
+	path, err := s.primary.Save(content, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if s.opts.Async {
+		s.enqueue(replicationTask{path: path})
+		return path, nil
+	}
+
+	if err := s.copyToReplica(path); err != nil {
+		_ = s.primary.Delete(path)
+		return "", fmt.Errorf("failed to replicate content: %w", err)
+	}
+	return path, nil
+}
+
+// copyToReplica copies the content at path from the primary to the replica
+func (s *ReplicatedStore) copyToReplica(path string) error {
+	content, err := s.primary.Get(path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return s.saver.SaveAt(content, path)
+}
+
+func (s *ReplicatedStore) Get(path string) (io.ReadCloser, error) {
+	content, err := s.primary.Get(path)
+	if err == nil {
+		return content, nil
+	}
+	if content, replicaErr := s.replica.Get(path); replicaErr == nil {
+		s.failovers.Add(1)
+		return content, nil
+	}
+	return nil, err
+}
+
+func (s *ReplicatedStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	content, err := getRange(s.primary, path, offset, length)
+	if err == nil {
+		return content, nil
+	}
+	if content, replicaErr := getRange(s.replica, path, offset, length); replicaErr == nil {
+		s.failovers.Add(1)
+		return content, nil
+	}
+	return nil, err
+}
+
+func (s *ReplicatedStore) GetSize(path string) (int64, error) {
+	size, err := s.primary.GetSize(path)
+	if err == nil {
+		return size, nil
+	}
+	if size, replicaErr := s.replica.GetSize(path); replicaErr == nil {
+		return size, nil
+	}
+	return 0, err
+}
+
+// Delete removes the content from both stores. Content that's missing from
+// one of them still counts as deleted if it was in the other.
+func (s *ReplicatedStore) Delete(path string) error {
+	err := s.primary.Delete(path)
+
+	if s.opts.Async {
+		s.enqueue(replicationTask{path: path, delete: true})
+		return err
+	}
+
+	replicaErr := s.replica.Delete(path)
+	switch {
+	case replicaErr == nil && errors.Is(err, fs.ErrNotExist):
+		return nil
+	case replicaErr != nil && !errors.Is(replicaErr, fs.ErrNotExist):
+		return errors.Join(err, fmt.Errorf("failed to delete replicated content: %w", replicaErr))
+	}
+	return err
+}
+
+func (s *ReplicatedStore) GetURL(path string) string {
+	return s.primary.GetURL(path)
+}
+
+func (s *ReplicatedStore) PresignGet(path, contentType, contentDisposition string) (string, error) {
+	presigner, ok := s.primary.(Presigner)
+	if !ok {
+		return "", nil
+	}
+	return presigner.PresignGet(path, contentType, contentDisposition)
+}
+
+func (s *ReplicatedStore) DiskUsage() (int64, int64, error) {
+	return diskUsage(s.primary)
+}
+
+// SetExpiry sets the expiry in both stores. Expiry is only a hint to the
+// stores, the cleanup task deletes expired content, so the replica failing to
+// take it isn't an error.
+func (s *ReplicatedStore) SetExpiry(path string, expiry time.Time) error {
+	_ = s.replica.SetExpiry(path, expiry)
+	return s.primary.SetExpiry(path, expiry)
+}
+
+func (s *ReplicatedStore) Type() string {
+	return s.primary.Type()
+}
+
+func (s *ReplicatedStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return s.primary.List(fn)
+}
+
+func (s *ReplicatedStore) SetDefault() error {
+	return s.primary.SetDefault()
+}
+
+func (s *ReplicatedStore) IsDefault() bool {
+	return s.primary.IsDefault()
+}
+
+// enqueue adds a task to the background queue. Each task brings the replica
+// in line with the primary's current content at its path, so a task replaces
+// any still queued for the same path, and keeps its place in the queue. A
+// task that doesn't fit in the queue is counted as failed.
+func (s *ReplicatedStore) enqueue(task replicationTask) {
+	s.mu.Lock()
+	if _, ok := s.tasks[task.path]; ok {
+		s.tasks[task.path] = task
+		s.mu.Unlock()
+		return
+	}
+	// The task being carried out counts towards the bound too
+	if s.pending.Load() >= int64(s.opts.MaxQueued) {
+		s.mu.Unlock()
+		s.failed.Add(1)
+		return
+	}
+	s.queue = append(s.queue, task.path)
+	s.tasks[task.path] = task
+	s.pending.Add(1)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the task at the front of the queue
+func (s *ReplicatedStore) next() (replicationTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return replicationTask{}, false
+	}
+	path := s.queue[0]
+	s.queue = s.queue[1:]
+	task := s.tasks[path]
+	delete(s.tasks, path)
+	return task, true
+}
+
+// retry puts a failed task at the back of the queue, unless it has run out of
+// attempts or a newer task for its path was queued while it was being tried
+func (s *ReplicatedStore) retry(task replicationTask) {
+	task.attempts++
+
+	s.mu.Lock()
+	_, replaced := s.tasks[task.path]
+	if !replaced && task.attempts < s.opts.MaxAttempts {
+		s.queue = append(s.queue, task.path)
+		s.tasks[task.path] = task
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.pending.Add(-1)
+	if !replaced {
+		s.failed.Add(1)
+	}
+}
+
+// run works through the background queue. Tasks for the same path are carried
+// out in the order they were queued, so a delete never reaches the replica
+// before the write it follows.
+func (s *ReplicatedStore) run() {
+	var delay time.Duration
+	for {
+		task, ok := s.next()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+
+		if s.apply(task) == nil {
+			s.pending.Add(-1)
+			delay = 0
+			continue
+		}
+		s.retry(task)
+
+		// The replica may be down, in which case the next task would fail
+		// just the same
+		if delay == 0 {
+			delay = s.opts.RetryDelay
+		} else {
+			delay = min(delay*2, maxRetryDelay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// apply carries out a task once. Content deleted from the primary before it
+// was copied has nothing left to copy, and content already gone from the
+// replica is deleted.
+func (s *ReplicatedStore) apply(task replicationTask) error {
+	var err error
+	if task.delete {
+		err = s.replica.Delete(task.path)
+	} else {
+		err = s.copyToReplica(task.path)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/watzon/0x45/internal/storage/memory"
+)
+
+// flakyStore fails writes while it's down, and always fails writes to paths
+// containing broken
+type flakyStore struct {
+	*memory.MemoryStore
+	down   atomic.Bool
+	broken string
+}
+
+func (s *flakyStore) SaveAt(content io.Reader, path string) error {
+	if s.down.Load() {
+		return errors.New("replica is down")
+	}
+	if s.broken != "" && strings.Contains(path, s.broken) {
+		return errors.New("path can't be written")
+	}
+	return s.MemoryStore.SaveAt(content, path)
+}
+
+func TestReplicatedStore(t *testing.T) {
+	content := "replicated content"
+
+	t.Run("Sync writes reach both stores", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false)}
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{})
+		require.NoError(t, err)
+
+		path, err := store.Save(strings.NewReader(content), "sync.txt")
+		require.NoError(t, err)
+		assert.Equal(t, content, readAll(t, replica, path))
+
+		// Reads fail over to the replica
+		require.NoError(t, primary.Delete(path))
+		assert.Equal(t, content, readAll(t, store, path))
+		assert.Equal(t, int64(1), store.Stats().Failovers)
+
+		// Deletes reach both stores, even if one no longer has the content
+		require.NoError(t, store.Delete(path))
+		_, err = replica.Get(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.ErrorIs(t, store.Delete(path), fs.ErrNotExist)
+	})
+
+	t.Run("Sync writes fail if the replica does", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false)}
+		replica.down.Store(true)
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{})
+		require.NoError(t, err)
+
+		_, err = store.Save(strings.NewReader(content), "sync.txt")
+		assert.Error(t, err)
+
+		// Nothing is left behind in the primary
+		require.NoError(t, primary.List(func(path string, size int64, modTime time.Time) error {
+			t.Errorf("unexpected content at %s", path)
+			return nil
+		}))
+	})
+
+	t.Run("Async writes are retried until the replica is back", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false)}
+		replica.down.Store(true)
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{
+			Async:      true,
+			RetryDelay: time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer store.Close()
+
+		path, err := store.Save(strings.NewReader(content), "async.txt")
+		require.NoError(t, err)
+		assert.Equal(t, content, readAll(t, primary, path))
+		assert.Equal(t, int64(1), store.Stats().Pending)
+
+		replica.down.Store(false)
+		require.Eventually(t, func() bool {
+			return store.Stats().Pending == 0
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, content, readAll(t, replica, path))
+
+		// Deletes are queued after the writes they follow
+		require.NoError(t, store.Delete(path))
+		require.Eventually(t, func() bool {
+			return store.Stats().Pending == 0
+		}, time.Second, time.Millisecond)
+		_, err = replica.Get(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.Zero(t, store.Stats().Failed)
+	})
+
+	t.Run("Async writes are given up on after all attempts", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false)}
+		replica.down.Store(true)
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{
+			Async:       true,
+			MaxAttempts: 3,
+			RetryDelay:  time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer store.Close()
+
+		_, err = store.Save(strings.NewReader(content), "async.txt")
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return store.Stats().Failed == 1
+		}, time.Second, time.Millisecond)
+		assert.Zero(t, store.Stats().Pending)
+	})
+
+	t.Run("Failing async writes don't hold up the others", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false), broken: "broken"}
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{
+			Async:       true,
+			MaxAttempts: 1000,
+			RetryDelay:  time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer store.Close()
+
+		_, err = store.Save(strings.NewReader(content), "broken.txt")
+		require.NoError(t, err)
+		path, err := store.Save(strings.NewReader(content), "async.txt")
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return store.Stats().Pending == 1
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, content, readAll(t, replica, path))
+	})
+
+	t.Run("Async writes that don't fit in the queue fail", func(t *testing.T) {
+		primary, replica := memory.New(true), &flakyStore{MemoryStore: memory.New(false)}
+		replica.down.Store(true)
+		store, err := NewReplicatedStore(primary, replica, ReplicaOptions{
+			Async:      true,
+			MaxQueued:  1,
+			RetryDelay: time.Hour,
+		})
+		require.NoError(t, err)
+		defer store.Close()
+
+		for _, filename := range []string{"first.txt", "second.txt"} {
+			_, err := store.Save(strings.NewReader(content), filename)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int64(1), store.Stats().Pending)
+		assert.Equal(t, int64(1), store.Stats().Failed)
+	})
+}
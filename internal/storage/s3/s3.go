@@ -5,24 +5,31 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 )
 
 type S3Store struct {
 	client    *s3.Client
+	uploader  *manager.Uploader
+	presigner *s3.PresignClient
 	bucket    string
 	region    string
 	endpoint  string
 	isDefault bool
+
+	// How long presigned URLs are valid for, presigning is disabled if zero
+	presignExpiry time.Duration
 }
 
-func New(bucket, region, key, secret, endpoint string, isDefault bool) (*S3Store, error) {
+func New(bucket, region, key, secret, endpoint string, presignExpiry time.Duration, isDefault bool) (*S3Store, error) {
 	cfg, err := config.LoadDefaultConfig(context.Background(),
 		config.WithRegion(region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(key, secret, "")),
@@ -44,10 +51,14 @@ func New(bucket, region, key, secret, endpoint string, isDefault bool) (*S3Store
 
 	return &S3Store{
 		client:    client,
+		uploader:  manager.NewUploader(client),
+		presigner: s3.NewPresignClient(client, s3.WithPresignExpires(presignExpiry)),
 		bucket:    bucket,
 		region:    region,
 		endpoint:  endpoint,
 		isDefault: isDefault,
+
+		presignExpiry: presignExpiry,
 	}, nil
 }
 
@@ -56,17 +67,25 @@ func (s *S3Store) Save(content io.Reader, filename string) (string, error) {
 	baseFilename := filename[:len(filename)-len(ext)]
 	uniqueFilename := fmt.Sprintf("%s-%s%s", baseFilename, uuid.New().String(), ext)
 	storagePath := filepath.Join(time.Now().Format("2006/01/02"), uniqueFilename)
+	if err := s.SaveAt(content, storagePath); err != nil {
+		return "", err
+	}
+	return storagePath, nil
+}
 
-	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+// SaveAt uploads content to the object with the given path as its key
+func (s *S3Store) SaveAt(content io.Reader, path string) error {
+	// The uploader streams the content in parts, so it doesn't need a seekable
+	// reader or a known content length up front
+	_, err := s.uploader.Upload(context.Background(), &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(storagePath),
+		Key:    aws.String(path),
 		Body:   content,
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to upload to S3: %w", err)
+		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
-
-	return storagePath, nil
+	return nil
 }
 
 func (s *S3Store) Get(path string) (io.ReadCloser, error) {
@@ -80,6 +99,23 @@ func (s *S3Store) Get(path string) (io.ReadCloser, error) {
 	return result.Body, nil
 }
 
+// GetRange has S3 send only the requested range of the object
+func (s *S3Store) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	result, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object range from S3: %w", err)
+	}
+	return result.Body, nil
+}
+
 func (s *S3Store) Delete(path string) error {
 	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -95,6 +131,32 @@ func (s *S3Store) GetURL(path string) string {
 	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, path)
 }
 
+// PresignGet returns a URL that's valid for the configured presign expiry.
+// Presigned URLs use the custom endpoint when one is set, so they work
+// against S3 compatible stores such as MinIO.
+func (s *S3Store) PresignGet(path, contentType, contentDisposition string) (string, error) {
+	if s.presignExpiry <= 0 {
+		return "", nil
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	}
+	if contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(contentDisposition)
+	}
+
+	req, err := s.presigner.PresignGetObject(context.Background(), input)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign S3 object: %w", err)
+	}
+	return req.URL, nil
+}
+
 func (s *S3Store) GetSize(path string) (int64, error) {
 	result, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -119,6 +181,24 @@ func (s *S3Store) SetExpiry(path string, expiry time.Time) error {
 	return err
 }
 
+func (s *S3Store) List(fn func(path string, size int64, modTime time.Time) error) error {
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to list objects in S3: %w", err)
+		}
+		for _, object := range page.Contents {
+			if err := fn(aws.ToString(object.Key), aws.ToInt64(object.Size), aws.ToTime(object.LastModified)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (s *S3Store) SetDefault() error {
 	s.isDefault = true
 	return nil
@@ -0,0 +1,44 @@
+package s3
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresignGet(t *testing.T) {
+	// Presigning is done locally, so no server needs to be running at the
+	// endpoint
+	const endpoint = "http://localhost:9000"
+
+	t.Run("URLs use the custom endpoint", func(t *testing.T) {
+		store, err := New("pastes", "us-east-1", "minio", "minio123", endpoint, 5*time.Minute, true)
+		require.NoError(t, err)
+
+		raw, err := store.PresignGet("2024/01/01/abc.zip", "application/octet-stream", `attachment; filename="abc.zip"`)
+		require.NoError(t, err)
+
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		assert.Equal(t, "localhost:9000", u.Host)
+		assert.Equal(t, "/pastes/2024/01/01/abc.zip", u.Path)
+
+		query := u.Query()
+		assert.Equal(t, "300", query.Get("X-Amz-Expires"))
+		assert.Equal(t, "application/octet-stream", query.Get("response-content-type"))
+		assert.Equal(t, `attachment; filename="abc.zip"`, query.Get("response-content-disposition"))
+		assert.NotEmpty(t, query.Get("X-Amz-Signature"))
+	})
+
+	t.Run("Presigning can be disabled", func(t *testing.T) {
+		store, err := New("pastes", "us-east-1", "minio", "minio123", endpoint, 0, true)
+		require.NoError(t, err)
+
+		raw, err := store.PresignGet("2024/01/01/abc.zip", "", "")
+		require.NoError(t, err)
+		assert.Empty(t, raw)
+	})
+}
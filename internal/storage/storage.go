@@ -33,4 +33,10 @@ type Store interface {
 
 	// IsDefault returns whether the storage backend is the default
 	IsDefault() bool
+
+	// List calls fn with the path, size and modification time of all content
+	// in the storage backend, stopping at the first error. Paths are those of
+	// the backend itself, without the markers added by encryption or
+	// compression.
+	List(fn func(path string, size int64, modTime time.Time) error) error
 }
@@ -0,0 +1,18 @@
+package storage
+
+// DiskUsager is implemented by stores that keep content on a filesystem whose
+// space they can report
+type DiskUsager interface {
+	// DiskUsage returns the bytes used and the total bytes of the filesystem
+	// the content is kept on, with a total of zero if it isn't known
+	DiskUsage() (used, total int64, err error)
+}
+
+// diskUsage returns the disk usage of store, or a total of zero if it can't
+// report it
+func diskUsage(store Store) (int64, int64, error) {
+	if usager, ok := store.(DiskUsager); ok {
+		return usager.DiskUsage()
+	}
+	return 0, 0, nil
+}
@@ -0,0 +1,352 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultTimeout is how long connecting to the server, and waiting for it to
+// start responding, may take when no timeout is configured. Bodies aren't
+// limited, so content of any size can still be streamed.
+const DefaultTimeout = 30 * time.Second
+
+// propfindBody asks for the properties List and GetSize need
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+type WebDAVStore struct {
+	client    *http.Client
+	endpoint  *url.URL
+	username  string
+	password  string
+	isDefault bool
+
+	// Collections known to exist, so they aren't created for every file
+	collections sync.Map
+}
+
+func New(endpoint, username, password string, timeout time.Duration, isDefault bool) (*WebDAVStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL: %s", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+
+	// A server that stops responding would otherwise hang requests forever
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+
+	return &WebDAVStore{
+		client:    &http.Client{Transport: transport},
+		endpoint:  u,
+		username:  username,
+		password:  password,
+		isDefault: isDefault,
+	}, nil
+}
+
+// url returns the URL of a path within the store. Paths of collections end
+// in a slash.
+func (s *WebDAVStore) url(p string) (string, error) {
+	if name := strings.TrimSuffix(p, "/"); p != "" && (!fs.ValidPath(name) || name == ".") {
+		return "", fmt.Errorf("invalid storage path: %s", p)
+	}
+	u := *s.endpoint
+	u.Path = u.Path + "/" + p
+	return u.String(), nil
+}
+
+// do sends a request for a path within the store, returning an error for
+// responses with a status other than those expected
+func (s *WebDAVStore) do(method, p string, body io.Reader, header http.Header, expected ...int) (*http.Response, error) {
+	target, err := s.url(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send WebDAV request: %w", err)
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	resp.Body.Close()
+	err = fmt.Errorf("WebDAV %s %s failed: %s", method, p, resp.Status)
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %w", err, fs.ErrNotExist)
+	}
+	return nil, err
+}
+
+// mkcol creates the collection at p along with its parents
+func (s *WebDAVStore) mkcol(p string) error {
+	if p == "." || p == "" {
+		return nil
+	}
+	if _, ok := s.collections.Load(p); ok {
+		return nil
+	}
+	if err := s.mkcol(path.Dir(p)); err != nil {
+		return err
+	}
+
+	// Collections that already exist can't be created again
+	resp, err := s.do("MKCOL", p+"/", nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	s.collections.Store(p, true)
+	return nil
+}
+
+func (s *WebDAVStore) Save(content io.Reader, filename string) (string, error) {
+	// Generate unique filename by adding UUID
+	filename = path.Base(filename)
+	ext := path.Ext(filename)
+	baseFilename := filename[:len(filename)-len(ext)]
+	uniqueFilename := fmt.Sprintf("%s-%s%s", baseFilename, uuid.New().String(), ext)
+
+	storagePath := path.Join(time.Now().Format("2006/01/02"), uniqueFilename)
+	if err := s.SaveAt(content, storagePath); err != nil {
+		return "", err
+	}
+	return storagePath, nil
+}
+
+// SaveAt uploads content to the given path, creating its collections first
+func (s *WebDAVStore) SaveAt(content io.Reader, p string) error {
+	if _, err := s.url(p); err != nil {
+		return err
+	}
+	if err := s.mkcol(path.Dir(p)); err != nil {
+		return fmt.Errorf("failed to create collection: %w", err)
+	}
+
+	// The content is streamed, so its length isn't known up front
+	resp, err := s.do(http.MethodPut, p, content, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("failed to upload to WebDAV: %w", err)
+	}
+	return resp.Body.Close()
+}
+
+func (s *WebDAVStore) Get(path string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, path, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetRange asks the server for only the requested range of the file. Servers
+// that ignore the Range header send the whole file, which is skipped to the
+// range instead.
+func (s *WebDAVStore) GetRange(path string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := s.do(http.MethodGet, path, nil, header, http.StatusPartialContent, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return &rangeReader{Reader: io.LimitReader(resp.Body, length), body: resp.Body}, nil
+}
+
+// rangeReader reads part of a response body
+type rangeReader struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r *rangeReader) Close() error {
+	return r.body.Close()
+}
+
+func (s *WebDAVStore) Delete(path string) error {
+	resp, err := s.do(http.MethodDelete, path, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *WebDAVStore) GetURL(path string) string {
+	u, err := s.url(path)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+func (s *WebDAVStore) GetSize(path string) (int64, error) {
+	entries, err := s.propfind(path, "0")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !entry.collection {
+			return entry.size, nil
+		}
+	}
+	return 0, fmt.Errorf("not a file: %s", path)
+}
+
+func (s *WebDAVStore) SetExpiry(path string, expiry time.Time) error {
+	// WebDAV has no notion of expiry, content is deleted by the cleanup task
+	return nil
+}
+
+// List walks the collections of the store one level at a time, since many
+// servers refuse PROPFIND requests of infinite depth
+func (s *WebDAVStore) List(fn func(path string, size int64, modTime time.Time) error) error {
+	return s.list("", fn)
+}
+
+func (s *WebDAVStore) list(dir string, fn func(path string, size int64, modTime time.Time) error) error {
+	target := dir
+	if dir != "" {
+		target = dir + "/"
+	}
+	entries, err := s.propfind(target, "1")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// The collection itself is part of the response
+		if entry.path == dir {
+			continue
+		}
+		if entry.collection {
+			if err := s.list(entry.path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(entry.path, entry.size, entry.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry is a file or collection described by a PROPFIND response
+type entry struct {
+	path       string // Path within the store
+	collection bool
+	size       int64
+	modTime    time.Time
+}
+
+// multistatus is the body of a PROPFIND response
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the entries at p, to the given depth
+func (s *WebDAVStore) propfind(p, depth string) ([]entry, error) {
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := s.do("PROPFIND", p, strings.NewReader(propfindBody), header, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed to parse WebDAV response: %w", err)
+	}
+
+	entries := make([]entry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href in WebDAV response: %s", r.Href)
+		}
+		rel := strings.TrimPrefix(href.Path, s.endpoint.Path)
+		e := entry{path: strings.Trim(rel, "/")}
+
+		for _, propstat := range r.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			e.collection = e.collection || prop.ResourceType.Collection != nil
+			e.size = max(e.size, prop.ContentLength)
+			if modTime, err := http.ParseTime(prop.LastModified); err == nil {
+				e.modTime = modTime
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *WebDAVStore) SetDefault() error {
+	s.isDefault = true
+	return nil
+}
+
+func (s *WebDAVStore) IsDefault() bool {
+	return s.isDefault
+}
+
+func (s *WebDAVStore) Type() string {
+	return "webdav"
+}
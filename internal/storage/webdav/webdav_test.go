@@ -0,0 +1,128 @@
+package webdav
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newTestServer starts an in-memory WebDAV server that requires basic auth
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "nas" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	server := newTestServer(t)
+	store, err := New(server.URL+"/dav/", "nas", "secret", 0, true)
+	require.NoError(t, err)
+
+	content := "stored on the NAS"
+	path, err := store.Save(strings.NewReader(content), "nas.txt")
+	require.NoError(t, err)
+
+	t.Run("Save and Get", func(t *testing.T) {
+		assert.Regexp(t, `^\d{4}/\d{2}/\d{2}/nas-[0-9a-f-]+\.txt$`, path)
+
+		file, err := store.Get(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("GetSize", func(t *testing.T) {
+		size, err := store.GetSize(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), size)
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		file, err := store.GetRange(path, 10, 3)
+		require.NoError(t, err)
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, "the", string(data))
+	})
+
+	t.Run("GetURL", func(t *testing.T) {
+		assert.Equal(t, server.URL+"/dav/"+path, store.GetURL(path))
+	})
+
+	t.Run("List", func(t *testing.T) {
+		other, err := store.Save(strings.NewReader("another file"), "other.txt")
+		require.NoError(t, err)
+
+		listed := make(map[string]int64)
+		require.NoError(t, store.List(func(path string, size int64, modTime time.Time) error {
+			listed[path] = size
+			assert.False(t, modTime.IsZero())
+			return nil
+		}))
+		assert.Equal(t, map[string]int64{path: int64(len(content)), other: 12}, listed)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, store.Delete(path))
+
+		_, err := store.Get(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.ErrorIs(t, store.Delete(path), fs.ErrNotExist)
+	})
+
+	t.Run("Paths outside the store are rejected", func(t *testing.T) {
+		_, err := store.Get("../secret.txt")
+		assert.Error(t, err)
+	})
+
+	t.Run("Credentials are required", func(t *testing.T) {
+		unauthorized, err := New(server.URL+"/dav", "nas", "wrong", 0, true)
+		require.NoError(t, err)
+
+		_, err = unauthorized.Save(strings.NewReader(content), "nas.txt")
+		assert.Error(t, err)
+	})
+}
+
+func TestWebDAVTimeout(t *testing.T) {
+	// A server that accepts requests but never answers them
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(hung) })
+
+	store, err := New(server.URL+"/dav", "nas", "secret", 100*time.Millisecond, true)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = store.GetSize("2024/01/01/hung.txt")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
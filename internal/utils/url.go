@@ -7,15 +7,26 @@ import (
 	"strings"
 )
 
+// OpenURL fetches a given URL and returns its body as a stream, along with
+// its length or -1 if the length isn't known. The caller is responsible for
+// closing the returned reader.
+func OpenURL(url string) (io.ReadCloser, int64, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
 // GetContentFromURL fetches the raw content of a given URL
 func GetContentFromURL(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	body, _, err := OpenURL(url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	content, err := io.ReadAll(resp.Body)
+	content, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
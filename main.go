@@ -43,6 +43,16 @@ func main() {
 
 	logger.Info("logger initialized", zap.String("level", logLevel.String()))
 
+	// Run a subcommand instead of the server if one is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-storage":
+			os.Exit(runMigrateStorage(ctx, cfg, logger, os.Args[2:]))
+		case "migrate-db":
+			os.Exit(runMigrateDB(cfg, logger, os.Args[2:]))
+		}
+	}
+
 	// Initialize server with storage manager
 	srv := server.New(cfg, logger)
 
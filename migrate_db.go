@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/database"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// runMigrateDB shows and changes the schema migrations applied to the
+// database, returning the exit code. The server applies pending migrations on
+// startup, so this is for checking on them and rolling them back.
+func runMigrateDB(cfg *config.Config, logger *zap.Logger, args []string) int {
+	flags := flag.NewFlagSet("migrate-db", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s migrate-db <command>\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Commands:")
+		fmt.Fprintln(flags.Output(), "  status     list the migrations and whether they're applied")
+		fmt.Fprintln(flags.Output(), "  up [n]     apply the next n migrations (default all)")
+		fmt.Fprintln(flags.Output(), "  down [n]   roll back the last n migrations (default 1)")
+		fmt.Fprintln(flags.Output(), "  force <v>  record version v as applied, after fixing a failed migration by hand")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	command := flags.Arg(0)
+	n := -1
+	if flags.NArg() == 2 {
+		parsed, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || parsed < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid number: %s\n", flags.Arg(1))
+			return 2
+		}
+		n = parsed
+	}
+
+	db, err := database.New(cfg, &gorm.Config{})
+	if err != nil {
+		logger.Error("failed to connect to database", zap.Error(err))
+		return 1
+	}
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db.DB)
+	if err != nil {
+		logger.Error("failed to load migrations", zap.Error(err))
+		return 1
+	}
+	defer migrator.Close()
+
+	switch {
+	case command == "status" && n < 0:
+	case command == "up":
+		err = migrator.Up(max(n, 0))
+	case command == "down":
+		if n < 0 {
+			n = 1
+		}
+		err = migrator.Down(n)
+	case command == "force" && n >= 0:
+		err = migrator.Force(n)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get migration status: %v\n", err)
+		return 1
+	}
+	for _, migration := range status.Migrations {
+		state := "pending"
+		if migration.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%06d\t%s\t%s\n", migration.Version, migration.Name, state)
+	}
+	switch {
+	case status.Legacy:
+		fmt.Println("Database was created before migrations were versioned, it's baselined on the next migration up")
+	case status.Dirty:
+		fmt.Printf("Database is at version %d, which failed part way; fix it by hand and force a version\n", status.Version)
+	default:
+		fmt.Printf("Database is at version %d\n", status.Version)
+	}
+	return 0
+}
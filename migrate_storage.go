@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/watzon/0x45/internal/config"
+	"github.com/watzon/0x45/internal/models"
+	"github.com/watzon/0x45/internal/server"
+	"github.com/watzon/0x45/internal/server/services"
+	"go.uber.org/zap"
+)
+
+// runMigrateStorage moves pastes between storage backends, returning the
+// exit code. The server can keep running while it does.
+func runMigrateStorage(ctx context.Context, cfg *config.Config, logger *zap.Logger, args []string) int {
+	flags := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s migrate-storage -to <storage> [options]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	opts := services.StorageMigrationOptions{}
+	flags.StringVar(&opts.From, "from", "", "only move pastes out of this storage (default all others)")
+	flags.StringVar(&opts.To, "to", "", "storage to move pastes to")
+	flags.DurationVar(&opts.OlderThan, "older-than", 0, "only move pastes created at least this long ago")
+	flags.Int64Var(&opts.MinSize, "min-size", 0, "only move pastes of at least this many bytes")
+	flags.Int64Var(&opts.MaxSize, "max-size", 0, "only move pastes of at most this many bytes")
+	flags.Float64Var(&opts.Rate, "rate", 10, "pastes moved per second, 0 for no limit")
+	flags.DurationVar(&opts.Grace, "grace", time.Minute, "how long moved content is kept for reads in progress")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "only list the pastes that would be moved")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if opts.To == "" {
+		flags.Usage()
+		return 2
+	}
+
+	opts.Progress = func(paste *models.Paste, err error) {
+		switch {
+		case err != nil:
+			fmt.Printf("%s\tfailed\t%v\n", paste.ID, err)
+		case opts.DryRun:
+			fmt.Printf("%s\t%s\t%s\n", paste.ID, paste.StorageName, humanize.Bytes(uint64(paste.Size)))
+		default:
+			fmt.Printf("%s\tmoved\t%s\n", paste.ID, humanize.Bytes(uint64(paste.Size)))
+		}
+	}
+
+	srv := server.New(cfg, logger)
+	defer func() {
+		if err := srv.Cleanup(); err != nil {
+			logger.Error("failed cleaning up server", zap.Error(err))
+		}
+	}()
+
+	result, err := srv.GetServices().Paste.MigrateStorage(ctx, opts)
+	verb := "Moved"
+	if opts.DryRun {
+		verb = "Would move"
+	}
+	fmt.Printf("%s %d pastes (%s) to %s, %d failed\n", verb, result.Migrated, humanize.Bytes(uint64(result.Bytes)), opts.To, result.Failed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration stopped: %v\n", err)
+		return 1
+	}
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,12 +1,14 @@
 import { initializeClipboard } from './clipboard.js';
 import { initializeCharts } from './charts/index.js';
 import { initializeFileUpload } from './upload.js';
+import { initializeEncryption } from './encrypted.js';
 
 // Initialize all features when DOM is ready
 document.addEventListener('DOMContentLoaded', () => {
     initializeClipboard();
     initializeCharts();
     initializeFileUpload();
+    initializeEncryption();
 
     // Handle code area expansion
     const expandBtn = document.querySelector('.expand-btn');
@@ -0,0 +1,182 @@
+import { copyToClipboard } from './clipboard.js';
+
+// Envelope format shared with the server, see "Encrypted pastes" in the docs
+const ENVELOPE_VERSION = 1;
+const ALGORITHM = 'AES-GCM';
+const KEY_LENGTH = 256;
+const IV_LENGTH = 12;
+
+function toBase64Url(bytes) {
+    let binary = '';
+    for (let i = 0; i < bytes.length; i++) {
+        binary += String.fromCharCode(bytes[i]);
+    }
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function fromBase64Url(str) {
+    const base64 = str.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+    return Uint8Array.from(atob(padded), c => c.charCodeAt(0));
+}
+
+// Encrypts content under a new random key. Returns the envelope to upload and
+// the key, which must only ever be put in the URL fragment.
+export async function encryptContent(plaintext) {
+    const key = await crypto.subtle.generateKey({ name: ALGORITHM, length: KEY_LENGTH }, true, ['encrypt']);
+    const iv = crypto.getRandomValues(new Uint8Array(IV_LENGTH));
+    const ciphertext = await crypto.subtle.encrypt({ name: ALGORITHM, iv }, key, plaintext);
+    const rawKey = await crypto.subtle.exportKey('raw', key);
+
+    return {
+        envelope: {
+            v: ENVELOPE_VERSION,
+            alg: ALGORITHM,
+            iv: toBase64Url(iv),
+            ct: toBase64Url(new Uint8Array(ciphertext)),
+        },
+        key: toBase64Url(new Uint8Array(rawKey)),
+    };
+}
+
+// Decrypts an envelope with a key taken from the URL fragment
+export async function decryptEnvelope(envelope, encodedKey) {
+    if (envelope.v !== ENVELOPE_VERSION || envelope.alg !== ALGORITHM) {
+        throw new Error('Unsupported envelope');
+    }
+
+    const key = await crypto.subtle.importKey('raw', fromBase64Url(encodedKey), { name: ALGORITHM }, false, ['decrypt']);
+    const plaintext = await crypto.subtle.decrypt(
+        { name: ALGORITHM, iv: fromBase64Url(envelope.iv) },
+        key,
+        fromBase64Url(envelope.ct),
+    );
+    return new Uint8Array(plaintext);
+}
+
+// Encrypts submissions from the new paste form when encryption is enabled
+function initializeEncryptedUpload() {
+    const form = document.getElementById('paste-form');
+    const checkbox = document.getElementById('encrypt');
+    if (!form || !checkbox) {
+        return;
+    }
+
+    form.addEventListener('submit', async (e) => {
+        if (!checkbox.checked) {
+            return;
+        }
+        e.preventDefault();
+
+        const fileInput = document.getElementById('file-upload');
+        const textarea = document.getElementById('content');
+        const file = fileInput.files[0];
+        const plaintext = file
+            ? new Uint8Array(await file.arrayBuffer())
+            : new TextEncoder().encode(textarea.value);
+        if (plaintext.length === 0) {
+            return;
+        }
+
+        const { envelope, key } = await encryptContent(plaintext);
+
+        // Only the envelope is sent, never the filename or the key
+        const body = new FormData();
+        body.append('content', JSON.stringify(envelope));
+        body.append('encrypted', 'true');
+        const expiresIn = document.getElementById('expires_in_hidden');
+        if (expiresIn && expiresIn.value) {
+            body.append('expires_in', expiresIn.value);
+        }
+
+        const response = await fetch(form.action, {
+            method: 'POST',
+            headers: { 'Accept': 'application/json' },
+            body,
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+
+        const paste = await response.json();
+
+        // Shown once on the paste page, just like a regular browser upload
+        document.cookie = `deletion_url=${paste.delete_url}; path=/; max-age=300; SameSite=Lax`;
+        window.location.href = `${paste.url}#${key}`;
+    });
+}
+
+// Decrypts the paste on the encrypted paste page
+async function initializeEncryptedViewer() {
+    const container = document.getElementById('encrypted-paste');
+    if (!container) {
+        return;
+    }
+
+    const status = document.getElementById('encrypted-status');
+    const key = window.location.hash.slice(1);
+    if (!key) {
+        status.textContent = '# This paste is encrypted, and the link you followed is missing its key.';
+        return;
+    }
+
+    let plaintext;
+    try {
+        plaintext = await decryptEnvelope(JSON.parse(container.dataset.envelope), key);
+    } catch (err) {
+        status.textContent = '# Failed to decrypt this paste. Check that you have the full link.';
+        return;
+    }
+
+    let text = null;
+    try {
+        text = new TextDecoder('utf-8', { fatal: true }).decode(plaintext);
+    } catch (err) {
+        // Binary content can only be downloaded
+    }
+
+    if (text !== null) {
+        status.style.display = 'none';
+        container.textContent = text;
+
+        const copyBtn = document.getElementById('encrypted-copy');
+        copyBtn.style.display = 'inline-block';
+        copyBtn.addEventListener('click', () => copyToClipboard(text, copyBtn));
+    } else {
+        status.textContent = '# This paste contains binary content.';
+    }
+
+    const downloadBtn = document.getElementById('encrypted-download');
+    downloadBtn.style.display = 'inline-block';
+    downloadBtn.addEventListener('click', () => {
+        const url = URL.createObjectURL(new Blob([plaintext]));
+        const link = document.createElement('a');
+        link.href = url;
+        link.download = container.dataset.filename + (text !== null ? '.txt' : '.bin');
+        link.click();
+        URL.revokeObjectURL(url);
+    });
+}
+
+// Carries the key in the URL fragment over to links and forms that lead to
+// another page of the same paste
+function initializeFragmentLinks() {
+    const fragment = window.location.hash;
+    if (!fragment) {
+        return;
+    }
+
+    document.querySelectorAll('a[data-keep-fragment]').forEach(link => {
+        link.href = link.href.split('#')[0] + fragment;
+    });
+    document.querySelectorAll('form[data-keep-fragment]').forEach(form => {
+        form.action = form.action.split('#')[0] + fragment;
+    });
+}
+
+export function initializeEncryption() {
+    initializeFragmentLinks();
+    initializeEncryptedUpload();
+    initializeEncryptedViewer();
+}